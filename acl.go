@@ -0,0 +1,234 @@
+package wiregate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ACLPolicy restricts which peers may reach each other through the server.
+// Rules name their members by public key, as "user:<name>" for nodes that
+// registered as that user, as "group:<name>" for the members of a group or
+// as "*" for every peer. Traffic between peers no rule allows is dropped.
+type ACLPolicy struct {
+	// Members of each group, which can't contain other groups
+	Groups map[string][]string `json:"groups,omitempty"`
+	Rules  []ACLRule           `json:"rules"`
+}
+
+// ACLRule lets the peers in From reach the peers in To, on Ports if any.
+type ACLRule struct {
+	From []string `json:"from"`
+	To   []string `json:"to"`
+	// Destination ports like "22", "53/udp" or "8000-8100/tcp", a port
+	// without protocol covers both TCP and UDP
+	Ports []string `json:"ports,omitempty"`
+}
+
+// PortRange is a range of TCP or UDP ports, an empty Proto covering both.
+type PortRange struct {
+	Proto       string
+	First, Last int
+}
+
+// PeerRule lets traffic from SourceIP to DestIP through the server, to Ports
+// if any. Either may be a subnet behind a peer, and an empty one matches any
+// peer.
+type PeerRule struct {
+	SourceIP string
+	DestIP   string
+	Ports    []PortRange
+}
+
+// allowAllPeers is what peers are allowed without an ACL policy.
+var allowAllPeers = []PeerRule{{}}
+
+// ParsePortRange parses a port spec like "22", "53/udp" or "8000-8100/tcp".
+func ParsePortRange(spec string) (PortRange, error) {
+	var r PortRange
+	ports := spec
+	if i := strings.Index(spec, "/"); i >= 0 {
+		ports, r.Proto = spec[:i], spec[i+1:]
+		if r.Proto != "tcp" && r.Proto != "udp" {
+			return r, fmt.Errorf("Port %q has protocol %q, expected tcp or udp", spec, r.Proto)
+		}
+	}
+	first, last := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		first, last = ports[:i], ports[i+1:]
+	}
+	var err error
+	if r.First, err = strconv.Atoi(first); err == nil {
+		r.Last, err = strconv.Atoi(last)
+	}
+	if err != nil || r.First < 1 || r.Last > 65535 || r.First > r.Last {
+		return r, fmt.Errorf("Port %q isn't a port or range of ports", spec)
+	}
+	return r, nil
+}
+
+// Validate checks that rules only refer to defined groups and valid ports.
+func (p *ACLPolicy) Validate() error {
+	for name, members := range p.Groups {
+		for _, m := range members {
+			if err := p.validateMember(m); err != nil {
+				return fmt.Errorf("Group %q: %s", name, err)
+			}
+			if strings.HasPrefix(m, "group:") || m == "*" {
+				return fmt.Errorf("Group %q can only contain public keys and users, not %q", name, m)
+			}
+		}
+	}
+	for i, rule := range p.Rules {
+		if len(rule.From) == 0 || len(rule.To) == 0 {
+			return fmt.Errorf("ACL rule %d needs both 'from' and 'to'", i+1)
+		}
+		for _, m := range append(append([]string(nil), rule.From...), rule.To...) {
+			if err := p.validateMember(m); err != nil {
+				return fmt.Errorf("ACL rule %d: %s", i+1, err)
+			}
+		}
+		for _, port := range rule.Ports {
+			if _, err := ParsePortRange(port); err != nil {
+				return fmt.Errorf("ACL rule %d: %s", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// withRenamedKeys returns a copy of p in which the public keys in renamed are
+// replaced by the keys they map to.
+func (p *ACLPolicy) withRenamedKeys(renamed map[string]string) *ACLPolicy {
+	if p == nil || len(renamed) == 0 {
+		return p
+	}
+	rename := func(members []string) []string {
+		renamedMembers := make([]string, len(members))
+		for i, m := range members {
+			if key, ok := renamed[m]; ok {
+				m = key
+			}
+			renamedMembers[i] = m
+		}
+		return renamedMembers
+	}
+	copied := &ACLPolicy{Rules: make([]ACLRule, len(p.Rules))}
+	if p.Groups != nil {
+		copied.Groups = make(map[string][]string, len(p.Groups))
+		for name, members := range p.Groups {
+			copied.Groups[name] = rename(members)
+		}
+	}
+	for i, rule := range p.Rules {
+		copied.Rules[i] = ACLRule{From: rename(rule.From), To: rename(rule.To), Ports: rule.Ports}
+	}
+	return copied
+}
+
+// HasPortRules tells whether any rule is limited to some ports, which only
+// the server's firewall can enforce.
+func (p *ACLPolicy) HasPortRules() bool {
+	for _, rule := range p.Rules {
+		if len(rule.Ports) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ACLPolicy) validateMember(member string) error {
+	switch {
+	case member == "*":
+		return nil
+	case strings.HasPrefix(member, "group:"):
+		if _, ok := p.Groups[strings.TrimPrefix(member, "group:")]; !ok {
+			return fmt.Errorf("Unknown group %q", member)
+		}
+		return nil
+	case strings.HasPrefix(member, "user:"):
+		if member == "user:" {
+			return fmt.Errorf("Missing user name in %q", member)
+		}
+		return nil
+	}
+	return ValidateKey(member)
+}
+
+// matches tells whether member covers the node with pubKey and user.
+func (p *ACLPolicy) matches(member, pubKey, user string) bool {
+	switch {
+	case member == "*":
+		return true
+	case strings.HasPrefix(member, "group:"):
+		for _, m := range p.Groups[strings.TrimPrefix(member, "group:")] {
+			if p.matches(m, pubKey, user) {
+				return true
+			}
+		}
+		return false
+	case strings.HasPrefix(member, "user:"):
+		return user != "" && member == "user:"+user
+	}
+	return member == pubKey
+}
+
+func (p *ACLPolicy) matchesAny(members []string, pubKey, user string) bool {
+	for _, m := range members {
+		if p.matches(m, pubKey, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns the rules that let the first node reach the second.
+func (p *ACLPolicy) allows(fromKey, fromUser, toKey, toUser string) []ACLRule {
+	var rules []ACLRule
+	for _, rule := range p.Rules {
+		if p.matchesAny(rule.From, fromKey, fromUser) && p.matchesAny(rule.To, toKey, toUser) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// CanSee tells whether a node should know about a peer, which it does if
+// either may reach the other.
+func (p *ACLPolicy) CanSee(viewerKey, viewerUser, peerKey, peerUser string) bool {
+	if p == nil || viewerKey == peerKey {
+		return true
+	}
+	return len(p.allows(viewerKey, viewerUser, peerKey, peerUser)) > 0 ||
+		len(p.allows(peerKey, peerUser, viewerKey, viewerUser)) > 0
+}
+
+// PeerRules returns the firewall rules enforcing the policy between nodes. A
+// nil policy allows all traffic between peers.
+func (p *ACLPolicy) PeerRules(nodes []*Node) []PeerRule {
+	if p == nil {
+		return allowAllPeers
+	}
+	rules := make([]PeerRule, 0)
+	for _, from := range nodes {
+		for _, to := range nodes {
+			if from == to {
+				continue
+			}
+			for _, rule := range p.allows(from.PubKey, from.User, to.PubKey, to.User) {
+				var ports []PortRange
+				for _, port := range rule.Ports {
+					portRange, _ := ParsePortRange(port)
+					ports = append(ports, portRange)
+				}
+				// Subnets behind a node are reached as the node itself
+				for _, source := range append([]string{from.VPNIP}, from.Subnets...) {
+					for _, dest := range append([]string{to.VPNIP}, to.Subnets...) {
+						rules = append(rules, PeerRule{SourceIP: source, DestIP: dest, Ports: ports})
+					}
+				}
+			}
+		}
+	}
+	return rules
+}
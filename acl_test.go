@@ -0,0 +1,142 @@
+package wiregate
+
+import (
+	"reflect"
+	"testing"
+)
+
+const nasKey = "itqZxy1VH5NlqGdZvVy02VsJLGqpVlhAoNpXmFKt60E="
+
+var testACL = &ACLPolicy{
+	Groups: map[string][]string{
+		"admins":  {"user:alice"},
+		"servers": {nasKey},
+	},
+	Rules: []ACLRule{
+		{From: []string{"group:admins"}, To: []string{"*"}},
+		{From: []string{"*"}, To: []string{"group:servers"}, Ports: []string{"443/tcp"}},
+	},
+}
+
+func TestParsePortRange(t *testing.T) {
+	var portTests = []struct {
+		spec     string
+		expected PortRange
+		valid    bool
+	}{
+		{"22", PortRange{First: 22, Last: 22}, true},
+		{"53/udp", PortRange{Proto: "udp", First: 53, Last: 53}, true},
+		{"8000-8100/tcp", PortRange{Proto: "tcp", First: 8000, Last: 8100}, true},
+		{"22/icmp", PortRange{}, false},
+		{"100-10", PortRange{}, false},
+		{"0", PortRange{}, false},
+		{"ssh", PortRange{}, false},
+	}
+	for _, tt := range portTests {
+		r, err := ParsePortRange(tt.spec)
+		if tt.valid && (err != nil || r != tt.expected) {
+			t.Errorf("Expected %s to parse as %+v, got %+v (%v)", tt.spec, tt.expected, r, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Expected %s to be invalid, got %+v", tt.spec, r)
+		}
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	if err := testACL.Validate(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	var invalid = []*ACLPolicy{
+		{Rules: []ACLRule{{From: []string{"group:missing"}, To: []string{"*"}}}},
+		{Rules: []ACLRule{{From: []string{"*"}}}},
+		{Rules: []ACLRule{{From: []string{"not-a-key"}, To: []string{"*"}}}},
+		{Rules: []ACLRule{{From: []string{"*"}, To: []string{"*"}, Ports: []string{"http"}}}},
+		{Groups: map[string][]string{"all": {"*"}}},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", p)
+		}
+	}
+}
+
+func TestACLHasPortRules(t *testing.T) {
+	var tests = []struct {
+		policy   *ACLPolicy
+		expected bool
+	}{
+		{&ACLPolicy{}, false},
+		{&ACLPolicy{Rules: []ACLRule{{From: []string{"*"}, To: []string{"*"}}}}, false},
+		{testACL, true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.HasPortRules(); got != tt.expected {
+			t.Errorf("Expected HasPortRules() of %+v to be %v, got %v", tt.policy, tt.expected, got)
+		}
+	}
+}
+
+func TestACLWithRenamedKeys(t *testing.T) {
+	policy := &ACLPolicy{
+		Groups: map[string][]string{"admins": {"oldKey", "user:alice"}},
+		Rules:  []ACLRule{{From: []string{"oldKey"}, To: []string{"*"}, Ports: []string{"22"}}},
+	}
+	renamed := policy.withRenamedKeys(map[string]string{"oldKey": "newKey"})
+	expected := &ACLPolicy{
+		Groups: map[string][]string{"admins": {"newKey", "user:alice"}},
+		Rules:  []ACLRule{{From: []string{"newKey"}, To: []string{"*"}, Ports: []string{"22"}}},
+	}
+	if !reflect.DeepEqual(renamed, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, renamed)
+	}
+	if policy.Groups["admins"][0] != "oldKey" || policy.Rules[0].From[0] != "oldKey" {
+		t.Errorf("Expected the original policy to be left alone, got %+v", policy)
+	}
+	var none *ACLPolicy
+	if none.withRenamedKeys(map[string]string{"oldKey": "newKey"}) != nil {
+		t.Errorf("Expected no policy to stay nil")
+	}
+}
+
+func TestACLPeerRules(t *testing.T) {
+	alice := &Node{PubKey: "aliceKey", VPNIP: "10.0.0.2", User: "alice"}
+	bob := &Node{PubKey: "bobKey", VPNIP: "10.0.0.3", User: "bob"}
+	nas := &Node{PubKey: nasKey, VPNIP: "10.0.0.4"}
+
+	rules := testACL.PeerRules([]*Node{alice, bob, nas})
+	expected := []PeerRule{
+		{SourceIP: "10.0.0.2", DestIP: "10.0.0.3"},
+		{SourceIP: "10.0.0.2", DestIP: "10.0.0.4"},
+		{SourceIP: "10.0.0.2", DestIP: "10.0.0.4", Ports: []PortRange{{Proto: "tcp", First: 443, Last: 443}}},
+		{SourceIP: "10.0.0.3", DestIP: "10.0.0.4", Ports: []PortRange{{Proto: "tcp", First: 443, Last: 443}}},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected rules %+v, got %+v", expected, rules)
+	}
+
+	// Bob can reach the NAS, which therefore sees him, but nobody lets the
+	// NAS reach alice's peers other than through her own rule
+	if !testACL.CanSee(nas.PubKey, "", bob.PubKey, bob.User) || !testACL.CanSee(bob.PubKey, bob.User, alice.PubKey, alice.User) {
+		t.Errorf("Expected peers that may reach each other to see each other")
+	}
+	other := &Node{PubKey: "otherKey", VPNIP: "10.0.0.5"}
+	if testACL.CanSee(bob.PubKey, bob.User, other.PubKey, other.User) {
+		t.Errorf("Expected bob not to see a peer he can't reach")
+	}
+
+	lab := &Node{PubKey: "labKey", VPNIP: "10.0.0.6", User: "bob", Subnets: []string{"192.168.50.0/24"}}
+	rules = testACL.PeerRules([]*Node{alice, lab})
+	expected = []PeerRule{
+		{SourceIP: "10.0.0.2", DestIP: "10.0.0.6"},
+		{SourceIP: "10.0.0.2", DestIP: "192.168.50.0/24"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected subnets to be reached like their node, got %+v", rules)
+	}
+
+	var noPolicy *ACLPolicy
+	if rules := noPolicy.PeerRules([]*Node{alice, bob}); !reflect.DeepEqual(rules, []PeerRule{{}}) {
+		t.Errorf("Expected all traffic to be allowed without a policy, got %+v", rules)
+	}
+}
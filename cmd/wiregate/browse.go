@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ideasynthesis/mdns"
+	log "github.com/sirupsen/logrus"
+)
+
+const wiregateServiceName = "_wiregate._tcp"
+
+// How long each mDNS query collects answers, and how long the browser waits
+// before asking again.
+const (
+	browseQueryTimeout = 2 * time.Second
+	browseInterval     = 3 * time.Second
+)
+
+// serviceBrowser keeps querying mDNS for WireGate services until it's
+// stopped, keeping the latest answer of every service instance. Services that
+// stop answering stay in the list, so indices into it don't shift.
+type serviceBrowser struct {
+	// Only keep services of this network, if set
+	network string
+
+	mu        sync.Mutex
+	services  []*WireGateService
+	instances map[string]int
+	updates   chan struct{}
+
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// browseServices starts browsing for WireGate services of network, or of any
+// network if it's empty.
+func browseServices(network string) *serviceBrowser {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &serviceBrowser{
+		network:   network,
+		instances: make(map[string]int),
+		updates:   make(chan struct{}, 1),
+		cancel:    cancel,
+		stopped:   make(chan struct{}),
+	}
+	go b.run(ctx)
+	return b
+}
+
+func (b *serviceBrowser) run(ctx context.Context) {
+	defer close(b.stopped)
+	for {
+		entries := make(chan *mdns.ServiceEntry, 16)
+		queryCtx, cancel := context.WithTimeout(ctx, browseQueryTimeout)
+		go func() {
+			if err := mdns.Query(&mdns.QueryParam{Service: wiregateServiceName, Context: queryCtx, Entries: entries}); err != nil {
+				log.Debugf("mDNS query failed: %s", err)
+			}
+			close(entries)
+		}()
+		for entry := range entries {
+			b.add(entry)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(browseInterval):
+		}
+	}
+}
+
+// add records entry, replacing an earlier answer of the same instance.
+func (b *serviceBrowser) add(entry *mdns.ServiceEntry) {
+	if len(entry.AddrV4)+len(entry.AddrV6) == 0 {
+		return
+	}
+	svc := WGServiceFromServiceEntry(entry)
+	if b.network != "" && svc.Network != b.network {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i, ok := b.instances[svc.Instance]; ok {
+		if reflect.DeepEqual(b.services[i], svc) {
+			return
+		}
+		b.services[i] = svc
+	} else {
+		b.instances[svc.Instance] = len(b.services)
+		b.services = append(b.services, svc)
+	}
+	select {
+	case b.updates <- struct{}{}:
+	default:
+	}
+}
+
+// Updates receives a value after a service was found or changed.
+// Notifications are coalesced, so readers should look at all of Services.
+func (b *serviceBrowser) Updates() <-chan struct{} {
+	return b.updates
+}
+
+// Services returns the services found so far, in the order they were found.
+func (b *serviceBrowser) Services() []*WireGateService {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*WireGateService(nil), b.services...)
+}
+
+// Stop stops browsing and waits for the last query to finish.
+func (b *serviceBrowser) Stop() {
+	b.cancel()
+	<-b.stopped
+}
+
+// sameService tells whether a and b are the same server, by instance name or,
+// for services saved before instance names were, by host name. Services
+// advertising different WireGuard keys aren't the same server.
+func sameService(a, b *WireGateService) bool {
+	if a.Fingerprint != "" && b.Fingerprint != "" && a.Fingerprint != b.Fingerprint {
+		return false
+	}
+	if a.Instance != "" && b.Instance != "" {
+		return a.Instance == b.Instance
+	}
+	return a.Host == b.Host
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ideasynthesis/mdns"
+)
+
+func testServiceEntry(instance, addr string, txt ...string) *mdns.ServiceEntry {
+	entry := &mdns.ServiceEntry{Name: instance, Host: "server.local.", Port: 38490, InfoFields: txt}
+	switch ip := net.ParseIP(addr); {
+	case ip == nil:
+	case ip.To4() != nil:
+		entry.AddrV4 = []net.IP{ip}
+	default:
+		entry.AddrV6 = []net.IP{ip}
+	}
+	return entry
+}
+
+func TestServiceBrowserAdd(t *testing.T) {
+	office := "office._wiregate._tcp.local."
+	lab := "lab._wiregate._tcp.local."
+	var addTests = []struct {
+		name    string
+		network string
+		entries []*mdns.ServiceEntry
+		// HTTP endpoints of the services kept, in order
+		expected []string
+		// Whether each entry notified readers
+		updates []bool
+	}{
+		{"new services", "", []*mdns.ServiceEntry{
+			testServiceEntry(office, "192.168.1.10"),
+			testServiceEntry(lab, "fd00::20"),
+		}, []string{"192.168.1.10:38490", "[fd00::20]:38490"}, []bool{true, true}},
+		{"repeated answer", "", []*mdns.ServiceEntry{
+			testServiceEntry(office, "192.168.1.10"),
+			testServiceEntry(office, "192.168.1.10"),
+		}, []string{"192.168.1.10:38490"}, []bool{true, false}},
+		{"moved service keeps its place", "", []*mdns.ServiceEntry{
+			testServiceEntry(office, "192.168.1.10"),
+			testServiceEntry(lab, "192.168.1.20"),
+			testServiceEntry(office, "192.168.1.11"),
+		}, []string{"192.168.1.11:38490", "192.168.1.20:38490"}, []bool{true, true, true}},
+		{"changed TXT records", "", []*mdns.ServiceEntry{
+			testServiceEntry(office, "192.168.1.10", "v=1", "desc=Office", "cap=253", "free=250"),
+			testServiceEntry(office, "192.168.1.10", "v=1", "desc=Office", "cap=253", "free=249"),
+		}, []string{"192.168.1.10:38490"}, []bool{true, true}},
+		{"answer without addresses", "", []*mdns.ServiceEntry{
+			testServiceEntry(office, ""),
+		}, nil, []bool{false}},
+		{"other networks", "home", []*mdns.ServiceEntry{
+			testServiceEntry(office, "192.168.1.10", "v=1", "desc=Office", "net=work"),
+			testServiceEntry(lab, "192.168.1.20", "v=1", "desc=Lab", "net=home"),
+			testServiceEntry("legacy._wiregate._tcp.local.", "192.168.1.30", "Legacy"),
+		}, []string{"192.168.1.20:38490"}, []bool{false, true, false}},
+	}
+	for _, tt := range addTests {
+		b := &serviceBrowser{network: tt.network, instances: make(map[string]int), updates: make(chan struct{}, 1)}
+		for i, entry := range tt.entries {
+			b.add(entry)
+			updated := false
+			select {
+			case <-b.Updates():
+				updated = true
+			default:
+			}
+			if updated != tt.updates[i] {
+				t.Errorf("%s: expected entry %d to notify readers: %t, got %t", tt.name, i, tt.updates[i], updated)
+			}
+		}
+		services := b.Services()
+		if len(services) != len(tt.expected) {
+			t.Errorf("%s: expected services at %v, got %d of them", tt.name, tt.expected, len(services))
+			continue
+		}
+		for i, svc := range services {
+			if svc.HTTPEndpoint != tt.expected[i] {
+				t.Errorf("%s: expected service %d at %s, got %s", tt.name, i, tt.expected[i], svc.HTTPEndpoint)
+			}
+		}
+	}
+}
+
+func TestSameService(t *testing.T) {
+	var sameTests = []struct {
+		name     string
+		a, b     *WireGateService
+		expected bool
+	}{
+		{"same instance",
+			&WireGateService{Instance: "office", Host: "a.local."},
+			&WireGateService{Instance: "office", Host: "b.local."}, true},
+		{"other instance on the same host",
+			&WireGateService{Instance: "office", Host: "a.local."},
+			&WireGateService{Instance: "lab", Host: "a.local."}, false},
+		{"saved without an instance, same host",
+			&WireGateService{Host: "a.local."},
+			&WireGateService{Instance: "office", Host: "a.local."}, true},
+		{"saved without an instance, other host",
+			&WireGateService{Host: "a.local."},
+			&WireGateService{Instance: "office", Host: "b.local."}, false},
+	}
+	for _, tt := range sameTests {
+		if same := sameService(tt.a, tt.b); same != tt.expected {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.expected, same)
+		}
+	}
+
+	a := &WireGateService{Instance: "office"}
+	b := &WireGateService{Instance: "office"}
+	a.Fingerprint, b.Fingerprint = "0123456789abcdef", "0123456789abcdef"
+	if !sameService(a, b) {
+		t.Errorf("Expected services with the same key to be the same")
+	}
+	b.Fingerprint = "fedcba9876543210"
+	if sameService(a, b) {
+		t.Errorf("Expected services with different keys not to be the same")
+	}
+	b.Fingerprint = ""
+	if !sameService(a, b) {
+		t.Errorf("Expected a service without a fingerprint to match by instance")
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -27,25 +30,55 @@ import (
 // TODO refactor this prototype, goal is to dedupe and share more code
 
 type WireGateService struct {
+	// mDNS instance name, which tells servers apart
+	Instance     string
 	Host         string
 	Addr         string
 	Port         int
 	HTTPEndpoint string
-	Description  string
+	// What the server advertises in its mDNS TXT records
+	wg.ServiceInfo
 }
 
+// WGServiceFromServiceEntry describes a server found over mDNS, reached at
+// the first of its IPv4 or IPv6 addresses that's on a local subnet.
 func WGServiceFromServiceEntry(entry *mdns.ServiceEntry) *WireGateService {
-	description := strings.Join(entry.InfoFields, ", ")
-	httpEndpoint := fmt.Sprintf("%s:%d", entry.AddrV4[0].String(), entry.Port)
+	addr := pickAddress(append(append([]net.IP(nil), entry.AddrV4...), entry.AddrV6...)).String()
 	return &WireGateService{
+		Instance:     entry.Name,
 		Host:         entry.Host,
-		Addr:         entry.AddrV4[0].String(),
+		Addr:         addr,
 		Port:         entry.Port,
-		HTTPEndpoint: httpEndpoint,
-		Description:  description,
+		HTTPEndpoint: net.JoinHostPort(addr, strconv.Itoa(entry.Port)),
+		ServiceInfo:  *wg.ParseServiceInfo(entry.InfoFields),
 	}
 }
 
+// details describes what the service advertises besides its description,
+// for picking one out of several.
+func (s *WireGateService) details() string {
+	var details []string
+	if s.Network != "" {
+		details = append(details, "network "+s.Network)
+	}
+	if s.Capacity > 0 {
+		details = append(details, fmt.Sprintf("%d/%d IPs free", s.FreeIPs, s.Capacity))
+	}
+	if s.AuthMode == wg.AuthPasswordUsers {
+		details = append(details, "user accounts")
+	}
+	if s.IPv6 {
+		details = append(details, "IPv6")
+	}
+	if s.Fingerprint != "" {
+		details = append(details, "key "+s.Fingerprint)
+	}
+	if s.Version > wg.MDNSProtocolVersion {
+		details = append(details, "newer WireGate version, may not work")
+	}
+	return strings.Join(details, ", ")
+}
+
 type WireGateHTTPClient struct {
 	client *http.Client
 }
@@ -58,96 +91,75 @@ type RegisteredNode struct {
 	ServerPubKey       string
 	ServerPeerIP       string
 	AllowedIPs         []string
+	Mesh               bool
+	Gateway            string
+	Routes             []string
+	DNS                []string
+	PresharedKey       string
+	HeartBeatInterval  time.Duration
+	GracePeriod        time.Duration
+	Lease              time.Duration
 }
 
-func (w *WireGateHTTPClient) registerNode(publicKey, vpnPassword, apiEndpoint string) *RegisteredNode {
+var errBadPassword = errors.New("Bad password")
+var errNodeNotFound = errors.New("WireGate server doesn't know this node")
+var errIPPoolExhausted = errors.New("WireGate server has no IPs left to lease")
+var errServerShuttingDown = errors.New("WireGate server is shutting down")
+var errSessionClosed = errors.New("Session closed")
+var errRekeyDue = errors.New("WireGuard key is due for rotation")
+var errInterfaceExists = errors.New("Interface already exists")
+var errSubnetOverlap = errors.New("VPN subnet overlaps another WireGate network")
+
+// registerNode sends registerReq to the server at apiEndpoint.
+func (w *WireGateHTTPClient) registerNode(registerReq *wg.RegistrationRequest, apiEndpoint string) (*RegisteredNode, error) {
 	var reqBuffer bytes.Buffer
-	registerReq := &wg.RegistrationRequest{
-		PublicKey: publicKey,
-		Password:  vpnPassword,
-	}
 	json.NewEncoder(&reqBuffer).Encode(registerReq)
 	url := fmt.Sprintf("https://%s/register", apiEndpoint)
 	rsp, err := w.client.Post(url, "application/json", &reqBuffer)
 	if err != nil {
-		log.Errorf("Fatal error while communicating with WireGate Control: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error while communicating with WireGate Control: %s", err)
 	}
+	defer rsp.Body.Close()
 	if rsp.StatusCode != 200 {
 		if rsp.StatusCode == 403 {
-			log.Errorf("Bad password!")
-			os.Exit(1)
+			return nil, errBadPassword
+		}
+		if rsp.StatusCode == 503 {
+			return nil, errIPPoolExhausted
 		}
 		body, err := ioutil.ReadAll(rsp.Body)
 		if err != nil {
-			log.Errorf("Error while reading error response from server: %s", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("Error while reading error response from server: %s", err)
 		}
-		log.Errorf("Server error (%d): %s", rsp.StatusCode, string(body))
-		os.Exit(1)
+		return nil, fmt.Errorf("Server error (%d): %s", rsp.StatusCode, strings.TrimSpace(string(body)))
 	}
-	reqBuffer.Reset()
 
 	log.Debugf("registerNode response: %#v\n", rsp)
 	var registerRsp wg.RegistrationReply
 	err = json.NewDecoder(rsp.Body).Decode(&registerRsp)
 	if err != nil {
-		log.Errorf("Fatal error while decoding json response from WireGate Control: %s", err)
-		log.Debugf("registerNode response body %#v\n", rsp.Body)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error while decoding json response from WireGate Control: %s", err)
+	}
+	heartBeatInterval := defaultHeartBeatInterval
+	if registerRsp.HeartBeatInterval > 0 {
+		heartBeatInterval = time.Duration(registerRsp.HeartBeatInterval) * time.Second
 	}
 	return &RegisteredNode{
+		HeartBeatInterval:  heartBeatInterval,
+		GracePeriod:        time.Duration(registerRsp.HeartBeatGracePeriod) * time.Second,
 		IP:                 registerRsp.NodeIp,
 		CIDR:               registerRsp.NodeCIDR,
-		EndpointIPPortPair: registerRsp.EndpointIPPortPair,
+		EndpointIPPortPair: chooseEndpoint(registerRsp.EndpointIPPortPair, registerRsp.Endpoints, apiEndpoint),
 		ServerPubKey:       registerRsp.WGServerPublicKey,
 		ServerPeerIP:       registerRsp.WGServerPeerIP,
 		AllowedIPs:         registerRsp.AllowedIPs,
-	}
-}
-
-func (w *WireGateHTTPClient) StartHeartBeat(wgService *WireGateService, pubKey, serverPubkey, serverIP string) {
-	var reqBuffer bytes.Buffer
-	var rspBuffer bytes.Buffer
-	hbReq := &wg.HeartBeatRequest{
-		PublicKey: pubKey,
-	}
-	json.NewEncoder(&reqBuffer).Encode(hbReq)
-	hbReqReader := bytes.NewReader(reqBuffer.Bytes())
-	hbTicker := time.NewTicker(5 * time.Second)
-	endpointURL := fmt.Sprintf("https://%s/beat", wgService.HTTPEndpoint)
-	log.Info("Starting heart beat")
-heartBeatLoop:
-	for {
-		select {
-		case <-hbTicker.C:
-			rspBuffer.Reset()
-			rsp, err := w.client.Post(endpointURL, "application/json", hbReqReader)
-			if err != nil {
-				log.Errorf("Error while talking with WireGate server: %s", err)
-				break heartBeatLoop
-			}
-			hbReqReader.Seek(0, 0)
-
-			log.Debugf("Received beat response: %#v", rsp)
-			var hbRsp wg.HeartBeatResponse
-			err = json.NewDecoder(rsp.Body).Decode(&hbRsp)
-			if err != nil {
-				log.Errorf("Error while decoding heartbeat response: %s", err)
-				break heartBeatLoop
-			}
-			// TODO: what if wg cmd stalls for too long?
-			formattedAllowedIPs := formatAllowedIPsWithCIDR(append(hbRsp.AllowedIPs, serverIP))
-			log.Debugf("Extracted allowedIPs from beat: %v", formattedAllowedIPs)
-			setAllowedIPs := exec.Command("wg", "set", "wg0", "peer", serverPubkey, "allowed-ips", formattedAllowedIPs)
-			if _, err := setAllowedIPs.CombinedOutput(); err != nil {
-				log.Errorf("Error while setting up WireGuard interface settings: %s", err)
-				os.Exit(1)
-			}
-
-		}
-	}
-	log.Info("Stopping heart beat")
+		Mesh:               registerRsp.Mesh,
+		Gateway:            registerRsp.Gateway,
+		Routes:             registerRsp.Routes,
+		DNS:                registerRsp.DNS,
+		PresharedKey:       registerRsp.PresharedKey,
+		Lease:              time.Duration(registerRsp.Lease) * time.Second,
+	}, nil
 }
 
 func get_http_client() *WireGateHTTPClient {
@@ -168,49 +180,144 @@ func get_http_client() *WireGateHTTPClient {
 	}
 }
 
-func query_mdns_wiregate_svcs(serviceName string, timeout int) []*WireGateService {
-	mdnsTimeout := time.Duration(timeout) * time.Second
-	serviceEntryChannel := make(chan *mdns.ServiceEntry, 1)
-	entries := make([]*WireGateService, 0)
+// waitForServices gives browser timeout to find services, returning early
+// once one matching selector is found, unless selector is an index.
+func waitForServices(browser *serviceBrowser, selector string, timeout time.Duration) []*WireGateService {
+	_, err := strconv.Atoi(selector)
+	byIndex := err == nil
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return browser.Services()
+		case <-browser.Updates():
+			if selector == "" || byIndex {
+				continue
+			}
+			services := browser.Services()
+			if _, err := selectService(services, selector); err == nil {
+				return services
+			}
+		}
+	}
+}
+
+func printServiceChoice(i int, svc *WireGateService) {
+	if details := svc.details(); details != "" {
+		fmt.Printf("%d) %s (%s) %s\n", i, svc.Description, svc.HTTPEndpoint, details)
+	} else {
+		fmt.Printf("%d) %s (%s)\n", i, svc.Description, svc.HTTPEndpoint)
+	}
+}
+
+// serviceChoicePrompt asks which of the services browser found to connect
+// to, listing services found or changed while it waits for an answer.
+func serviceChoicePrompt(browser *serviceBrowser, stdin *bufio.Reader) *WireGateService {
+	choices := make(chan string)
 	go func() {
-		mdns.Lookup(serviceName, serviceEntryChannel)
-		close(serviceEntryChannel)
+		choiceStr, err := stdin.ReadString('\n')
+		if err != nil {
+			log.Errorf("Error while reading from console: %s", err)
+			os.Exit(1)
+		}
+		choices <- choiceStr
 	}()
+	fmt.Println("Found following WireGate services running on local network, more are listed as they show up:")
+	var shown []*WireGateService
 	for {
+		services := browser.Services()
+		var changed bool
+		for i, svc := range services {
+			if i < len(shown) && shown[i] == svc {
+				continue
+			}
+			if !changed && shown != nil {
+				fmt.Println()
+			}
+			changed = true
+			printServiceChoice(i, svc)
+		}
+		if changed {
+			fmt.Printf("Enter number of service you wish to connect to (0-%d): ", len(services)-1)
+			shown = services
+		}
 		select {
-		case entry, ok := <-serviceEntryChannel:
-			if !ok {
-				return entries
+		case choiceStr := <-choices:
+			choice, err := strconv.Atoi(strings.TrimSpace(choiceStr))
+			if err != nil {
+				log.Errorf("%s is not a number!", choiceStr)
+				os.Exit(1)
 			}
-			entries = append(entries, WGServiceFromServiceEntry(entry))
-		case <-time.After(mdnsTimeout):
-			return entries
+			if choice < 0 || choice >= len(shown) {
+				log.Errorf("%s is outside the range of valid choices", choiceStr)
+				os.Exit(1)
+			}
+			return shown[choice]
+		case <-browser.Updates():
 		}
 	}
 }
 
-func serviceChoicePrompt(serviceChoices []*WireGateService) *WireGateService {
-	consoleReader := bufio.NewReader(os.Stdin)
-	fmt.Println("Found following WireGate services running on local network:")
-	for i, svc := range serviceChoices {
-		fmt.Printf("%d) %s (%s:%d)\n", i, svc.Description, svc.Addr, svc.Port)
-	}
-	fmt.Printf("Enter number of service you wish to connect to (0-%d): ", len(serviceChoices)-1)
-	choiceStr, err := consoleReader.ReadString('\n')
+// isHostPort reports whether selector looks like host:port rather than a
+// service name or index.
+func isHostPort(selector string) bool {
+	_, port, err := net.SplitHostPort(selector)
 	if err != nil {
-		log.Errorf("Error while reading from console: %s", err)
-		os.Exit(1)
+		return false
 	}
-	choice, err := strconv.Atoi(strings.TrimSpace(choiceStr))
-	if err != nil {
-		log.Errorf("%s is not a number!", choiceStr)
-		os.Exit(1)
+	_, err = strconv.Atoi(port)
+	return err == nil
+}
+
+// selectService picks the service matching selector, which is either an
+// index into services, a host:port pair, a service description or a host name.
+func selectService(services []*WireGateService, selector string) (*WireGateService, error) {
+	if choice, err := strconv.Atoi(selector); err == nil {
+		if choice < 0 || choice >= len(services) {
+			return nil, fmt.Errorf("%d is outside the range of found services (0-%d)", choice, len(services)-1)
+		}
+		return services[choice], nil
 	}
-	if choice < 0 || choice > len(serviceChoices) {
-		log.Errorf("%s is outside the range of valid choices", choiceStr)
-		os.Exit(1)
+	for _, svc := range services {
+		if svc.HTTPEndpoint == selector || svc.Description == selector || strings.TrimSuffix(svc.Host, ".") == strings.TrimSuffix(selector, ".") {
+			return svc, nil
+		}
+	}
+	return nil, fmt.Errorf("No WireGate service matching '%s' found", selector)
+}
+
+// readPassword gets the VPN password from the first configured source: a
+// file, an environment variable or a line on stdin, and prompts for it on the
+// terminal if none is set.
+func readPassword(conf *ClientConfig) (string, error) {
+	switch {
+	case conf.passwordFile != "":
+		contents, err := ioutil.ReadFile(conf.passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("Error while reading password file: %s", err)
+		}
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	case conf.passwordEnv != "":
+		password, ok := os.LookupEnv(conf.passwordEnv)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s is not set", conf.passwordEnv)
+		}
+		return password, nil
+	case conf.passwordStdin:
+		line, err := conf.stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("Error while reading password from stdin: %s", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Printf("Enter password: ")
+	password, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Printf("\n")
+	if err != nil {
+		return "", fmt.Errorf("Error while reading password from terminal: %s", err)
 	}
-	return serviceChoices[choice]
+	return string(password), nil
 }
 
 func generateWGKeypair() (string, string) {
@@ -265,99 +372,156 @@ func WriteRestrictedFile(fname, contents string) (string, error) {
 	return fpath, nil
 }
 
-func createWGInterface(wgPrivKey string, registeredNode *RegisteredNode) {
-	// TODO: make interface name be customizable
-	ifaceName := "wg0"
-	if _, err := exec.LookPath("wg"); err != nil {
-		log.Errorf("Error: Unable to call 'wg', is WireGuard installed?")
-		os.Exit(1)
-	}
-	// TODO how to handle cleaning up?
-	log.Debugf("Creating interface %s", ifaceName)
-	createIface := exec.Command("ip", "link", "add", "dev", ifaceName, "type", "wireguard")
-	if _, err := createIface.CombinedOutput(); err != nil {
-		log.Errorf("Error while creating %s interface: %s", ifaceName, err)
-		os.Exit(1)
-	}
-	//address nodeIP must be a cidr
-	nodeIPwithCIDR := fmt.Sprintf("%s/%s", registeredNode.IP, registeredNode.CIDR)
-	log.Debugf("Configuring %s with address %s", ifaceName, nodeIPwithCIDR)
-	addIfaceAddr := exec.Command("ip", "address", "add", "dev", ifaceName, nodeIPwithCIDR)
-	if _, err := addIfaceAddr.CombinedOutput(); err != nil {
-		log.Errorf("Error while assigning address '%s' to %s interface: %s", registeredNode.IP, ifaceName, err)
-		os.Exit(1)
+// Exit codes that let scripts tell apart why the client gave up.
+const (
+	exitNoServers       = 3
+	exitBadPassword     = 4
+	exitIPPoolExhausted = 5
+	exitSubnetOverlap   = 6
+)
+
+type ClientConfig struct {
+	iface         *WGInterfaceConfig
+	server        string
+	user          string
+	passwordFile  string
+	passwordEnv   string
+	passwordStdin bool
+	mdnsTimeout   int
+	// Only consider servers advertising this network name, if set
+	network string
+	// Shared by the service prompt and '-password-stdin', so neither
+	// buffers away a line the other needs
+	stdin *bufio.Reader
+	// If set, write a wg-quick config here instead of configuring the interface
+	export      string
+	exportLease int
+}
+
+func exitCodeFor(err error) int {
+	switch {
+	case err == errBadPassword:
+		return exitBadPassword
+	case err == errIPPoolExhausted:
+		return exitIPPoolExhausted
+	case errors.Is(err, errSubnetOverlap):
+		return exitSubnetOverlap
 	}
+	return 1
+}
 
-	wgPrivKeyPath, err := WriteRestrictedFile("wiregate_pkey", wgPrivKey)
-	if err != nil {
-		log.Errorf("Error while saving private wireguard key: %s", err)
-		os.Exit(1)
+func chooseService(conf *ClientConfig) *WireGateService {
+	if isHostPort(conf.server) {
+		host, port, _ := net.SplitHostPort(conf.server)
+		portNum, _ := strconv.Atoi(port)
+		return &WireGateService{
+			Host:         host,
+			Addr:         host,
+			Port:         portNum,
+			HTTPEndpoint: conf.server,
+			ServiceInfo:  wg.ServiceInfo{Description: conf.server},
+		}
 	}
-	allowedIPs := append(registeredNode.AllowedIPs, registeredNode.ServerPeerIP)
-	formattedAllowedIPs := formatAllowedIPsWithCIDR(allowedIPs)
-	wgSetIface := exec.Command("wg", "set", ifaceName, "private-key", wgPrivKeyPath, "peer", registeredNode.ServerPubKey, "endpoint", registeredNode.EndpointIPPortPair, "allowed-ips", formattedAllowedIPs)
-	if _, err := wgSetIface.CombinedOutput(); err != nil {
-		log.Errorf("Error while setting up WireGuard interface settings: %s", err)
-		os.Exit(1)
+	log.Info("Searching for WireGate servers on local network...")
+	browser := browseServices(conf.network)
+	defer browser.Stop()
+	WGServices := waitForServices(browser, conf.server, time.Duration(conf.mdnsTimeout)*time.Second)
+	if len(WGServices) == 0 {
+		if conf.network != "" {
+			log.Infof("No WireGate services for network %s found on local network, exiting.", conf.network)
+		} else {
+			log.Info("No WireGate services found on local network, exiting.")
+		}
+		os.Exit(exitNoServers)
 	}
-	log.Debugf("Turning %s up", ifaceName)
-	enableIface := exec.Command("ip", "link", "set", "up", "dev", ifaceName)
-	if _, err := enableIface.CombinedOutput(); err != nil {
-		log.Errorf("Error while enabling interface '%s': %s", ifaceName, err)
-		os.Exit(1)
+	if conf.server == "" {
+		// show prompt asking which one to connect to
+		return serviceChoicePrompt(browser, conf.stdin)
+	}
+	svc, err := selectService(WGServices, conf.server)
+	if err != nil {
+		log.Error(err)
+		os.Exit(exitNoServers)
 	}
+	return svc
 }
 
-func client_main() {
+func client_main(conf *ClientConfig) {
+	rand.Seed(time.Now().UnixNano())
 	// TODO check if running as sudo (required for creating interfaces)
-	log.Info("Searching for WireGate servers on local network...")
-	// search mdns for wiregate services
-	WGServices := query_mdns_wiregate_svcs("_wiregate._tcp", 3)
-	if len(WGServices) == 0 {
-		log.Info("No WireGate services found on local network, exiting.")
-		os.Exit(0)
+	if _, err := net.InterfaceByName(conf.iface.Name); err == nil && conf.export == "" {
+		log.Errorf("Interface %s already exists, refusing to touch it. Remove it or pick another name with '-wg-interface'", conf.iface.Name)
+		os.Exit(1)
 	}
-	// show prompt asking which one to connect to
-	chosenWGService := serviceChoicePrompt(WGServices)
+	chosenWGService := chooseService(conf)
 
-	// ask for password
-	fmt.Printf("Enter password: ")
-	vpnPassword, err := terminal.ReadPassword(int(syscall.Stdin))
+	vpnPassword, err := readPassword(conf)
 	if err != nil {
-		log.Error("Error while reading password from stdin")
+		log.Error(err)
 		os.Exit(1)
 	}
-	fmt.Printf("\n")
-
-	// get wireguard private/public key
-	wgPrivKey, wgPubkey := generateWGKeypair()
 
-	// register node w/ server
 	httpClient := get_http_client()
-	registeredNode := httpClient.registerNode(wgPubkey, string(vpnPassword), chosenWGService.HTTPEndpoint)
+	if conf.export != "" {
+		exportClientConfig(conf, httpClient, chosenWGService, vpnPassword)
+		os.Exit(0)
+	}
 
-	// create wireguard device
-	createWGInterface(wgPrivKey, registeredNode)
+	session, err := connect(httpClient, conf.iface, chosenWGService, conf.user, vpnPassword)
+	if err != nil {
+		log.Errorf("Unable to connect to WireGate server: %s", err)
+		os.Exit(exitCodeFor(err))
+	}
 
 	// keep sending heartbeats + keep updating allowed IPs
-	heartBeatDoneStream := make(chan struct{})
+	sessionDone := make(chan error, 1)
 	go func() {
-		httpClient.StartHeartBeat(chosenWGService, wgPubkey, registeredNode.ServerPubKey, registeredNode.ServerPeerIP)
-		heartBeatDoneStream <- struct{}{}
+		sessionDone <- session.Run()
 	}()
 
 	terminator := make(chan os.Signal, 1)
-	signal.Notify(terminator, os.Interrupt)
+	signal.Notify(terminator, os.Interrupt, syscall.SIGTERM)
+	exitCode := 0
 	select {
 	case <-terminator:
-	case <-heartBeatDoneStream:
+	case err := <-sessionDone:
+		log.Errorf("Giving up on WireGate server: %s", err)
+		exitCode = exitCodeFor(err)
+	}
+	session.Close()
+	session.Leave()
+
+	if err := destroyWGInterface(conf.iface.Name); err != nil {
+		log.Error(err)
+		os.Exit(1)
 	}
+	os.Exit(exitCode)
+}
 
-	// cleanup wg0 iface
-	log.Debugf("Deleting interface %s", "wg0")
-	ipLinkDelete := exec.Command("ip", "link", "delete", "dev", "wg0")
-	if _, err := ipLinkDelete.CombinedOutput(); err != nil {
-		fmt.Errorf("Encountered error while removing WireGuard interface 'wg0': %s", err)
+// exportClientConfig registers a leased peer and writes a wg-quick config for
+// it instead of configuring an interface.
+func exportClientConfig(conf *ClientConfig, httpClient *WireGateHTTPClient, service *WireGateService, vpnPassword string) {
+	wgPrivKey, wgPubkey, err := wg.GenerateKeyPair()
+	if err != nil {
+		log.Errorf("Unable to generate WireGuard keys: %s", err)
+		os.Exit(1)
+	}
+	registerReq := &wg.RegistrationRequest{
+		PublicKey: wgPubkey,
+		User:      conf.user,
+		Password:  vpnPassword,
+		Lease:     conf.exportLease,
+		Gateway:   conf.iface.Gateway,
+		Subnets:   conf.iface.Subnets,
+	}
+	registeredNode, err := httpClient.registerNode(registerReq, service.HTTPEndpoint)
+	if err != nil {
+		log.Errorf("Unable to register with WireGate server: %s", err)
+		os.Exit(exitCodeFor(err))
+	}
+	if err := exportWgQuickConfig(conf.export, conf.iface, wgPrivKey, registeredNode); err != nil {
+		log.Error(err)
 		os.Exit(1)
 	}
+	log.Infof("Wrote wg-quick config for %s/%s to %s, the server will keep this peer for %s", registeredNode.IP, registeredNode.CIDR, conf.export, registeredNode.Lease)
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+func TestSelectService(t *testing.T) {
+	services := []*WireGateService{
+		{Host: "office.local.", HTTPEndpoint: "192.168.1.10:8080", ServiceInfo: wg.ServiceInfo{Description: "Office"}},
+		{Host: "lab.local.", HTTPEndpoint: "192.168.1.20:8080", ServiceInfo: wg.ServiceInfo{Description: "Lab"}},
+	}
+	var selectTests = []struct {
+		selector string
+		// Index of the expected service, -1 for none
+		expected int
+	}{
+		{"0", 0},
+		{"1", 1},
+		{"2", -1},
+		{"-1", -1},
+		{"192.168.1.20:8080", 1},
+		{"Office", 0},
+		{"lab.local.", 1},
+		{"lab.local", 1},
+		{"192.168.1.30:8080", -1},
+		{"office", -1},
+	}
+	for _, tt := range selectTests {
+		svc, err := selectService(services, tt.selector)
+		if tt.expected < 0 {
+			if err == nil {
+				t.Errorf("Expected %q to select nothing, got %v", tt.selector, svc)
+			}
+			continue
+		}
+		if err != nil || svc != services[tt.expected] {
+			t.Errorf("Expected %q to select %v, got %v (%v)", tt.selector, services[tt.expected], svc, err)
+		}
+	}
+}
+
+func TestIsHostPort(t *testing.T) {
+	var hostPortTests = []struct {
+		selector string
+		expected bool
+	}{
+		{"192.168.1.10:8080", true},
+		{"[fd00::10]:8080", true},
+		{"server.local:8080", true},
+		{"192.168.1.10", false},
+		{"fd00::10", false},
+		{"server.local:http", false},
+		{"Office", false},
+		{"0", false},
+	}
+	for _, tt := range hostPortTests {
+		if isHostPort(tt.selector) != tt.expected {
+			t.Errorf("Expected isHostPort(%q) to be %t", tt.selector, tt.expected)
+		}
+	}
+}
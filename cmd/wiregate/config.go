@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+// errUsage is returned for bad flags, which the flag package already reported.
+var errUsage = errors.New("Invalid usage")
+
+// staticPeerConfig is a static peer as written in the server's config file.
+type staticPeerConfig struct {
+	PublicKey string   `json:"public-key"`
+	VPNIP     string   `json:"vpn-ip"`
+	Subnets   []string `json:"subnets"`
+}
+
+// Settings that can't change without recreating the WireGuard interface or
+// restarting the HTTP API, by flag name.
+var restartOnlySettings = map[string]func(*ServerConfig) interface{}{
+	"interface":                func(c *ServerConfig) interface{} { return c.iface },
+	"wg-interface":             func(c *ServerConfig) interface{} { return c.wgIface },
+	"wg-port":                  func(c *ServerConfig) interface{} { return c.wgPort },
+	"wg-cidr":                  func(c *ServerConfig) interface{} { return c.wgCIDR },
+	"wg-cidr-pool":             func(c *ServerConfig) interface{} { return c.wgCIDRPool },
+	"http-service-description": func(c *ServerConfig) interface{} { return c.mdnsServiceDesc },
+	"network":                  func(c *ServerConfig) interface{} { return c.network },
+	"http-port":                func(c *ServerConfig) interface{} { return c.httpPort },
+	"max-lease":                func(c *ServerConfig) interface{} { return c.maxLease },
+	"mesh":                     func(c *ServerConfig) interface{} { return c.mesh },
+	"firewall":                 func(c *ServerConfig) interface{} { return c.firewall },
+	"gateway":                  func(c *ServerConfig) interface{} { return c.gateway },
+	"dns":                      func(c *ServerConfig) interface{} { return c.dns },
+	"allow-subnets":            func(c *ServerConfig) interface{} { return c.allowSubnets },
+	"psk-lifetime":             func(c *ServerConfig) interface{} { return c.pskLifetime },
+	"post-up":                  func(c *ServerConfig) interface{} { return c.postUp },
+	"post-down":                func(c *ServerConfig) interface{} { return c.postDown },
+}
+
+func newServerFlagSet(conf *ServerConfig) *flag.FlagSet {
+	server := flag.NewFlagSet("server", flag.ContinueOnError)
+	server.StringVar(&conf.configPath, "config", "", "JSON config file with server options, keyed by flag name. Flags given on the command line take precedence. SIGHUP reloads it")
+	server.StringVar(&conf.iface, "interface", "", "Comma-separated LAN interfaces to serve clients on. Empty uses the one the default route goes out of")
+	server.StringVar(&conf.wgIface, "wg-interface", "wg0", "Name for WireGuard interface")
+	server.IntVar(&conf.wgPort, "wg-port", 51820, "WireGuard port")
+	server.StringVar(&conf.wgCIDR, "wg-cidr", "", "IPv4 CIDR subnet for WireGuard VPN, eg. 10.24.1.1/24. The WireGuard interface will use the first subnet address. Empty picks a free /24 from '-wg-cidr-pool'")
+	server.StringVar(&conf.wgCIDRPool, "wg-cidr-pool", "10.24.1.0/24,10.24.0.0/16,172.24.0.0/16", "Comma-separated IPv4 subnets to pick the VPN subnet from if '-wg-cidr' is empty, the first /24 no route uses wins")
+	server.StringVar(&conf.mdnsServiceDesc, "http-service-description", "Wiregate", "MDNS WireGate HTTP Control description")
+	server.StringVar(&conf.network, "network", "", "Name of the VPN network, advertised over mDNS so clients can look for it with '-network'")
+	server.IntVar(&conf.httpPort, "http-port", 38490, "WireGate HTTP Control port")
+	server.StringVar(&conf.vpnPassword, "vpn-password", "", "REQUIRED: Password to register with the WireGate VPN")
+	server.IntVar(&conf.purgeInterval, "purge-interval", 10, "Seconds between checks for unresponsive clients")
+	server.IntVar(&conf.purgeDeadline, "purge-deadline", 10, "Seconds without a heart beat after which a client is purged")
+	server.BoolVar(&conf.handshakeLiveness, "handshake-liveness", false, "Don't purge clients whose WireGuard tunnel recently completed a handshake, even if their heart beats stop")
+	server.IntVar(&conf.heartBeatInterval, "heartbeat-interval", 5, "Seconds between client heart beats, advertised to clients")
+	server.IntVar(&conf.maxLease, "max-lease", 86400, "Longest time in seconds to keep peers that don't heart beat, eg. exported configs. 0 disables them")
+	server.IntVar(&conf.pskLifetime, "psk-lifetime", 86400, "Seconds after which clients' WireGuard preshared keys are replaced, 0 keeps them for the whole session")
+	server.StringVar(&conf.firewall, "firewall", wg.FirewallAuto, "Firewall backend for the VPN's forwarding and NAT rules: auto, nftables, iptables or none to leave the firewall alone")
+	server.StringVar(&conf.gateway, "gateway", wg.GatewayIsolated, "What clients may reach through the server: isolated for only each other, lan to also reach the server's LAN or exit to send all their traffic through it")
+	server.StringVar(&conf.dns, "dns", "", "Comma-separated DNS servers for clients in exit gateway mode to use")
+	server.StringVar(&conf.allowSubnets, "allow-subnets", "", "Comma-separated subnets clients may advertise subnets within, to route them for the other clients. Empty doesn't let clients advertise any")
+	server.StringVar(&conf.postUp, "post-up", "", "Shell command to run after creating the WireGuard interface and firewall rules")
+	server.StringVar(&conf.postDown, "post-down", "", "Shell command to run when destroying the WireGuard interface, before removing the firewall rules")
+	server.StringVar(&conf.export, "export", "", "Write a wg-quick config for the server's WireGuard interface to this file and exit")
+	server.BoolVar(&conf.mesh, "mesh", false, "Let clients connect to each other directly instead of routing all traffic through the server")
+	server.BoolVar(&conf.debug, "debug", false, "Turn on debug-level logging")
+	return server
+}
+
+// loadServerConfig builds the server's config from the config file named by
+// '-config', if any, overridden by the flags in args.
+func loadServerConfig(args []string) (*ServerConfig, error) {
+	conf := &ServerConfig{args: args}
+	server := newServerFlagSet(conf)
+	if err := server.Parse(args); err == flag.ErrHelp {
+		return nil, err
+	} else if err != nil {
+		return nil, errUsage
+	}
+	if conf.configPath != "" {
+		if err := applyConfigFile(conf, server, conf.configPath); err != nil {
+			return nil, err
+		}
+		// Parse again so flags on the command line win over the file
+		server.Parse(args)
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// applyConfigFile sets the flags of server to the values in the JSON file at
+// path and reads its static peers, users and ACL policy into conf.
+func applyConfigFile(conf *ServerConfig, server *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read config file: %s", err)
+	}
+	defer f.Close()
+	var options map[string]json.RawMessage
+	if err := json.NewDecoder(f).Decode(&options); err != nil {
+		return fmt.Errorf("Config file %s isn't a valid JSON object: %s", path, err)
+	}
+	for name, raw := range options {
+		if name == "static-peers" {
+			var peers []staticPeerConfig
+			if err := json.Unmarshal(raw, &peers); err != nil {
+				return fmt.Errorf("%s: 'static-peers' must be a list of objects with 'public-key' and optional 'vpn-ip' and 'subnets': %s", path, err)
+			}
+			for _, p := range peers {
+				conf.staticPeers = append(conf.staticPeers, wg.StaticPeer{PublicKey: p.PublicKey, VPNIP: p.VPNIP, Subnets: p.Subnets})
+			}
+			continue
+		}
+		if name == "users" {
+			if err := json.Unmarshal(raw, &conf.users); err != nil {
+				return fmt.Errorf("%s: 'users' must be an object of user names and their passwords: %s", path, err)
+			}
+			continue
+		}
+		if name == "acl" {
+			conf.acl = &wg.ACLPolicy{}
+			if err := json.Unmarshal(raw, conf.acl); err != nil {
+				return fmt.Errorf("%s: 'acl' must be an object with 'groups' and 'rules': %s", path, err)
+			}
+			continue
+		}
+		if name == "config" || server.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %q, options are named like the server's flags", path, name)
+		}
+		var value interface{}
+		valueDecoder := json.NewDecoder(strings.NewReader(string(raw)))
+		valueDecoder.UseNumber()
+		if err := valueDecoder.Decode(&value); err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %s", path, name, err)
+		}
+		switch value.(type) {
+		case string, bool, json.Number:
+		default:
+			return fmt.Errorf("%s: %q must be a string, number or boolean", path, name)
+		}
+		if err := server.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %s", path, name, err)
+		}
+	}
+	return nil
+}
+
+func (c *ServerConfig) validate() error {
+	if c.vpnPassword == "" {
+		// TODO: check for weak password; generate share-able password if empty.
+		return fmt.Errorf("Missing '-vpn-password' argment!")
+	}
+	if c.heartBeatInterval <= 0 || c.purgeInterval <= 0 {
+		return fmt.Errorf("'-heartbeat-interval' and '-purge-interval' must be positive!")
+	}
+	if c.purgeDeadline <= c.heartBeatInterval {
+		return fmt.Errorf("'-purge-deadline' (%d) must be longer than '-heartbeat-interval' (%d)!", c.purgeDeadline, c.heartBeatInterval)
+	}
+	if c.maxLease < 0 {
+		return fmt.Errorf("'-max-lease' can't be negative!")
+	}
+	if c.pskLifetime < 0 {
+		return fmt.Errorf("'-psk-lifetime' can't be negative!")
+	}
+	switch c.firewall {
+	case wg.FirewallAuto, wg.FirewallNftables, wg.FirewallIptables, wg.FirewallNone:
+	default:
+		return fmt.Errorf("'-firewall' must be one of auto, nftables, iptables or none!")
+	}
+	if err := wg.ValidateGatewayMode(c.gateway); err != nil {
+		return fmt.Errorf("'-gateway': %s", err)
+	}
+	for _, dns := range c.dnsServers() {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("'-dns' %q isn't an IP address!", dns)
+		}
+	}
+	for user, password := range c.users {
+		if user == "" || password == "" {
+			return fmt.Errorf("Users need both a name and a password!")
+		}
+	}
+	if c.acl != nil {
+		if err := c.acl.Validate(); err != nil {
+			return fmt.Errorf("Invalid ACL: %s", err)
+		}
+		if c.firewall == wg.FirewallNone {
+			return fmt.Errorf("An ACL needs the server's firewall to enforce it, it can't be used with '-firewall none'!")
+		}
+		// Mesh peers talk to each other directly, past the server's firewall
+		if c.mesh && c.acl.HasPortRules() {
+			return fmt.Errorf("ACL rules with 'ports' can't be enforced in '-mesh' mode, where clients bypass the server's firewall!")
+		}
+	}
+	// Unknown until the server picks it if '-wg-cidr' is empty
+	var subnet *net.IPNet
+	if c.wgCIDR != "" {
+		var err error
+		if _, subnet, err = net.ParseCIDR(c.wgCIDR); err != nil {
+			return fmt.Errorf("'-wg-cidr' %q isn't a valid CIDR subnet: %s", c.wgCIDR, err)
+		}
+	}
+	pool, err := parseSubnets(c.wgCIDRPool)
+	if err != nil {
+		return fmt.Errorf("'-wg-cidr-pool': %s", err)
+	}
+	for _, s := range pool {
+		_, block, _ := net.ParseCIDR(s)
+		if ones, bits := block.Mask.Size(); bits != 32 || ones > 24 {
+			return fmt.Errorf("'-wg-cidr-pool' %s must be an IPv4 subnet of at least a /24!", s)
+		}
+	}
+	allowSubnets, err := parseSubnets(c.allowSubnets)
+	if err != nil {
+		return fmt.Errorf("'-allow-subnets': %s", err)
+	}
+	for _, s := range allowSubnets {
+		if _, allowed, _ := net.ParseCIDR(s); subnet != nil && (allowed.Contains(subnet.IP) || subnet.Contains(allowed.IP)) {
+			return fmt.Errorf("'-allow-subnets' %s overlaps the VPN subnet %s!", s, subnet)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, p := range c.staticPeers {
+		if err := wg.ValidateKey(p.PublicKey); err != nil {
+			return fmt.Errorf("Static peer: %s", err)
+		}
+		if seen[p.PublicKey] {
+			return fmt.Errorf("Static peer %s is listed more than once", p.PublicKey)
+		}
+		seen[p.PublicKey] = true
+		for _, s := range p.Subnets {
+			_, peerSubnet, err := net.ParseCIDR(s)
+			if err != nil || peerSubnet.String() != s {
+				return fmt.Errorf("Static peer %s: 'subnets' %q isn't a CIDR subnet like 192.168.50.0/24", p.PublicKey, s)
+			}
+			if subnet != nil && (peerSubnet.Contains(subnet.IP) || subnet.Contains(peerSubnet.IP)) {
+				return fmt.Errorf("Static peer %s: 'subnets' %s overlaps the VPN subnet %s", p.PublicKey, s, subnet)
+			}
+		}
+		if p.VPNIP == "" {
+			continue
+		}
+		if subnet == nil {
+			return fmt.Errorf("Static peer %s: 'vpn-ip' needs '-wg-cidr', the VPN subnet isn't known before the server picks it", p.PublicKey)
+		}
+		if ip := net.ParseIP(p.VPNIP); ip == nil || !subnet.Contains(ip) {
+			return fmt.Errorf("Static peer %s: 'vpn-ip' %q must be an IP in %s", p.PublicKey, p.VPNIP, c.wgCIDR)
+		}
+		if seen[p.VPNIP] {
+			return fmt.Errorf("Static peer %s: 'vpn-ip' %s is used by another static peer", p.PublicKey, p.VPNIP)
+		}
+		seen[p.VPNIP] = true
+	}
+	return nil
+}
+
+// localRoutes lists this computer's routes, swapped out in tests.
+var localRoutes = wg.LocalRoutes
+
+// vpnCIDR returns '-wg-cidr', or the first free /24 in '-wg-cidr-pool' if
+// it's empty, with the WireGuard interface's address like 10.24.1.1/24. The
+// subnet mustn't overlap a network this computer is on, or another one the
+// VPN routes, or clients couldn't reach one of them.
+func (c *ServerConfig) vpnCIDR() (string, error) {
+	routes, err := localRoutes()
+	if err != nil {
+		return "", err
+	}
+	// Left behind by a server that crashed, which creating it again fails on
+	for i := 0; i < len(routes); i++ {
+		if routes[i].Interface == c.wgIface {
+			routes = append(routes[:i], routes[i+1:]...)
+			i--
+		}
+	}
+	if c.wgCIDR != "" {
+		_, subnet, _ := net.ParseCIDR(c.wgCIDR)
+		for _, r := range routes {
+			if r.Subnet.Contains(subnet.IP) || subnet.Contains(r.Subnet.IP) {
+				return "", fmt.Errorf("'-wg-cidr' %s overlaps the route to %s on %s, pick another or leave it out to pick a free one", subnet, r.Subnet, r.Interface)
+			}
+		}
+		return c.wgCIDR, nil
+	}
+	var taken []*net.IPNet
+	for _, r := range routes {
+		taken = append(taken, r.Subnet)
+	}
+	routed := c.advertisableSubnets()
+	for _, p := range c.staticPeers {
+		routed = append(routed, p.Subnets...)
+	}
+	for _, s := range routed {
+		if _, subnet, err := net.ParseCIDR(s); err == nil {
+			taken = append(taken, subnet)
+		}
+	}
+	pool, _ := parseSubnets(c.wgCIDRPool)
+	subnet, err := wg.FreeSubnet(pool, taken)
+	if err != nil {
+		return "", err
+	}
+	firstIP := append(net.IP(nil), subnet.IP...)
+	firstIP[3]++
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", firstIP, ones), nil
+}
+
+// dnsServers returns the DNS servers listed by '-dns'.
+func (c *ServerConfig) dnsServers() []string {
+	var servers []string
+	for _, dns := range strings.Split(c.dns, ",") {
+		if dns = strings.TrimSpace(dns); dns != "" {
+			servers = append(servers, dns)
+		}
+	}
+	return servers
+}
+
+// lanInterfaces returns the interfaces named by '-interface', or the one the
+// default route goes out of if it's empty.
+func (c *ServerConfig) lanInterfaces() ([]string, error) {
+	var ifaces []string
+	for _, name := range strings.Split(c.iface, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ifaces = append(ifaces, name)
+		}
+	}
+	if len(ifaces) > 0 {
+		return ifaces, nil
+	}
+	iface, err := wg.DefaultRouteInterface()
+	if err != nil {
+		return nil, err
+	}
+	return []string{iface}, nil
+}
+
+// advertisableSubnets returns the subnets listed by '-allow-subnets'.
+func (c *ServerConfig) advertisableSubnets() []string {
+	subnets, _ := parseSubnets(c.allowSubnets)
+	return subnets
+}
+
+// restartRequiredChanges returns the names of settings that differ between c
+// and newConf but only take effect after a restart.
+func (c *ServerConfig) restartRequiredChanges(newConf *ServerConfig) []string {
+	changed := make([]string, 0)
+	for name, setting := range restartOnlySettings {
+		if !reflect.DeepEqual(setting(c), setting(newConf)) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+const testStaticPeerKey = "itqZxy1VH5NlqGdZvVy02VsJLGqpVlhAoNpXmFKt60E="
+
+// testServerConfig returns the default server config with the given flags.
+func testServerConfig(t *testing.T, args ...string) (*ServerConfig, error) {
+	conf := &ServerConfig{}
+	if err := newServerFlagSet(conf).Parse(append([]string{"-vpn-password", "secret"}, args...)); err != nil {
+		t.Fatalf("Unexpected error parsing %v: %s", args, err)
+	}
+	return conf, conf.validate()
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "wiregate-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	var configTests = []struct {
+		content string
+		// Part of the expected error, empty if the file is valid
+		err   string
+		check func(conf *ServerConfig) bool
+	}{
+		{`{"wg-port": 51821, "mesh": true, "dns": "1.1.1.1"}`, "", func(c *ServerConfig) bool {
+			return c.wgPort == 51821 && c.mesh && c.dns == "1.1.1.1"
+		}},
+		{`{"users": {"alice": "pass1"}}`, "", func(c *ServerConfig) bool {
+			return reflect.DeepEqual(c.users, map[string]string{"alice": "pass1"})
+		}},
+		{`{"static-peers": [{"public-key": "` + testStaticPeerKey + `", "vpn-ip": "10.24.1.10", "subnets": ["192.168.50.0/24"]}]}`, "", func(c *ServerConfig) bool {
+			return reflect.DeepEqual(c.staticPeers, []wg.StaticPeer{{PublicKey: testStaticPeerKey, VPNIP: "10.24.1.10", Subnets: []string{"192.168.50.0/24"}}})
+		}},
+		{`{"acl": {"rules": [{"from": ["user:alice"], "to": ["user:bob"]}]}}`, "", func(c *ServerConfig) bool {
+			return c.acl != nil && len(c.acl.Rules) == 1
+		}},
+		{`{"wg-prot": 51821}`, "unknown option", nil},
+		{`{"config": "other.json"}`, "unknown option", nil},
+		{`{"wg-port": "many"}`, "invalid value", nil},
+		{`{"wg-port": [51821]}`, "must be a string, number or boolean", nil},
+		{`{"static-peers": {"public-key": "` + testStaticPeerKey + `"}}`, "'static-peers' must be a list", nil},
+		{`{"users": ["alice"]}`, "'users' must be an object", nil},
+		{`["wg-port", 51821]`, "isn't a valid JSON object", nil},
+	}
+	for _, tt := range configTests {
+		path := writeConfigFile(t, tt.content)
+		defer os.Remove(path)
+		conf := &ServerConfig{}
+		server := newServerFlagSet(conf)
+		err := applyConfigFile(conf, server, path)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("Unexpected error for %s: %s", tt.content, err)
+			} else if !tt.check(conf) {
+				t.Errorf("Config file %s wasn't applied: %+v", tt.content, conf)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Expected an error containing %q for %s, got %v", tt.err, tt.content, err)
+		}
+	}
+
+	if err := applyConfigFile(&ServerConfig{}, newServerFlagSet(&ServerConfig{}), "/nonexistent/wiregate.json"); err == nil {
+		t.Errorf("Expected a missing config file to fail")
+	}
+}
+
+func TestLoadServerConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{"vpn-password": "fromFile", "wg-port": 51821, "http-port": 8080}`)
+	defer os.Remove(path)
+	conf, err := loadServerConfig([]string{"-config", path, "-wg-port", "51822"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.vpnPassword != "fromFile" || conf.httpPort != 8080 || conf.wgPort != 51822 {
+		t.Errorf("Expected flags to win over the config file, got %+v", conf)
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	var validateTests = []struct {
+		args  []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"-vpn-password", ""}, false},
+		{[]string{"-heartbeat-interval", "0"}, false},
+		{[]string{"-purge-interval", "-1"}, false},
+		{[]string{"-heartbeat-interval", "10", "-purge-deadline", "10"}, false},
+		{[]string{"-heartbeat-interval", "10", "-purge-deadline", "30"}, true},
+		{[]string{"-max-lease", "-1"}, false},
+		{[]string{"-psk-lifetime", "-1"}, false},
+		{[]string{"-firewall", "pf"}, false},
+		{[]string{"-firewall", "none"}, true},
+		{[]string{"-gateway", "everything"}, false},
+		{[]string{"-gateway", "exit", "-dns", "1.1.1.1,9.9.9.9"}, true},
+		{[]string{"-dns", "dns.example.com"}, false},
+		{[]string{"-wg-cidr", "10.24.1.1/24"}, true},
+		{[]string{"-wg-cidr", "10.24.1.1"}, false},
+		{[]string{"-wg-cidr-pool", "10.24.0.0/16,172.24.0.0/24"}, true},
+		{[]string{"-wg-cidr-pool", "10.24.0.0/25"}, false},
+		{[]string{"-wg-cidr-pool", "fd00::/64"}, false},
+		{[]string{"-wg-cidr-pool", "lab"}, false},
+		{[]string{"-allow-subnets", "192.168.0.0/16"}, true},
+		{[]string{"-allow-subnets", "lab"}, false},
+		{[]string{"-wg-cidr", "10.24.1.1/24", "-allow-subnets", "10.0.0.0/8"}, false},
+	}
+	for _, tt := range validateTests {
+		_, err := testServerConfig(t, tt.args...)
+		if tt.valid && err != nil {
+			t.Errorf("Expected %v to be valid, got %s", tt.args, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Expected %v to be invalid", tt.args)
+		}
+	}
+
+	var settingsTests = []struct {
+		name   string
+		modify func(c *ServerConfig)
+		valid  bool
+	}{
+		{"user without a password", func(c *ServerConfig) { c.users = map[string]string{"alice": ""} }, false},
+		{"user with a password", func(c *ServerConfig) { c.users = map[string]string{"alice": "pass1"} }, true},
+		{"static peer", func(c *ServerConfig) { c.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey}} }, true},
+		{"static peer with a bad key", func(c *ServerConfig) { c.staticPeers = []wg.StaticPeer{{PublicKey: "notAKey"}} }, false},
+		{"static peer listed twice", func(c *ServerConfig) {
+			c.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey}, {PublicKey: testStaticPeerKey}}
+		}, false},
+		{"static peer with a bad subnet", func(c *ServerConfig) {
+			c.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey, Subnets: []string{"192.168.50.1/24"}}}
+		}, false},
+		{"static peer with a VPN IP but no '-wg-cidr'", func(c *ServerConfig) {
+			c.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey, VPNIP: "10.24.1.10"}}
+		}, false},
+		{"static peer with a VPN IP", func(c *ServerConfig) {
+			c.wgCIDR = "10.24.1.1/24"
+			c.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey, VPNIP: "10.24.1.10"}}
+		}, true},
+		{"static peer with a VPN IP outside the VPN subnet", func(c *ServerConfig) {
+			c.wgCIDR = "10.24.1.1/24"
+			c.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey, VPNIP: "10.24.2.10"}}
+		}, false},
+		{"static peer with a subnet overlapping the VPN subnet", func(c *ServerConfig) {
+			c.wgCIDR = "10.24.1.1/24"
+			c.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey, Subnets: []string{"10.24.0.0/16"}}}
+		}, false},
+		{"invalid ACL", func(c *ServerConfig) { c.acl = &wg.ACLPolicy{Rules: []wg.ACLRule{{From: []string{"user:alice"}}}} }, false},
+		{"ACL without a firewall", func(c *ServerConfig) {
+			c.firewall = wg.FirewallNone
+			c.acl = &wg.ACLPolicy{Rules: []wg.ACLRule{{From: []string{"user:alice"}, To: []string{"user:bob"}}}}
+		}, false},
+		{"ACL port rules in mesh mode", func(c *ServerConfig) {
+			c.mesh = true
+			c.acl = &wg.ACLPolicy{Rules: []wg.ACLRule{{From: []string{"user:alice"}, To: []string{"user:bob"}, Ports: []string{"22"}}}}
+		}, false},
+		{"ACL without port rules in mesh mode", func(c *ServerConfig) {
+			c.mesh = true
+			c.acl = &wg.ACLPolicy{Rules: []wg.ACLRule{{From: []string{"user:alice"}, To: []string{"user:bob"}}}}
+		}, true},
+	}
+	for _, tt := range settingsTests {
+		conf, _ := testServerConfig(t)
+		tt.modify(conf)
+		err := conf.validate()
+		if tt.valid && err != nil {
+			t.Errorf("Expected %s to be valid, got %s", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Expected %s to be invalid", tt.name)
+		}
+	}
+}
+
+func TestVPNCIDR(t *testing.T) {
+	defer func() { localRoutes = wg.LocalRoutes }()
+	localRoutes = func() ([]wg.Route, error) {
+		return wg.ParseRoutes(`Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+docker0	000118AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+wg0	0001180A	00000000	0001	0	0	0	00FFFFFF	0	0	0
+`), nil
+	}
+	var cidrTests = []struct {
+		args     []string
+		expected string
+	}{
+		{nil, "10.24.1.1/24"},
+		{[]string{"-wg-cidr", "10.99.0.1/24"}, "10.99.0.1/24"},
+		// Left behind on the server's own interface by a crash
+		{[]string{"-wg-cidr", "10.24.1.1/24"}, "10.24.1.1/24"},
+		{[]string{"-wg-interface", "wg1"}, "10.24.0.1/24"},
+		{[]string{"-wg-cidr", "192.168.1.1/24"}, ""},
+		{[]string{"-wg-cidr-pool", "192.168.0.0/23"}, "192.168.0.1/24"},
+		{[]string{"-wg-cidr-pool", "192.168.1.0/24,172.24.0.0/16"}, ""},
+		{[]string{"-wg-cidr-pool", "172.24.0.0/16,10.200.0.0/16"}, "10.200.0.1/24"},
+		{[]string{"-allow-subnets", "10.24.0.0/23"}, "10.24.2.1/24"},
+	}
+	for _, tt := range cidrTests {
+		conf, err := testServerConfig(t, tt.args...)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", tt.args, err)
+		}
+		cidr, err := conf.vpnCIDR()
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("Expected no VPN subnet for %v, got %s", tt.args, cidr)
+			}
+			continue
+		}
+		if err != nil || cidr != tt.expected {
+			t.Errorf("Expected VPN subnet %s for %v, got %s (%v)", tt.expected, tt.args, cidr, err)
+		}
+	}
+
+	conf, _ := testServerConfig(t)
+	conf.staticPeers = []wg.StaticPeer{{PublicKey: testStaticPeerKey, Subnets: []string{"10.24.1.0/24"}}}
+	if cidr, err := conf.vpnCIDR(); err != nil || cidr != "10.24.0.1/24" {
+		t.Errorf("Expected the subnets behind static peers to be left out, got %s (%v)", cidr, err)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The client daemon's control API listens on this unix socket, which only
+// root can use.
+var controlSocketPath = filepath.Join(clientStateDir, "wiregate.sock")
+
+// Where a daemon started by 'wiregate up' logs to.
+var daemonLogPath = filepath.Join(clientStateDir, "daemon.log")
+
+// How long 'wiregate up' waits for a daemon it started to listen.
+const daemonStartTimeout = 5 * time.Second
+
+// How long the daemon gets to connect to a server on behalf of 'wiregate up'.
+const controlRequestTimeout = time.Minute
+
+// UpRequest asks the daemon to connect an interface to a WireGate server the
+// caller already found and has the password for.
+type UpRequest struct {
+	Interface WGInterfaceConfig
+	Service   WireGateService
+	User      string
+	Password  string
+}
+
+type DownRequest struct {
+	Interface string
+}
+
+// Daemon keeps client sessions running in the background and manages them
+// through the control API.
+type Daemon struct {
+	mu         sync.Mutex
+	httpClient *WireGateHTTPClient
+	// Sessions by interface name, nil while still connecting
+	sessions map[string]*Session
+	// Set once the daemon shuts down, after which it refuses new sessions
+	stopping bool
+	// Tracks 'up' requests still connecting, which shutdown waits for
+	connecting sync.WaitGroup
+	// If set, the daemon exits once its last session goes down
+	exitWhenIdle bool
+	idle         chan struct{}
+}
+
+func NewDaemon(exitWhenIdle bool) *Daemon {
+	return &Daemon{
+		httpClient:   get_http_client(),
+		sessions:     make(map[string]*Session),
+		exitWhenIdle: exitWhenIdle,
+		idle:         make(chan struct{}, 1),
+	}
+}
+
+func (d *Daemon) up(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var r UpRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusBadRequest)
+		return
+	}
+	name := r.Interface.Name
+	d.mu.Lock()
+	if d.stopping {
+		d.mu.Unlock()
+		http.Error(w, "The daemon is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := d.sessions[name]; ok {
+		d.mu.Unlock()
+		http.Error(w, fmt.Sprintf("%s is already up", name), http.StatusConflict)
+		return
+	}
+	// Reserve the interface while connecting
+	d.sessions[name] = nil
+	d.connecting.Add(1)
+	defer d.connecting.Done()
+	d.mu.Unlock()
+
+	session, err := connect(d.httpClient, &r.Interface, &r.Service, r.User, r.Password)
+	d.mu.Lock()
+	stopping := d.stopping
+	if err != nil || stopping {
+		delete(d.sessions, name)
+	} else {
+		d.sessions[name] = session
+	}
+	d.mu.Unlock()
+	if err == nil && stopping {
+		// Shutdown doesn't see this session, but waits for it to go down
+		teardown(session)
+		http.Error(w, "The daemon is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Errorf("Unable to bring up %s: %s", name, err)
+		status := http.StatusBadGateway
+		switch {
+		case err == errBadPassword:
+			status = http.StatusForbidden
+		case err == errIPPoolExhausted:
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, errInterfaceExists):
+			status = http.StatusConflict
+		case errors.Is(err, errSubnetOverlap):
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, err.Error(), status)
+		d.checkIdle()
+		return
+	}
+	go d.run(session)
+	json.NewEncoder(w).Encode(session.Status())
+}
+
+// run keeps session alive and tears it down if it can't be recovered.
+func (d *Daemon) run(session *Session) {
+	err := session.Run()
+	if err == errSessionClosed {
+		return
+	}
+	log.Errorf("Giving up on WireGate server for %s: %s", session.iface.Name, err)
+	if d.remove(session) {
+		teardown(session)
+		d.checkIdle()
+	}
+}
+
+func (d *Daemon) down(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var r DownRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusBadRequest)
+		return
+	}
+	d.mu.Lock()
+	session, ok := d.sessions[r.Interface]
+	d.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s isn't up", r.Interface), http.StatusNotFound)
+		return
+	}
+	if session == nil {
+		http.Error(w, fmt.Sprintf("%s is still connecting", r.Interface), http.StatusConflict)
+		return
+	}
+	if d.remove(session) {
+		teardown(session)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	d.checkIdle()
+}
+
+func (d *Daemon) status(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := make([]*SessionStatus, 0)
+	for _, session := range d.runningSessions() {
+		statuses = append(statuses, session.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Interface < statuses[j].Interface })
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// remove forgets session and reports whether it was still running, in which
+// case the caller tears it down.
+func (d *Daemon) remove(session *Session) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sessions[session.iface.Name] != session {
+		return false
+	}
+	delete(d.sessions, session.iface.Name)
+	return true
+}
+
+func (d *Daemon) runningSessions() []*Session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sessions := make([]*Session, 0, len(d.sessions))
+	for _, session := range d.sessions {
+		if session != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// stop refuses new sessions and waits for those still connecting, which tear
+// themselves down.
+func (d *Daemon) stop() {
+	d.mu.Lock()
+	d.stopping = true
+	d.mu.Unlock()
+	d.connecting.Wait()
+}
+
+func (d *Daemon) checkIdle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.exitWhenIdle && len(d.sessions) == 0 {
+		select {
+		case d.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// teardown stops a session, unregisters it and removes its interface.
+func teardown(session *Session) {
+	log.Infof("Bringing down %s", session.iface.Name)
+	session.Close()
+	session.Leave()
+	if err := destroyWGInterface(session.iface.Name); err != nil {
+		log.Error(err)
+	}
+}
+
+// daemon_main serves the control API until it's signalled to stop, or, with
+// exitWhenIdle, until its last session goes down.
+func daemon_main(exitWhenIdle bool) {
+	if err := os.MkdirAll(clientStateDir, 0700); err != nil {
+		log.Errorf("Error while creating %s: %s", clientStateDir, err)
+		os.Exit(1)
+	}
+	if daemonRunning() {
+		log.Errorf("A WireGate daemon is already listening on %s", controlSocketPath)
+		os.Exit(1)
+	}
+	os.Remove(controlSocketPath)
+	listener, err := net.Listen("unix", controlSocketPath)
+	if err != nil {
+		log.Errorf("Unable to listen on %s: %s", controlSocketPath, err)
+		os.Exit(1)
+	}
+	if err := os.Chmod(controlSocketPath, 0600); err != nil {
+		log.Errorf("Unable to restrict access to %s: %s", controlSocketPath, err)
+		listener.Close()
+		os.Exit(1)
+	}
+
+	d := NewDaemon(exitWhenIdle)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/up", d.up)
+	mux.HandleFunc("/down", d.down)
+	mux.HandleFunc("/status", d.status)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	log.Infof("WireGate daemon listening on %s", controlSocketPath)
+
+	terminator := make(chan os.Signal, 1)
+	signal.Notify(terminator, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-terminator:
+		log.Infof("Received signal %s, bringing down all interfaces", s)
+	case <-d.idle:
+		log.Info("No interfaces left up, exiting")
+	}
+	server.Close()
+	d.stop()
+	for _, session := range d.runningSessions() {
+		if d.remove(session) {
+			teardown(session)
+		}
+	}
+	os.Remove(controlSocketPath)
+	os.Exit(0)
+}
+
+// controlClient talks to the daemon's control API over its unix socket.
+func controlClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", controlSocketPath)
+			},
+		},
+		Timeout: timeout,
+	}
+}
+
+func daemonRunning() bool {
+	rsp, err := controlClient(time.Second).Get("http://wiregate/status")
+	if err != nil {
+		return false
+	}
+	rsp.Body.Close()
+	return true
+}
+
+// startDaemon runs 'wiregate daemon' in the background, detached from the
+// terminal, and waits for it to listen.
+func startDaemon() error {
+	if err := os.MkdirAll(clientStateDir, 0700); err != nil {
+		return fmt.Errorf("Error while creating %s: %s", clientStateDir, err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(daemonLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open daemon log: %s", err)
+	}
+	defer logFile.Close()
+	daemon := exec.Command(executable, "daemon", "-exit-when-idle")
+	daemon.Stdout = logFile
+	daemon.Stderr = logFile
+	daemon.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := daemon.Start(); err != nil {
+		return fmt.Errorf("Unable to start WireGate daemon: %s", err)
+	}
+	daemon.Process.Release()
+	deadline := time.Now().Add(daemonStartTimeout)
+	for time.Now().Before(deadline) {
+		if daemonRunning() {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("WireGate daemon didn't start, see %s", daemonLogPath)
+}
+
+// controlError turns an unsuccessful control API response into an error,
+// mapping the ones 'wiregate client' has exit codes for.
+func controlError(rsp *http.Response) error {
+	switch rsp.StatusCode {
+	case http.StatusForbidden:
+		return errBadPassword
+	case http.StatusServiceUnavailable:
+		return errIPPoolExhausted
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	message := strings.TrimSpace(string(body))
+	if rsp.StatusCode == http.StatusUnprocessableEntity {
+		return fmt.Errorf("%w%s", errSubnetOverlap, strings.TrimPrefix(message, errSubnetOverlap.Error()))
+	}
+	return errors.New(message)
+}
+
+// up_main finds a server and asks the daemon, starting it if needed, to keep
+// the interface connected to it.
+func up_main(conf *ClientConfig) {
+	service := chooseService(conf)
+	password, err := readPassword(conf)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if !daemonRunning() {
+		log.Info("Starting WireGate daemon")
+		if err := startDaemon(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	var reqBuffer bytes.Buffer
+	json.NewEncoder(&reqBuffer).Encode(&UpRequest{Interface: *conf.iface, Service: *service, User: conf.user, Password: password})
+	rsp, err := controlClient(controlRequestTimeout).Post("http://wiregate/up", "application/json", &reqBuffer)
+	if err != nil {
+		log.Errorf("Unable to reach WireGate daemon: %s", err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		err := controlError(rsp)
+		log.Errorf("Unable to bring up %s: %s", conf.iface.Name, err)
+		os.Exit(exitCodeFor(err))
+	}
+	var status SessionStatus
+	if err := json.NewDecoder(rsp.Body).Decode(&status); err != nil {
+		log.Errorf("Error while decoding daemon response: %s", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is up as %s on WireGate server %s\n", status.Interface, status.Address, status.Server)
+}
+
+func down_main(ifaceName string) {
+	var reqBuffer bytes.Buffer
+	json.NewEncoder(&reqBuffer).Encode(&DownRequest{Interface: ifaceName})
+	rsp, err := controlClient(controlRequestTimeout).Post("http://wiregate/down", "application/json", &reqBuffer)
+	if err != nil {
+		log.Errorf("No WireGate daemon running: %s", err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNoContent {
+		log.Errorf("Unable to bring down %s: %s", ifaceName, controlError(rsp))
+		os.Exit(1)
+	}
+	fmt.Printf("%s is down\n", ifaceName)
+}
+
+func status_main(asJSON bool) {
+	statuses := make([]*SessionStatus, 0)
+	rsp, err := controlClient(time.Second).Get("http://wiregate/status")
+	if err == nil {
+		defer rsp.Body.Close()
+		if err := json.NewDecoder(rsp.Body).Decode(&statuses); err != nil {
+			log.Errorf("Error while decoding daemon response: %s", err)
+			os.Exit(1)
+		}
+	}
+	if asJSON {
+		json.NewEncoder(os.Stdout).Encode(statuses)
+		return
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No WireGate interfaces are up")
+		return
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "INTERFACE\tSERVER\tADDRESS\tSTATE\tSINCE")
+	for _, s := range statuses {
+		state := "connected"
+		if !s.Connected {
+			state = "reconnecting"
+			if s.LastError != "" {
+				state = fmt.Sprintf("reconnecting (%s)", s.LastError)
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", s.Interface, s.Server, s.Address, state, s.Since.Format(time.RFC3339))
+	}
+	table.Flush()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+)
+
+// interfaceAddrs lists the addresses of this computer's interfaces, swapped
+// out in tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+// onLocalSubnet tells whether ip is on a subnet one of this computer's
+// interfaces is connected to.
+func onLocalSubnet(ip net.IP) bool {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickAddress returns the first of a server's addresses that's on a local
+// subnet, or the first one if none is. It returns nil if addrs is empty.
+func pickAddress(addrs []net.IP) net.IP {
+	for _, addr := range addrs {
+		if onLocalSubnet(addr) {
+			return addr
+		}
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// chooseEndpoint picks the server's WireGuard endpoint this client can reach:
+// the one on the address its HTTP API answered at, else one on a local
+// subnet, else the one the server prefers.
+func chooseEndpoint(preferred string, endpoints []string, apiEndpoint string) string {
+	apiHost, _, _ := net.SplitHostPort(apiEndpoint)
+	for _, endpoint := range endpoints {
+		if host, _, err := net.SplitHostPort(endpoint); err == nil && host == apiHost {
+			return endpoint
+		}
+	}
+	for _, endpoint := range endpoints {
+		if host, _, err := net.SplitHostPort(endpoint); err == nil && onLocalSubnet(net.ParseIP(host)) {
+			return endpoint
+		}
+	}
+	return preferred
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// fakeInterfaceAddrs makes this computer look like it's on cidrs.
+func fakeInterfaceAddrs(cidrs ...string) func() {
+	interfaceAddrs = func() ([]net.Addr, error) {
+		addrs := []net.Addr{&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)}}
+		for _, cidr := range cidrs {
+			ip, subnet, _ := net.ParseCIDR(cidr)
+			addrs = append(addrs, &net.IPNet{IP: ip, Mask: subnet.Mask})
+		}
+		return addrs, nil
+	}
+	return func() { interfaceAddrs = net.InterfaceAddrs }
+}
+
+func TestPickAddress(t *testing.T) {
+	defer fakeInterfaceAddrs("192.168.1.5/24", "fd00::5/64")()
+	var addressTests = []struct {
+		addrs    []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"10.0.0.2"}, "10.0.0.2"},
+		{[]string{"10.0.0.2", "192.168.1.10"}, "192.168.1.10"},
+		{[]string{"192.168.1.10", "192.168.1.11"}, "192.168.1.10"},
+		{[]string{"10.0.0.2", "fd00::10"}, "fd00::10"},
+		{[]string{"fd01::10", "10.0.0.2"}, "fd01::10"},
+		// The loopback network isn't one the server can be reached on
+		{[]string{"10.0.0.2", "127.0.0.2"}, "10.0.0.2"},
+	}
+	for _, tt := range addressTests {
+		var addrs []net.IP
+		for _, addr := range tt.addrs {
+			addrs = append(addrs, net.ParseIP(addr))
+		}
+		picked := pickAddress(addrs)
+		if tt.expected == "" {
+			if picked != nil {
+				t.Errorf("Expected no address from %v, got %s", tt.addrs, picked)
+			}
+			continue
+		}
+		if !picked.Equal(net.ParseIP(tt.expected)) {
+			t.Errorf("Expected %s from %v, got %s", tt.expected, tt.addrs, picked)
+		}
+	}
+}
+
+func TestChooseEndpoint(t *testing.T) {
+	defer fakeInterfaceAddrs("192.168.1.5/24")()
+	var endpointTests = []struct {
+		preferred   string
+		endpoints   []string
+		apiEndpoint string
+		expected    string
+	}{
+		{"10.0.0.2:51820", nil, "10.0.0.2:38490", "10.0.0.2:51820"},
+		{"10.0.0.2:51820", []string{"10.0.0.2:51820", "192.168.1.10:51820"}, "10.0.0.2:38490", "10.0.0.2:51820"},
+		{"10.0.0.2:51820", []string{"10.0.0.2:51820", "192.168.1.10:51820"}, "192.168.1.10:38490", "192.168.1.10:51820"},
+		{"10.0.0.2:51820", []string{"10.0.0.2:51820", "192.168.1.10:51820"}, "server.local:38490", "192.168.1.10:51820"},
+		{"10.0.0.2:51820", []string{"10.0.0.2:51820", "[fd00::10]:51820"}, "[fd00::10]:38490", "[fd00::10]:51820"},
+		{"10.0.0.2:51820", []string{"10.0.0.3:51820", "172.16.0.2:51820"}, "server.local:38490", "10.0.0.2:51820"},
+		{"10.0.0.2:51820", []string{"not an endpoint"}, "192.168.1.10:38490", "10.0.0.2:51820"},
+	}
+	for _, tt := range endpointTests {
+		if endpoint := chooseEndpoint(tt.preferred, tt.endpoints, tt.apiEndpoint); endpoint != tt.expected {
+			t.Errorf("Expected endpoint %s from %v via %s, got %s", tt.expected, tt.endpoints, tt.apiEndpoint, endpoint)
+		}
+	}
+}
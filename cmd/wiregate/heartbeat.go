@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+// Used when the server doesn't advertise a heart beat interval.
+const defaultHeartBeatInterval = 5 * time.Second
+
+// How long to poll before trying to reopen a dropped membership stream.
+const streamRetryInterval = 30 * time.Second
+
+// Missing this many stream keepalives in a row means the stream is dead.
+const streamMissedPings = 3
+
+// jitter spreads d by up to 10% either way so clients that registered at the
+// same time don't beat in lockstep.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 5)
+	if spread <= 0 {
+		return d
+	}
+	return d - d/10 + time.Duration(rand.Int63n(spread))
+}
+
+// PeerSync applies membership updates from the server to the WireGuard
+// interface, touching it only when something changed.
+type PeerSync struct {
+	ifaceName         string
+	ownPubKey         string
+	serverPubKey      string
+	serverIP          string
+	membership        *Membership
+	mesh              *MeshRouter
+	appliedAllowedIPs string
+	// Subnets routed through the server in its gateway mode
+	routes []string
+	// Opens the preshared keys the server rotates, along with serverPubKey
+	privKey      string
+	presharedKey string
+	// Called whenever the server answers
+	onResponse func()
+	// Called after switching to a rotated preshared key, which the server
+	// only installs once it's acknowledged
+	onPresharedKey func(psk string)
+}
+
+func NewPeerSync(ifaceName, ownPubKey, serverPubKey, serverIP string, mesh *MeshRouter) *PeerSync {
+	return &PeerSync{
+		ifaceName:    ifaceName,
+		ownPubKey:    ownPubKey,
+		serverPubKey: serverPubKey,
+		serverIP:     serverIP,
+		membership:   NewMembership(),
+		mesh:         mesh,
+	}
+}
+
+// Apply returns errNodeNotFound if the update removed this node and
+// errServerShuttingDown if the server is going away.
+func (p *PeerSync) Apply(rsp *wg.HeartBeatResponse) error {
+	if rsp.ShuttingDown {
+		return errServerShuttingDown
+	}
+	if p.onResponse != nil {
+		p.onResponse()
+	}
+	if rsp.PresharedKey != "" {
+		if err := p.applyPresharedKey(rsp.PresharedKey); err != nil {
+			log.Errorf("Unable to apply the preshared key the server rotated: %s", err)
+		}
+	}
+	changed := p.membership.Apply(rsp)
+	if changed && !p.membership.Has(p.ownPubKey) {
+		return errNodeNotFound
+	}
+	if !changed && (p.mesh == nil || !p.mesh.Unconfirmed()) {
+		return nil
+	}
+	log.Debugf("Membership at revision %d", p.membership.Revision())
+	allowedIPs := append(p.membership.IPs(), p.serverIP)
+	peerSubnets := p.membership.Subnets(p.ownPubKey)
+	if changed {
+		if err := syncPeerSubnetRoutes(p.ifaceName, peerSubnets); err != nil {
+			return err
+		}
+	}
+	if p.mesh != nil {
+		direct := p.mesh.Sync(p.membership.Peers())
+		allowedIPs = serverRouted(allowedIPs, direct)
+		peerSubnets = serverRouted(peerSubnets, direct)
+	}
+	formattedAllowedIPs := serverPeerAllowedIPs(allowedIPs, append(append([]string(nil), p.routes...), peerSubnets...))
+	if formattedAllowedIPs == p.appliedAllowedIPs {
+		return nil
+	}
+	// TODO: what if wg cmd stalls for too long?
+	log.Debugf("Updating server peer allowedIPs: %v", formattedAllowedIPs)
+	setAllowedIPs := exec.Command("wg", "set", p.ifaceName, "peer", p.serverPubKey, "allowed-ips", formattedAllowedIPs)
+	if out, err := setAllowedIPs.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while setting up WireGuard interface settings: %s\n%s", err, out)
+	}
+	p.appliedAllowedIPs = formattedAllowedIPs
+	return nil
+}
+
+// applyPresharedKey opens a sealed preshared key and sets it on the server
+// peer if the server rotated it.
+func (p *PeerSync) applyPresharedKey(sealed string) error {
+	psk, err := wg.OpenPresharedKey(sealed, p.privKey, p.serverPubKey)
+	if err != nil {
+		return err
+	}
+	if psk == p.presharedKey {
+		return nil
+	}
+	if err := setPresharedKey(p.ifaceName, p.serverPubKey, psk); err != nil {
+		return err
+	}
+	log.Info("Switched to the preshared key the server rotated")
+	p.presharedKey = psk
+	if p.onPresharedKey != nil {
+		p.onPresharedKey(psk)
+	}
+	return nil
+}
+
+// serverRouted returns the IPs or subnets that aren't reached directly.
+func serverRouted(ips []string, direct map[string]bool) []string {
+	routed := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if !direct[ip] {
+			routed = append(routed, ip)
+		}
+	}
+	return routed
+}
+
+// StartHeartBeat keeps the node registered and its peers in sync with the
+// server, beating at the interval the server advertised. It prefers the
+// server's membership stream and falls back to polling /beat while the stream
+// is unavailable. It returns once polling fails too, or with errRekeyDue
+// once the session's key should be rotated.
+func (s *Session) StartHeartBeat() error {
+	hbReq := &wg.HeartBeatRequest{
+		PublicKey: s.pubKey,
+	}
+	node := s.node
+	peerSync := NewPeerSync(s.iface.Name, s.pubKey, node.ServerPubKey, node.ServerPeerIP, s.mesh)
+	peerSync.routes = node.Routes
+	peerSync.privKey = s.privKey
+	peerSync.presharedKey = node.PresharedKey
+	peerSync.onResponse = func() { s.setConnected(true, nil) }
+	if node.PresharedKey != "" {
+		hbReq.PresharedKeyFingerprint = wg.KeyFingerprint(node.PresharedKey)
+	}
+	peerSync.onPresharedKey = func(psk string) {
+		// Acknowledge right away instead of with the next beat, as handshakes
+		// fail while the server still uses the old key. Later beats and
+		// reopened streams acknowledge it again if this one doesn't arrive.
+		hbReq.PresharedKeyFingerprint = wg.KeyFingerprint(psk)
+		if _, err := s.httpClient.beat(s.service, hbReq); err != nil {
+			log.Errorf("Unable to acknowledge the rotated preshared key: %s", err)
+		}
+	}
+	if node.GracePeriod > 0 && node.GracePeriod <= node.HeartBeatInterval+node.HeartBeatInterval/10 {
+		log.Warnf("Server purges nodes after %s but wants heart beats every %s, expect to be purged", node.GracePeriod, node.HeartBeatInterval)
+	}
+	log.Infof("Starting heart beat every %s", node.HeartBeatInterval)
+	stop, release := s.untilRekey()
+	defer release()
+	for {
+		err := s.httpClient.followEvents(s.service, hbReq, peerSync, node.HeartBeatInterval, stop)
+		if err == errSessionClosed {
+			return s.stopped()
+		}
+		if err == errNodeNotFound || err == errServerShuttingDown {
+			return err
+		}
+		log.Infof("Membership stream unavailable, polling instead: %s", err)
+		if err := s.httpClient.pollHeartBeats(s.service, hbReq, peerSync, node.HeartBeatInterval, streamRetryInterval, stop); err != nil {
+			if err == errSessionClosed {
+				return s.stopped()
+			}
+			log.Info("Stopping heart beat")
+			return err
+		}
+	}
+}
+
+// pollHeartBeats sends a heart beat roughly every interval for duration, or
+// until done is closed.
+func (w *WireGateHTTPClient) pollHeartBeats(wgService *WireGateService, hbReq *wg.HeartBeatRequest, peerSync *PeerSync, interval, duration time.Duration, done <-chan struct{}) error {
+	hbTimer := time.NewTimer(jitter(interval))
+	defer hbTimer.Stop()
+	deadline := time.After(duration)
+	for {
+		select {
+		case <-done:
+			return errSessionClosed
+		case <-deadline:
+			return nil
+		case <-hbTimer.C:
+			hbTimer.Reset(jitter(interval))
+			hbReq.Revision = peerSync.membership.Revision()
+			hbRsp, err := w.beat(wgService, hbReq)
+			if err != nil {
+				return err
+			}
+			if err := peerSync.Apply(hbRsp); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// beat sends a single heart beat and returns the server's answer.
+func (w *WireGateHTTPClient) beat(wgService *WireGateService, hbReq *wg.HeartBeatRequest) (*wg.HeartBeatResponse, error) {
+	var reqBuffer bytes.Buffer
+	json.NewEncoder(&reqBuffer).Encode(hbReq)
+	endpointURL := fmt.Sprintf("https://%s/beat", wgService.HTTPEndpoint)
+	rsp, err := w.client.Post(endpointURL, "application/json", &reqBuffer)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeartBeatStatus(rsp); err != nil {
+		return nil, err
+	}
+	log.Debugf("Received beat response: %#v", rsp)
+	defer rsp.Body.Close()
+	var hbRsp wg.HeartBeatResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&hbRsp); err != nil {
+		return nil, fmt.Errorf("Error while decoding heartbeat response: %s", err)
+	}
+	return &hbRsp, nil
+}
+
+// followEvents applies membership updates pushed by the server for as long
+// as the stream stays alive, which doubles as this node's heart beat, or until
+// closed is closed.
+func (w *WireGateHTTPClient) followEvents(wgService *WireGateService, hbReq *wg.HeartBeatRequest, peerSync *PeerSync, interval time.Duration, closed <-chan struct{}) error {
+	var reqBuffer bytes.Buffer
+	hbReq.Revision = peerSync.membership.Revision()
+	json.NewEncoder(&reqBuffer).Encode(hbReq)
+	endpointURL := fmt.Sprintf("https://%s/events", wgService.HTTPEndpoint)
+	rsp, err := w.client.Post(endpointURL, "application/json", &reqBuffer)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if err := checkHeartBeatStatus(rsp); err != nil {
+		return err
+	}
+	log.Info("Following membership stream")
+
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		scanner := bufio.NewScanner(rsp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			readErr <- err
+		} else {
+			readErr <- fmt.Errorf("stream closed by server")
+		}
+	}()
+
+	livenessTimeout := streamMissedPings * interval
+	liveness := time.NewTimer(livenessTimeout)
+	defer liveness.Stop()
+	var data strings.Builder
+	for {
+		select {
+		case <-closed:
+			return errSessionClosed
+		case err := <-readErr:
+			return err
+		case <-liveness.C:
+			return fmt.Errorf("no keepalive from server in %s", livenessTimeout)
+		case line := <-lines:
+			if !liveness.Stop() {
+				<-liveness.C
+			}
+			liveness.Reset(livenessTimeout)
+			switch {
+			case strings.HasPrefix(line, "data:"):
+				data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			case line == "" && data.Len() > 0:
+				var hbRsp wg.HeartBeatResponse
+				if err := json.Unmarshal([]byte(data.String()), &hbRsp); err != nil {
+					return fmt.Errorf("Error while decoding membership event: %s", err)
+				}
+				data.Reset()
+				if err := peerSync.Apply(&hbRsp); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// checkHeartBeatStatus turns unsuccessful responses into errors, closing
+// their body.
+func checkHeartBeatStatus(rsp *http.Response) error {
+	if rsp.StatusCode == http.StatusOK {
+		return nil
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return errNodeNotFound
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	return fmt.Errorf("Server error (%d): %s", rsp.StatusCode, strings.TrimSpace(string(body)))
+}
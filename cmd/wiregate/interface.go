@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+// WGInterfaceConfig holds the client's WireGuard interface settings. Zero
+// values leave the WireGuard/kernel defaults in place.
+type WGInterfaceConfig struct {
+	Name       string
+	MTU        int
+	Keepalive  int
+	ListenPort int
+	FwMark     string
+	// The gateway mode to ask the server for, empty takes what it offers
+	Gateway string
+	// Subnets behind this client to route for the other clients
+	Subnets []string `json:",omitempty"`
+	// Seconds between rotations of the client's WireGuard key, 0 keeps it
+	// for the whole session
+	RekeyInterval int `json:",omitempty"`
+}
+
+// Routes pinning the server's endpoint to the default gateway are tagged with
+// this protocol number, so they can be told apart from the system's.
+const endpointRouteProto = "74"
+
+// Routes to subnets behind other clients are tagged with this protocol
+// number, so they can be synced without remembering which were added.
+const peerSubnetRouteProto = "75"
+
+func createWGInterface(iface *WGInterfaceConfig, wgPrivKey string, registeredNode *RegisteredNode) error {
+	if _, err := exec.LookPath("wg"); err != nil {
+		return fmt.Errorf("Unable to call 'wg', is WireGuard installed?")
+	}
+	log.Debugf("Creating interface %s", iface.Name)
+	createIface := exec.Command("ip", "link", "add", "dev", iface.Name, "type", "wireguard")
+	if out, err := createIface.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while creating %s interface: %s\n%s", iface.Name, err, out)
+	}
+	if err := configureWGInterface(iface, wgPrivKey, registeredNode); err != nil {
+		if err := destroyWGInterface(iface.Name); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func configureWGInterface(iface *WGInterfaceConfig, wgPrivKey string, registeredNode *RegisteredNode) error {
+	//address nodeIP must be a cidr
+	nodeIPwithCIDR := fmt.Sprintf("%s/%s", registeredNode.IP, registeredNode.CIDR)
+	log.Debugf("Configuring %s with address %s", iface.Name, nodeIPwithCIDR)
+	addIfaceAddr := exec.Command("ip", "address", "add", "dev", iface.Name, nodeIPwithCIDR)
+	if out, err := addIfaceAddr.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while assigning address '%s' to %s interface: %s\n%s", registeredNode.IP, iface.Name, err, out)
+	}
+	if iface.MTU > 0 {
+		setMTU := exec.Command("ip", "link", "set", "mtu", strconv.Itoa(iface.MTU), "dev", iface.Name)
+		if out, err := setMTU.CombinedOutput(); err != nil {
+			return fmt.Errorf("Error while setting MTU of %s interface to %d: %s\n%s", iface.Name, iface.MTU, err, out)
+		}
+	}
+
+	wgPrivKeyPath, err := WriteRestrictedFile("wiregate_pkey", wgPrivKey)
+	if err != nil {
+		return fmt.Errorf("Error while saving private wireguard key: %s", err)
+	}
+	wgArgs := []string{"set", iface.Name, "private-key", wgPrivKeyPath}
+	if iface.ListenPort > 0 {
+		wgArgs = append(wgArgs, "listen-port", strconv.Itoa(iface.ListenPort))
+	}
+	if iface.FwMark != "" {
+		wgArgs = append(wgArgs, "fwmark", iface.FwMark)
+	}
+	wgSetIface := exec.Command("wg", wgArgs...)
+	if out, err := wgSetIface.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while setting up WireGuard interface settings: %s\n%s", err, out)
+	}
+	if err := configureServerPeer(iface, registeredNode); err != nil {
+		return err
+	}
+	log.Debugf("Turning %s up", iface.Name)
+	enableIface := exec.Command("ip", "link", "set", "up", "dev", iface.Name)
+	if out, err := enableIface.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while enabling interface '%s': %s\n%s", iface.Name, err, out)
+	}
+	return applyGateway(iface, registeredNode)
+}
+
+func configureServerPeer(iface *WGInterfaceConfig, registeredNode *RegisteredNode) error {
+	allowedIPs := append(append([]string(nil), registeredNode.AllowedIPs...), registeredNode.ServerPeerIP)
+	formattedAllowedIPs := serverPeerAllowedIPs(allowedIPs, registeredNode.Routes)
+	wgArgs := []string{"set", iface.Name, "peer", registeredNode.ServerPubKey, "endpoint", registeredNode.EndpointIPPortPair, "allowed-ips", formattedAllowedIPs}
+	if iface.Keepalive > 0 {
+		wgArgs = append(wgArgs, "persistent-keepalive", strconv.Itoa(iface.Keepalive))
+	}
+	wgSetPeer := exec.Command("wg", wgArgs...)
+	if out, err := wgSetPeer.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while configuring WireGate server peer: %s\n%s", err, out)
+	}
+	if registeredNode.PresharedKey != "" {
+		return setPresharedKey(iface.Name, registeredNode.ServerPubKey, registeredNode.PresharedKey)
+	}
+	return nil
+}
+
+// setPresharedKey sets the preshared key of the peer with pubKey, which 'wg'
+// only reads from a file.
+func setPresharedKey(ifaceName, pubKey, psk string) error {
+	pskPath, err := WriteRestrictedFile("PresharedKey", psk)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(pskPath))
+	if out, err := exec.Command("wg", "set", ifaceName, "peer", pubKey, "preshared-key", pskPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while setting preshared key of peer %s: %s\n%s", pubKey, err, out)
+	}
+	return nil
+}
+
+// setPrivateKey switches the interface to a new private key, which 'wg' only
+// reads from a file. Its peers handshake with the new key on the next packet.
+func setPrivateKey(ifaceName, privKey string) error {
+	privKeyPath, err := WriteRestrictedFile("wiregate_pkey", privKey)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(privKeyPath))
+	if out, err := exec.Command("wg", "set", ifaceName, "private-key", privKeyPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while setting private key of %s: %s\n%s", ifaceName, err, out)
+	}
+	return nil
+}
+
+// reconfigureWGInterface applies a new registration to an existing interface.
+func reconfigureWGInterface(iface *WGInterfaceConfig, oldNode, newNode *RegisteredNode) error {
+	if oldNode.IP != newNode.IP || oldNode.CIDR != newNode.CIDR {
+		log.Infof("Server assigned new address %s/%s, was %s/%s", newNode.IP, newNode.CIDR, oldNode.IP, oldNode.CIDR)
+		oldAddr := fmt.Sprintf("%s/%s", oldNode.IP, oldNode.CIDR)
+		if out, err := exec.Command("ip", "address", "del", "dev", iface.Name, oldAddr).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error while removing address '%s' from %s interface: %s\n%s", oldAddr, iface.Name, err, out)
+		}
+		newAddr := fmt.Sprintf("%s/%s", newNode.IP, newNode.CIDR)
+		if out, err := exec.Command("ip", "address", "add", "dev", iface.Name, newAddr).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error while assigning address '%s' to %s interface: %s\n%s", newAddr, iface.Name, err, out)
+		}
+	}
+	if oldNode.ServerPubKey != newNode.ServerPubKey {
+		log.Infof("WireGate server key changed to %s", newNode.ServerPubKey)
+		if out, err := exec.Command("wg", "set", iface.Name, "peer", oldNode.ServerPubKey, "remove").CombinedOutput(); err != nil {
+			return fmt.Errorf("Error while removing old WireGate server peer: %s\n%s", err, out)
+		}
+	}
+	if err := configureServerPeer(iface, newNode); err != nil {
+		return err
+	}
+	if oldNode.Gateway != newNode.Gateway || !reflect.DeepEqual(oldNode.Routes, newNode.Routes) || !reflect.DeepEqual(oldNode.DNS, newNode.DNS) {
+		log.Infof("WireGate server changed the routes it offers from %v to %v", oldNode.Routes, newNode.Routes)
+		removeGateway(iface.Name, oldNode)
+		return applyGateway(iface, newNode)
+	}
+	return nil
+}
+
+// serverPeerAllowedIPs formats the VPN IPs and routed subnets reached through
+// the server for 'wg set'.
+func serverPeerAllowedIPs(ips []string, routes []string) string {
+	formatted := formatAllowedIPsWithCIDR(ips)
+	if len(routes) > 0 {
+		formatted = strings.Join(append([]string{formatted}, routes...), ",")
+	}
+	return formatted
+}
+
+// applyGateway routes the subnets the server's gateway mode covers through
+// iface and switches DNS to the servers it handed out, if any.
+func applyGateway(iface *WGInterfaceConfig, registeredNode *RegisteredNode) error {
+	if len(registeredNode.Routes) > 0 {
+		log.Infof("WireGate server is a %s gateway, routing %s through it", registeredNode.Gateway, strings.Join(registeredNode.Routes, ", "))
+	}
+	for _, route := range registeredNode.Routes {
+		routes := []string{route}
+		if route == "0.0.0.0/0" {
+			// Two halves beat the default route without replacing it, but
+			// the server itself must still be reached the old way
+			if err := pinEndpointRoute(registeredNode.EndpointIPPortPair); err != nil {
+				return err
+			}
+			routes = []string{"0.0.0.0/1", "128.0.0.0/1"}
+		} else if localIface := directlyConnected(route, iface.Name); localIface != "" {
+			log.Infof("Not routing %s through WireGate, it's reachable directly on %s", route, localIface)
+			continue
+		}
+		for _, r := range routes {
+			if out, err := exec.Command("ip", "route", "add", r, "dev", iface.Name).CombinedOutput(); err != nil {
+				return fmt.Errorf("Error while routing %s through %s: %s\n%s", r, iface.Name, err, out)
+			}
+		}
+	}
+	if len(registeredNode.DNS) > 0 {
+		setDNS(iface.Name, registeredNode.DNS)
+	}
+	return nil
+}
+
+// removeGateway undoes applyGateway for a node that's staying connected.
+func removeGateway(ifaceName string, registeredNode *RegisteredNode) {
+	for _, route := range registeredNode.Routes {
+		routes := []string{route}
+		if route == "0.0.0.0/0" {
+			unpinEndpointRoute(registeredNode.EndpointIPPortPair)
+			routes = []string{"0.0.0.0/1", "128.0.0.0/1"}
+		}
+		for _, r := range routes {
+			// Fails for routes applyGateway skipped, which is fine
+			exec.Command("ip", "route", "del", r, "dev", ifaceName).CombinedOutput()
+		}
+	}
+	if len(registeredNode.DNS) > 0 {
+		unsetDNS(ifaceName)
+	}
+}
+
+// syncPeerSubnetRoutes routes subnets behind other clients through ifaceName
+// and removes the routes to ones that went away. Subnets on the local network
+// stay reachable directly.
+func syncPeerSubnetRoutes(ifaceName string, subnets []string) error {
+	out, err := exec.Command("ip", "-4", "route", "show", "dev", ifaceName, "proto", peerSubnetRouteProto).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error while listing routes through %s: %s\n%s", ifaceName, err, out)
+	}
+	routed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			routed[fields[0]] = true
+		}
+	}
+	wanted := make(map[string]bool, len(subnets))
+	for _, subnet := range subnets {
+		if localIface := directlyConnected(subnet, ifaceName); localIface != "" {
+			log.Debugf("Not routing %s through WireGate, it's reachable directly on %s", subnet, localIface)
+			continue
+		}
+		wanted[subnet] = true
+		if routed[subnet] {
+			continue
+		}
+		log.Infof("Routing %s through %s to the client advertising it", subnet, ifaceName)
+		if out, err := exec.Command("ip", "route", "replace", subnet, "dev", ifaceName, "proto", peerSubnetRouteProto).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error while routing %s through %s: %s\n%s", subnet, ifaceName, err, out)
+		}
+	}
+	for subnet := range routed {
+		if !wanted[subnet] {
+			log.Infof("No client advertises %s anymore, removing its route", subnet)
+			exec.Command("ip", "route", "del", subnet, "dev", ifaceName, "proto", peerSubnetRouteProto).CombinedOutput()
+		}
+	}
+	return nil
+}
+
+// directlyConnected returns the interface other than ifaceName that's on a
+// subnet overlapping route, if any.
+func directlyConnected(route, ifaceName string) string {
+	_, routeNet, err := net.ParseCIDR(route)
+	if err != nil {
+		return ""
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if iface.Name == ifaceName {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ifaceNet, ok := addr.(*net.IPNet)
+			if !ok || ifaceNet.IP.To4() == nil || ifaceNet.IP.IsLoopback() {
+				continue
+			}
+			if routeNet.Contains(ifaceNet.IP) || ifaceNet.Contains(routeNet.IP) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// pinEndpointRoute keeps the server's endpoint routed through the current
+// gateway once all other traffic goes through the VPN. Endpoints on the local
+// network don't need it.
+func pinEndpointRoute(endpoint string) error {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("Invalid WireGate server endpoint %s: %s", endpoint, err)
+	}
+	// Only IPv4 goes through the server in exit mode
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return nil
+	}
+	out, err := exec.Command("ip", "route", "get", host).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error while looking up the route to %s: %s\n%s", host, err, out)
+	}
+	var via, dev string
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			via = fields[i+1]
+		case "dev":
+			dev = fields[i+1]
+		}
+	}
+	if via == "" || dev == "" {
+		return nil
+	}
+	log.Debugf("Pinning route to %s via %s dev %s", host, via, dev)
+	pin := exec.Command("ip", "route", "replace", host+"/32", "via", via, "dev", dev, "proto", endpointRouteProto)
+	if out, err := pin.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error while pinning the route to %s: %s\n%s", host, err, out)
+	}
+	return nil
+}
+
+// unpinEndpointRoute removes the route pinEndpointRoute added, if any.
+func unpinEndpointRoute(endpoint string) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return
+	}
+	exec.Command("ip", "route", "del", host+"/32", "proto", endpointRouteProto).CombinedOutput()
+}
+
+// setDNS points the system's resolver at servers while ifaceName is up,
+// through resolvconf like wg-quick does.
+func setDNS(ifaceName string, servers []string) {
+	if _, err := exec.LookPath("resolvconf"); err != nil {
+		log.Warnf("WireGate server wants DNS queries to go to %s, but 'resolvconf' isn't installed. Set it up yourself to keep them inside the VPN", strings.Join(servers, ", "))
+		return
+	}
+	var conf strings.Builder
+	for _, server := range servers {
+		fmt.Fprintf(&conf, "nameserver %s\n", server)
+	}
+	setDNS := exec.Command("resolvconf", "-a", ifaceName, "-m", "0", "-x")
+	setDNS.Stdin = strings.NewReader(conf.String())
+	if out, err := setDNS.CombinedOutput(); err != nil {
+		log.Warnf("Unable to switch DNS to %s: %s\n%s", strings.Join(servers, ", "), err, out)
+		return
+	}
+	log.Infof("Using DNS servers %s", strings.Join(servers, ", "))
+}
+
+func unsetDNS(ifaceName string) {
+	if _, err := exec.LookPath("resolvconf"); err == nil {
+		exec.Command("resolvconf", "-d", ifaceName, "-f").CombinedOutput()
+	}
+}
+
+// endpointIPs returns the IPs of the peer endpoints ifaceName knows.
+func endpointIPs(ifaceName string) []string {
+	out, err := exec.Command("wg", "show", ifaceName, "endpoints").CombinedOutput()
+	if err != nil {
+		return nil
+	}
+	var ips []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(fields[1]); err == nil {
+			ips = append(ips, host)
+		}
+	}
+	return ips
+}
+
+// Subnet returns the VPN subnet the node's address is in.
+func (n *RegisteredNode) Subnet() (*net.IPNet, error) {
+	address := fmt.Sprintf("%s/%s", n.IP, n.CIDR)
+	_, subnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, fmt.Errorf("Server assigned invalid address %s: %s", address, err)
+	}
+	return subnet, nil
+}
+
+// checkSubnetOverlap makes sure subnet doesn't overlap the VPN subnet of
+// another WireGate interface that's up, so their routes don't clash.
+func checkSubnetOverlap(ifaceName string, subnet *net.IPNet) error {
+	states, err := listSessionStates()
+	if err != nil {
+		log.Warnf("Unable to check other WireGate interfaces for overlapping subnets: %s", err)
+		return nil
+	}
+	for _, state := range states {
+		if state.Interface == ifaceName || state.Subnet == "" {
+			continue
+		}
+		if _, err := net.InterfaceByName(state.Interface); err != nil {
+			// Left behind by a client that didn't exit cleanly
+			continue
+		}
+		_, other, err := net.ParseCIDR(state.Subnet)
+		if err != nil {
+			continue
+		}
+		if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+			return fmt.Errorf("%w: %s overlaps %s used by %s for WireGate server %s", errSubnetOverlap, subnet, other, state.Interface, state.Server)
+		}
+	}
+	return nil
+}
+
+// checkRouteOverlap makes sure subnet doesn't overlap a network this computer
+// already routes to, which the VPN's routes would break or be shadowed by.
+// Routes through WireGate interfaces are left to checkSubnetOverlap, and the
+// split default routes of exit gateway mode cover everything, so they're
+// skipped too.
+func checkRouteOverlap(ifaceName string, subnet *net.IPNet) error {
+	routes, err := localRoutes()
+	if err != nil {
+		log.Warnf("Unable to check routes for networks overlapping the VPN subnet: %s", err)
+		return nil
+	}
+	wiregateIfaces := map[string]bool{ifaceName: true}
+	if states, err := listSessionStates(); err == nil {
+		for _, state := range states {
+			wiregateIfaces[state.Interface] = true
+		}
+	}
+	for _, r := range routes {
+		if wiregateIfaces[r.Interface] {
+			continue
+		}
+		if ones, _ := r.Subnet.Mask.Size(); ones <= 1 {
+			continue
+		}
+		if r.Subnet.Contains(subnet.IP) || subnet.Contains(r.Subnet.IP) {
+			return fmt.Errorf("%w: %s overlaps the route to %s on %s, the server's operator has to pick another '-wg-cidr'", errSubnetOverlap, subnet, r.Subnet, r.Interface)
+		}
+	}
+	return nil
+}
+
+func destroyWGInterface(ifaceName string) error {
+	endpoints := endpointIPs(ifaceName)
+	log.Debugf("Deleting interface %s", ifaceName)
+	ipLinkDelete := exec.Command("ip", "link", "delete", "dev", ifaceName)
+	if out, err := ipLinkDelete.CombinedOutput(); err != nil {
+		return fmt.Errorf("Encountered error while removing WireGuard interface '%s': %s\n%s", ifaceName, err, out)
+	}
+	// Routes through the interface went with it, but not those pinning its
+	// endpoints or its DNS servers
+	for _, ip := range endpoints {
+		exec.Command("ip", "route", "del", ip+"/32", "proto", endpointRouteProto).CombinedOutput()
+	}
+	unsetDNS(ifaceName)
+	return nil
+}
+
+// exportWgQuickConfig writes a wg-quick config equivalent to the interface
+// createWGInterface would set up. Since nothing keeps its allowed IPs up to
+// date, the server peer gets the whole VPN subnet.
+func exportWgQuickConfig(path string, iface *WGInterfaceConfig, wgPrivKey string, registeredNode *RegisteredNode) error {
+	address := fmt.Sprintf("%s/%s", registeredNode.IP, registeredNode.CIDR)
+	vpnSubnet, err := registeredNode.Subnet()
+	if err != nil {
+		return err
+	}
+	conf := &wg.WgQuickConfig{
+		Interface: wg.WgQuickInterface{
+			Address:    address,
+			PrivateKey: wgPrivKey,
+			ListenPort: iface.ListenPort,
+			MTU:        iface.MTU,
+			FwMark:     iface.FwMark,
+			DNS:        registeredNode.DNS,
+		},
+		Peers: []wg.WgQuickPeer{{
+			PublicKey:           registeredNode.ServerPubKey,
+			PresharedKey:        registeredNode.PresharedKey,
+			Endpoint:            registeredNode.EndpointIPPortPair,
+			AllowedIPs:          append([]string{vpnSubnet.String()}, registeredNode.Routes...),
+			PersistentKeepalive: iface.Keepalive,
+		}},
+	}
+	if err := ioutil.WriteFile(path, []byte(conf.String()), 0600); err != nil {
+		return fmt.Errorf("Error while writing wg-quick config to %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+// Where clients record their sessions, so '-leave' can clean up after one
+// that didn't exit cleanly.
+const clientStateDir = "/var/run/wiregate"
+
+// How long to wait for the server to acknowledge a node leaving.
+const leaveTimeout = 5 * time.Second
+
+// sessionState is what a client records about its session on disk.
+type sessionState struct {
+	Interface    string
+	PublicKey    string
+	Server       string
+	HTTPEndpoint string
+	// The VPN subnet, so other sessions can avoid overlapping it
+	Subnet string
+}
+
+func sessionStatePath(ifaceName string) string {
+	return filepath.Join(clientStateDir, ifaceName+".json")
+}
+
+func writeSessionState(state *sessionState) error {
+	if err := os.MkdirAll(clientStateDir, 0700); err != nil {
+		return fmt.Errorf("Error while creating %s: %s", clientStateDir, err)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(sessionStatePath(state.Interface), data, 0600); err != nil {
+		return fmt.Errorf("Error while writing session state: %s", err)
+	}
+	return nil
+}
+
+func readSessionState(ifaceName string) (*sessionState, error) {
+	data, err := ioutil.ReadFile(sessionStatePath(ifaceName))
+	if err != nil {
+		return nil, err
+	}
+	var state sessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Error while decoding session state %s: %s", sessionStatePath(ifaceName), err)
+	}
+	return &state, nil
+}
+
+// listSessionStates returns the recorded sessions of all WireGate interfaces.
+func listSessionStates() ([]*sessionState, error) {
+	paths, err := filepath.Glob(filepath.Join(clientStateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*sessionState, 0, len(paths))
+	for _, path := range paths {
+		state, err := readSessionState(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			log.Debugf("Skipping session state %s: %s", path, err)
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func removeSessionState(ifaceName string) {
+	if err := os.Remove(sessionStatePath(ifaceName)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error while removing session state: %s", err)
+	}
+}
+
+// unregisterNode tells the server at apiEndpoint to forget pubKey right away
+// instead of waiting for its heart beats to stop.
+func (w *WireGateHTTPClient) unregisterNode(pubKey, apiEndpoint string) error {
+	var reqBuffer bytes.Buffer
+	json.NewEncoder(&reqBuffer).Encode(&wg.DeregistrationRequest{PublicKey: pubKey})
+	ctx, cancel := context.WithTimeout(context.Background(), leaveTimeout)
+	defer cancel()
+	url := fmt.Sprintf("https://%s/unregister", apiEndpoint)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, &reqBuffer)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error while communicating with WireGate Control: %s", err)
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errNodeNotFound
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	return fmt.Errorf("Server error (%d): %s", rsp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// leave unregisters pubKey from the server at apiEndpoint, logging instead
+// of failing since the server purges the node eventually anyway.
+func leave(httpClient *WireGateHTTPClient, pubKey, apiEndpoint string) {
+	log.Infof("Unregistering from WireGate server at %s", apiEndpoint)
+	err := httpClient.unregisterNode(pubKey, apiEndpoint)
+	switch {
+	case err == errNodeNotFound:
+		log.Info("WireGate server had already forgotten this node")
+	case err != nil:
+		log.Errorf("Unable to unregister, the server will purge this node later: %s", err)
+	}
+}
+
+// leave_main cleans up after a client that didn't exit cleanly: it
+// unregisters the node it left behind and removes its interface.
+func leave_main(conf *ClientConfig) {
+	ifaceName := conf.iface.Name
+	state, err := readSessionState(ifaceName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		log.Warnf("No previous session found on %s, the server won't be told it left", ifaceName)
+	} else {
+		leave(get_http_client(), state.PublicKey, state.HTTPEndpoint)
+	}
+	exitCode := 0
+	if _, err := net.InterfaceByName(ifaceName); err == nil {
+		if err := destroyWGInterface(ifaceName); err != nil {
+			log.Error(err)
+			exitCode = 1
+		}
+	}
+	removeSessionState(ifaceName)
+	os.Exit(exitCode)
+}
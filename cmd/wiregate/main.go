@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
 )
 
 const wgVersion = "0.9.4"
@@ -33,27 +38,101 @@ func printHelp() {
 	fmt.Println("Available commands:")
 	fmt.Println("server\tStart as WireGate server")
 	fmt.Println("client\tStart as client")
+	fmt.Println("provision\tRegister a peer for a phone and show its config as a QR code")
+	fmt.Println("up\tConnect in the background, takes the same flags as client")
+	fmt.Println("down\tDisconnect an interface brought up with 'up'")
+	fmt.Println("status\tShow interfaces brought up with 'up'")
+	fmt.Println("daemon\tRun the background client that up, down and status talk to")
 	fmt.Println("version\tPrint version")
 	fmt.Println("help\tPrint this text")
 	fmt.Println("")
 	fmt.Println("Use 'wiregate [command] --help' for more information about a command")
+	fmt.Println("")
+	fmt.Println("The client exits with status 3 if no server was found, 4 on a bad password,")
+	fmt.Println("5 if the server has no VPN IPs left and 6 if its VPN subnet overlaps another")
+	fmt.Println("WireGate network this computer is in.")
 }
 
-func main() {
-	var server = flag.NewFlagSet("server", flag.ExitOnError)
-	var iface = server.String("interface", "", "REQUIRED: Network interface to use")
-	var wgIface = server.String("wg-interface", "wg0", "Name for WireGuard interface")
-	var wgPort = server.Int("wg-port", 51820, "WireGuard port")
-	var wgCIDR = server.String("wg-cidr", "10.24.1.1/24", "IPv4 CIDR subnet for WireGuard VPN. The WireGuard interface will use the first subnet address")
-	var mdnsServiceDesc = server.String("http-service-description", "Wiregate", "MDNS WireGate HTTP Control description")
-	var httpPort = server.Int("http-port", 38490, "WireGate HTTP Control port")
-	var vpnPassword = server.String("vpn-password", "", "REQUIRED: Password to register with the WireGate VPN")
-	var purgeInterval = server.Int("purge-interval", 10, "Interval to purge unresponsive clients")
-	var serverDebug = server.Bool("debug", false, "Turn on debug-level logging")
+// validateDiscoveryFlags checks flags shared by commands that find a server
+// and authenticate with it.
+func validateDiscoveryFlags(passwordFile, passwordEnv string, passwordStdin bool, mdnsTimeout int) {
+	passwordSources := 0
+	for _, set := range []bool{passwordFile != "", passwordEnv != "", passwordStdin} {
+		if set {
+			passwordSources++
+		}
+	}
+	if passwordSources > 1 {
+		fmt.Printf("Use only one of '-password-file', '-password-env' and '-password-stdin'!")
+		os.Exit(1)
+	}
+	if mdnsTimeout <= 0 {
+		fmt.Printf("'-mdns-timeout' must be positive!")
+		os.Exit(1)
+	}
+}
 
+// parseSubnets parses a comma-separated list of CIDR subnets.
+func parseSubnets(list string) ([]string, error) {
+	var subnets []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a CIDR subnet", s)
+		}
+		subnets = append(subnets, subnet.String())
+	}
+	return subnets, nil
+}
+
+func main() {
 	var client = flag.NewFlagSet("client", flag.ExitOnError)
+	var clientServer = client.String("server", "", "WireGate server to connect to, by name, host:port or index in the list of found servers. Prompts if empty")
+	var clientUser = client.String("user", "", "Register as this user, with the user's password instead of the VPN password")
+	var passwordFile = client.String("password-file", "", "Read the VPN password from this file")
+	var passwordEnv = client.String("password-env", "", "Read the VPN password from this environment variable")
+	var passwordStdin = client.Bool("password-stdin", false, "Read the VPN password from the first line of stdin")
+	var mdnsTimeout = client.Int("mdns-timeout", 3, "Seconds to search for WireGate servers on the local network before listing them or giving up")
+	var clientNetwork = client.String("network", "", "Only look for WireGate servers of this network, as set with the server's '-network'")
+	var clientWgIface = client.String("wg-interface", "wg0", "Name for WireGuard interface, which must not exist yet")
+	var clientMTU = client.Int("mtu", 0, "MTU of the WireGuard interface, 0 uses the default")
+	var keepalive = client.Int("keepalive", 0, "Seconds between persistent keepalives sent to the server, 0 disables them")
+	var clientListenPort = client.Int("listen-port", 0, "WireGuard listen port, 0 picks a random one")
+	var fwMark = client.String("fwmark", "", "Firewall mark for WireGuard's outgoing packets, eg. 0x1234")
+	var clientGateway = client.String("gateway", "", "Route at most this much through the server, if it offers it: isolated, lan or exit. Empty takes what the server offers")
+	var advertiseSubnets = client.String("advertise-subnets", "", "Comma-separated subnets behind this client, eg. a lab's LAN, to route for the other clients. The server must allow them")
+	var rekeyInterval = client.Int("rekey-interval", 86400, "Seconds between rotations of the client's WireGuard key, 0 keeps it for the whole session")
+	var clientExport = client.String("export", "", "Register, then write a wg-quick config to this file instead of configuring the interface")
+	var exportLease = client.Int("export-lease", 86400, "Seconds the server should keep an exported peer registered")
+	var clientLeave = client.Bool("leave", false, "Unregister the node a previous client left behind on '-wg-interface', remove the interface and exit")
 	var clientDebug = client.Bool("debug", false, "Turn on debug-level logging")
 
+	var provision = flag.NewFlagSet("provision", flag.ExitOnError)
+	var provisionServer = provision.String("server", "", "WireGate server to provision the peer on, by name, host:port or index in the list of found servers. Prompts if empty")
+	var provisionUser = provision.String("user", "", "Register the peer as this user, with the user's password instead of the VPN password")
+	var provisionPasswordFile = provision.String("password-file", "", "Read the VPN password from this file")
+	var provisionPasswordEnv = provision.String("password-env", "", "Read the VPN password from this environment variable")
+	var provisionPasswordStdin = provision.Bool("password-stdin", false, "Read the VPN password from the first line of stdin")
+	var provisionMdnsTimeout = provision.Int("mdns-timeout", 3, "Seconds to search for WireGate servers on the local network before listing them or giving up")
+	var provisionNetwork = provision.String("network", "", "Only look for WireGate servers of this network, as set with the server's '-network'")
+	var provisionLease = provision.Int("lease", 86400, "Seconds the server keeps the peer registered")
+	var provisionOut = provision.String("out", "", "Also write the peer's wg-quick config to this file")
+	var provisionDebug = provision.Bool("debug", false, "Turn on debug-level logging")
+
+	var down = flag.NewFlagSet("down", flag.ExitOnError)
+	var downWgIface = down.String("wg-interface", "wg0", "WireGuard interface to bring down")
+	var downDebug = down.Bool("debug", false, "Turn on debug-level logging")
+
+	var status = flag.NewFlagSet("status", flag.ExitOnError)
+	var statusJSON = status.Bool("json", false, "Print the status as JSON")
+
+	var daemon = flag.NewFlagSet("daemon", flag.ExitOnError)
+	var exitWhenIdle = daemon.Bool("exit-when-idle", false, "Exit once no interfaces are up anymore")
+	var daemonDebug = daemon.Bool("debug", false, "Turn on debug-level logging")
+
 	if len(os.Args) < 2 {
 		printHelp()
 		os.Exit(1)
@@ -61,34 +140,105 @@ func main() {
 
 	switch os.Args[1] {
 	case "server":
-		if err := server.Parse(os.Args[2:]); err == nil {
-			setupLogging(*serverDebug)
-
-			if *iface == "" {
-				fmt.Printf("Missing '-interface' argument!")
+		conf, err := loadServerConfig(os.Args[2:])
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		} else if err == errUsage {
+			os.Exit(2)
+		} else if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		setupLogging(conf.debug)
+		server_main(conf)
+	case "client", "up":
+		if err := client.Parse(os.Args[2:]); err == nil {
+			setupLogging(*clientDebug)
+			validateDiscoveryFlags(*passwordFile, *passwordEnv, *passwordStdin, *mdnsTimeout)
+			if *clientMTU < 0 || *keepalive < 0 || *clientListenPort < 0 || *clientListenPort > 65535 || *rekeyInterval < 0 {
+				fmt.Printf("'-mtu', '-keepalive', '-listen-port' and '-rekey-interval' must be valid non-negative numbers!")
+				os.Exit(1)
+			}
+			if *clientGateway != "" {
+				if err := wg.ValidateGatewayMode(*clientGateway); err != nil {
+					fmt.Printf("'-gateway': %s", err)
+					os.Exit(1)
+				}
+			}
+			subnets, err := parseSubnets(*advertiseSubnets)
+			if err != nil {
+				fmt.Printf("'-advertise-subnets': %s", err)
 				os.Exit(1)
 			}
-			if *vpnPassword == "" {
-				// TODO: check for weak password; generate share-able password if empty.
-				fmt.Printf("Missing '-vpn-password' argment!")
+			conf := &ClientConfig{
+				iface: &WGInterfaceConfig{
+					Name:       *clientWgIface,
+					MTU:        *clientMTU,
+					Keepalive:  *keepalive,
+					ListenPort: *clientListenPort,
+					FwMark:     *fwMark,
+					Gateway:    *clientGateway,
+					Subnets:    subnets,
+
+					RekeyInterval: *rekeyInterval,
+				},
+				server:        *clientServer,
+				user:          *clientUser,
+				passwordFile:  *passwordFile,
+				passwordEnv:   *passwordEnv,
+				passwordStdin: *passwordStdin,
+				mdnsTimeout:   *mdnsTimeout,
+				network:       *clientNetwork,
+				stdin:         bufio.NewReader(os.Stdin),
+				export:        *clientExport,
+				exportLease:   *exportLease,
+			}
+			if os.Args[1] == "up" {
+				if conf.export != "" || *clientLeave {
+					fmt.Printf("'-export' and '-leave' only work with 'wiregate client'!")
+					os.Exit(1)
+				}
+				up_main(conf)
+				return
+			}
+			if *clientLeave {
+				leave_main(conf)
+			}
+			client_main(conf)
+		}
+	case "provision":
+		if err := provision.Parse(os.Args[2:]); err == nil {
+			setupLogging(*provisionDebug)
+			validateDiscoveryFlags(*provisionPasswordFile, *provisionPasswordEnv, *provisionPasswordStdin, *provisionMdnsTimeout)
+			if *provisionLease <= 0 {
+				fmt.Printf("'-lease' must be positive!")
 				os.Exit(1)
 			}
-			conf := &ServerConfig{
-				iface:           *iface,
-				wgIface:         *wgIface,
-				wgPort:          *wgPort,
-				wgCIDR:          *wgCIDR,
-				mdnsServiceDesc: *mdnsServiceDesc,
-				httpPort:        *httpPort,
-				vpnPassword:     *vpnPassword,
-				purgeInterval:   *purgeInterval,
+			conf := &ClientConfig{
+				server:        *provisionServer,
+				user:          *provisionUser,
+				passwordFile:  *provisionPasswordFile,
+				passwordEnv:   *provisionPasswordEnv,
+				passwordStdin: *provisionPasswordStdin,
+				mdnsTimeout:   *provisionMdnsTimeout,
+				network:       *provisionNetwork,
+				stdin:         bufio.NewReader(os.Stdin),
 			}
-			server_main(conf)
+			provision_main(conf, *provisionLease, *provisionOut)
 		}
-	case "client":
-		if err := client.Parse(os.Args[2:]); err == nil {
-			setupLogging(*clientDebug)
-			client_main()
+	case "down":
+		if err := down.Parse(os.Args[2:]); err == nil {
+			setupLogging(*downDebug)
+			down_main(*downWgIface)
+		}
+	case "status":
+		if err := status.Parse(os.Args[2:]); err == nil {
+			status_main(*statusJSON)
+		}
+	case "daemon":
+		if err := daemon.Parse(os.Args[2:]); err == nil {
+			setupLogging(*daemonDebug)
+			daemon_main(*exitWhenIdle)
 		}
 	case "version":
 		fmt.Printf("WireGate %s\n", wgVersion)
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+// Membership is the client's copy of the server's registry, kept up to date
+// with the revisioned changes sent in heartbeat responses.
+type Membership struct {
+	revision uint64
+	peers    map[string]wg.MeshPeer
+}
+
+func NewMembership() *Membership {
+	return &Membership{peers: make(map[string]wg.MeshPeer)}
+}
+
+func (m *Membership) Revision() uint64 {
+	return m.revision
+}
+
+// Apply updates the membership from a heartbeat response and reports whether
+// any peer joined, left or changed.
+func (m *Membership) Apply(rsp *wg.HeartBeatResponse) bool {
+	changed := false
+	if rsp.Full {
+		peers := make(map[string]wg.MeshPeer, len(rsp.Peers))
+		for _, p := range rsp.Peers {
+			peers[p.PublicKey] = p
+		}
+		changed = len(peers) != len(m.peers)
+		for key, p := range peers {
+			if old, ok := m.peers[key]; !ok || !reflect.DeepEqual(old, p) {
+				changed = true
+			}
+		}
+		m.peers = peers
+	}
+	for _, c := range rsp.Changes {
+		if c.Revision <= m.revision {
+			continue
+		}
+		old, existed := m.peers[c.Peer.PublicKey]
+		if c.Removed {
+			if existed {
+				delete(m.peers, c.Peer.PublicKey)
+				changed = true
+			}
+		} else if !existed || !reflect.DeepEqual(old, c.Peer) {
+			m.peers[c.Peer.PublicKey] = c.Peer
+			changed = true
+		}
+	}
+	m.revision = rsp.Revision
+	return changed
+}
+
+func (m *Membership) Has(pubKey string) bool {
+	_, ok := m.peers[pubKey]
+	return ok
+}
+
+// IPs returns the VPN IPs of all members, sorted.
+func (m *Membership) IPs() []string {
+	ips := make([]string, 0, len(m.peers))
+	for _, p := range m.peers {
+		ips = append(ips, p.VPNIP)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Subnets returns the subnets routed through members other than ownPubKey,
+// sorted.
+func (m *Membership) Subnets(ownPubKey string) []string {
+	var subnets []string
+	for key, p := range m.peers {
+		if key != ownPubKey {
+			subnets = append(subnets, p.Subnets...)
+		}
+	}
+	sort.Strings(subnets)
+	return subnets
+}
+
+func (m *Membership) Peers() []wg.MeshPeer {
+	peers := make([]wg.MeshPeer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+func TestMembershipApply(t *testing.T) {
+	peer1 := wg.MeshPeer{PublicKey: "pubKey1", VPNIP: "10.24.1.2"}
+	peer2 := wg.MeshPeer{PublicKey: "pubKey2", VPNIP: "10.24.1.3"}
+	moved := wg.MeshPeer{PublicKey: "pubKey2", VPNIP: "10.24.1.3", Endpoint: "192.168.1.20:51820"}
+	peer3 := wg.MeshPeer{PublicKey: "pubKey3", VPNIP: "10.24.1.4", Subnets: []string{"192.168.50.0/24"}}
+	// Every case starts out knowing peer1 and peer2 at revision 5
+	initial := &wg.HeartBeatResponse{Revision: 5, Full: true, Peers: []wg.MeshPeer{peer1, peer2}}
+	var membershipTests = []struct {
+		name     string
+		rsp      *wg.HeartBeatResponse
+		changed  bool
+		ips      []string
+		revision uint64
+	}{
+		{"nothing new", &wg.HeartBeatResponse{Revision: 5}, false, []string{"10.24.1.2", "10.24.1.3"}, 5},
+		{"same full membership", &wg.HeartBeatResponse{Revision: 6, Full: true, Peers: []wg.MeshPeer{peer2, peer1}}, false, []string{"10.24.1.2", "10.24.1.3"}, 6},
+		{"full membership without a peer", &wg.HeartBeatResponse{Revision: 6, Full: true, Peers: []wg.MeshPeer{peer1}}, true, []string{"10.24.1.2"}, 6},
+		{"full membership with a changed peer", &wg.HeartBeatResponse{Revision: 6, Full: true, Peers: []wg.MeshPeer{peer1, moved}}, true, []string{"10.24.1.2", "10.24.1.3"}, 6},
+		{"peer joined", &wg.HeartBeatResponse{Revision: 6, Changes: []wg.MembershipChange{{Revision: 6, Peer: peer3}}}, true, []string{"10.24.1.2", "10.24.1.3", "10.24.1.4"}, 6},
+		{"peer left", &wg.HeartBeatResponse{Revision: 6, Changes: []wg.MembershipChange{{Revision: 6, Removed: true, Peer: peer2}}}, true, []string{"10.24.1.2"}, 6},
+		{"peer changed", &wg.HeartBeatResponse{Revision: 6, Changes: []wg.MembershipChange{{Revision: 6, Peer: moved}}}, true, []string{"10.24.1.2", "10.24.1.3"}, 6},
+		{"unknown peer left", &wg.HeartBeatResponse{Revision: 6, Changes: []wg.MembershipChange{{Revision: 6, Removed: true, Peer: peer3}}}, false, []string{"10.24.1.2", "10.24.1.3"}, 6},
+		{"unchanged peer", &wg.HeartBeatResponse{Revision: 6, Changes: []wg.MembershipChange{{Revision: 6, Peer: peer1}}}, false, []string{"10.24.1.2", "10.24.1.3"}, 6},
+		{"already applied change", &wg.HeartBeatResponse{Revision: 6, Changes: []wg.MembershipChange{{Revision: 5, Removed: true, Peer: peer1}, {Revision: 6, Peer: peer3}}}, true, []string{"10.24.1.2", "10.24.1.3", "10.24.1.4"}, 6},
+		{"joined then left", &wg.HeartBeatResponse{Revision: 7, Changes: []wg.MembershipChange{{Revision: 6, Peer: peer3}, {Revision: 7, Removed: true, Peer: peer3}}}, true, []string{"10.24.1.2", "10.24.1.3"}, 7},
+	}
+	for _, tt := range membershipTests {
+		m := NewMembership()
+		if !m.Apply(initial) {
+			t.Fatalf("Expected the first membership to be a change")
+		}
+		if changed := m.Apply(tt.rsp); changed != tt.changed {
+			t.Errorf("%s: expected changed to be %t, got %t", tt.name, tt.changed, changed)
+		}
+		if ips := m.IPs(); !reflect.DeepEqual(ips, tt.ips) {
+			t.Errorf("%s: expected IPs %v, got %v", tt.name, tt.ips, ips)
+		}
+		if m.Revision() != tt.revision {
+			t.Errorf("%s: expected revision %d, got %d", tt.name, tt.revision, m.Revision())
+		}
+	}
+
+	m := NewMembership()
+	m.Apply(&wg.HeartBeatResponse{Revision: 1, Full: true, Peers: []wg.MeshPeer{peer1, peer3}})
+	if subnets := m.Subnets("pubKey1"); !reflect.DeepEqual(subnets, []string{"192.168.50.0/24"}) {
+		t.Errorf("Expected the subnets behind other peers, got %v", subnets)
+	}
+	if subnets := m.Subnets("pubKey3"); len(subnets) != 0 {
+		t.Errorf("Expected a peer's own subnets to be left out, got %v", subnets)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+// How long a direct peer gets to complete a handshake before its traffic is
+// routed through the server again.
+const meshHandshakeGracePeriod = 15 * time.Second
+const meshPersistentKeepalive = "25"
+
+type directPeer struct {
+	wg.MeshPeer
+	addedAt   time.Time
+	confirmed bool
+}
+
+// MeshRouter keeps direct WireGuard peers in sync with the peers advertised
+// by the server in mesh mode. Peers that can't be reached directly keep being
+// routed through the server.
+type MeshRouter struct {
+	ifaceName string
+	ownPubKey string
+	direct    map[string]*directPeer
+	// Endpoints that failed to handshake, keyed by pubkey
+	failed map[string]string
+	// Open the preshared keys of direct peers, which the server seals
+	privKey      string
+	serverPubKey string
+}
+
+func NewMeshRouter(ifaceName, ownPubKey, privKey, serverPubKey string) *MeshRouter {
+	return &MeshRouter{
+		ifaceName:    ifaceName,
+		ownPubKey:    ownPubKey,
+		direct:       make(map[string]*directPeer),
+		failed:       make(map[string]string),
+		privKey:      privKey,
+		serverPubKey: serverPubKey,
+	}
+}
+
+// Sync reconciles the interface's direct peers with peers and returns the
+// set of VPN IPs and subnets that are currently reachable without the server.
+func (m *MeshRouter) Sync(peers []wg.MeshPeer) map[string]bool {
+	wanted := make(map[string]wg.MeshPeer, len(peers))
+	for _, p := range peers {
+		if p.PublicKey == m.ownPubKey || p.Endpoint == "" {
+			continue
+		}
+		wanted[p.PublicKey] = p
+	}
+
+	handshakes, err := latestHandshakes(m.ifaceName)
+	if err != nil {
+		log.Errorf("Unable to read WireGuard handshakes, keeping mesh peers as they are: %s", err)
+	}
+	for key, dp := range m.direct {
+		p, ok := wanted[key]
+		switch {
+		case !ok:
+			log.Infof("Mesh peer %s left, removing direct route", key)
+			m.removePeer(key)
+		case p.Endpoint != dp.Endpoint || p.VPNIP != dp.VPNIP || !reflect.DeepEqual(p.Subnets, dp.Subnets):
+			log.Infof("Mesh peer %s changed, reconfiguring", key)
+			m.removePeer(key)
+		case err == nil && handshakes[key] != 0:
+			dp.confirmed = true
+		case err == nil && !dp.confirmed && time.Since(dp.addedAt) > meshHandshakeGracePeriod:
+			log.Infof("No handshake with mesh peer %s at %s, routing through server instead", key, dp.Endpoint)
+			m.removePeer(key)
+			m.failed[key] = dp.Endpoint
+		}
+	}
+	for key, endpoint := range m.failed {
+		if p, ok := wanted[key]; !ok || p.Endpoint != endpoint {
+			delete(m.failed, key)
+		}
+	}
+
+	directIPs := make(map[string]bool, len(wanted))
+	for key, p := range wanted {
+		if _, ok := m.failed[key]; ok {
+			continue
+		}
+		if _, ok := m.direct[key]; !ok {
+			if err := m.addPeer(p); err != nil {
+				log.Errorf("Unable to add mesh peer %s: %s", key, err)
+				continue
+			}
+		}
+		directIPs[p.VPNIP] = true
+		for _, subnet := range p.Subnets {
+			directIPs[subnet] = true
+		}
+	}
+	return directIPs
+}
+
+// Unconfirmed reports whether any direct peer is still waiting for its first
+// handshake and so needs to be checked again.
+func (m *MeshRouter) Unconfirmed() bool {
+	for _, dp := range m.direct {
+		if !dp.confirmed {
+			return true
+		}
+	}
+	return false
+}
+
+// Close removes all direct peers from the interface.
+func (m *MeshRouter) Close() {
+	for key := range m.direct {
+		m.removePeer(key)
+	}
+}
+
+func (m *MeshRouter) addPeer(p wg.MeshPeer) error {
+	log.Infof("Adding direct mesh peer %s (%s) at %s", p.PublicKey, p.VPNIP, p.Endpoint)
+	allowedIPs := strings.Join(append([]string{fmt.Sprintf("%s/32", p.VPNIP)}, p.Subnets...), ",")
+	args := []string{"set", m.ifaceName, "peer", p.PublicKey, "endpoint", p.Endpoint, "persistent-keepalive", meshPersistentKeepalive, "allowed-ips", allowedIPs}
+	if p.PresharedKey != "" {
+		psk, err := wg.OpenPresharedKey(p.PresharedKey, m.privKey, m.serverPubKey)
+		if err != nil {
+			return err
+		}
+		pskPath, err := WriteRestrictedFile("PresharedKey", psk)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(filepath.Dir(pskPath))
+		args = append(args, "preshared-key", pskPath)
+	}
+	if out, err := exec.Command("wg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s\n%s", err, out)
+	}
+	m.direct[p.PublicKey] = &directPeer{MeshPeer: p, addedAt: time.Now()}
+	return nil
+}
+
+func (m *MeshRouter) removePeer(pubKey string) {
+	removePeer := exec.Command("wg", "set", m.ifaceName, "peer", pubKey, "remove")
+	if out, err := removePeer.CombinedOutput(); err != nil {
+		log.Errorf("Unable to remove mesh peer %s: %s\n%s", pubKey, err, out)
+	}
+	delete(m.direct, pubKey)
+}
+
+// latestHandshakes returns the unix timestamp of the last handshake with each
+// peer of ifaceName, 0 meaning there was none yet.
+func latestHandshakes(ifaceName string) (map[string]int64, error) {
+	out, err := exec.Command("wg", "show", ifaceName, "latest-handshakes").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s\n%s", err, out)
+	}
+	return wg.ParseLatestHandshakes(string(out))
+}
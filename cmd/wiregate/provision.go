@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+func (w *WireGateHTTPClient) provisionNode(provisionReq *wg.ProvisionRequest, apiEndpoint string) (*wg.ProvisionReply, error) {
+	var reqBuffer bytes.Buffer
+	json.NewEncoder(&reqBuffer).Encode(provisionReq)
+	url := fmt.Sprintf("https://%s/provision", apiEndpoint)
+	rsp, err := w.client.Post(url, "application/json", &reqBuffer)
+	if err != nil {
+		return nil, fmt.Errorf("Error while communicating with WireGate Control: %s", err)
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case 200:
+	case 403:
+		return nil, errBadPassword
+	case 503:
+		return nil, errIPPoolExhausted
+	default:
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return nil, fmt.Errorf("Server error (%d): %s", rsp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var provisionRsp wg.ProvisionReply
+	if err := json.NewDecoder(rsp.Body).Decode(&provisionRsp); err != nil {
+		return nil, fmt.Errorf("Error while decoding json response from WireGate Control: %s", err)
+	}
+	return &provisionRsp, nil
+}
+
+// printQRCode renders text as a QR code on the terminal using qrencode.
+func printQRCode(text string) error {
+	if _, err := exec.LookPath("qrencode"); err != nil {
+		return fmt.Errorf("Unable to call 'qrencode', is it installed?")
+	}
+	qrencode := exec.Command("qrencode", "-t", "ansiutf8")
+	qrencode.Stdin = strings.NewReader(text)
+	qrencode.Stdout = os.Stdout
+	qrencode.Stderr = os.Stderr
+	return qrencode.Run()
+}
+
+// provision_main registers a peer for a device that can't run the WireGate
+// client and shows its wg-quick config as a QR code for the WireGuard app.
+func provision_main(conf *ClientConfig, lease int, outPath string) {
+	chosenWGService := chooseService(conf)
+	vpnPassword, err := readPassword(conf)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	httpClient := get_http_client()
+	provisioned, err := httpClient.provisionNode(&wg.ProvisionRequest{User: conf.user, Password: vpnPassword, Lease: lease}, chosenWGService.HTTPEndpoint)
+	if err != nil {
+		log.Errorf("Unable to provision peer: %s", err)
+		os.Exit(exitCodeFor(err))
+	}
+	leaseDuration := time.Duration(provisioned.Lease) * time.Second
+	log.Infof("Provisioned peer %s with pubkey %s, it expires in %s", provisioned.NodeIp, provisioned.PublicKey, leaseDuration)
+
+	if outPath != "" {
+		if err := ioutil.WriteFile(outPath, []byte(provisioned.Config), 0600); err != nil {
+			log.Errorf("Error while writing wg-quick config to %s: %s", outPath, err)
+			os.Exit(1)
+		}
+		log.Infof("Wrote wg-quick config to %s", outPath)
+	}
+	if err := printQRCode(provisioned.Config); err != nil {
+		log.Errorf("Unable to show QR code, here's the config instead: %s", err)
+		fmt.Print(provisioned.Config)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+// rekeyNode asks the server at apiEndpoint to move the node to a new key.
+func (w *WireGateHTTPClient) rekeyNode(rekeyReq *wg.RekeyRequest, apiEndpoint string) error {
+	var reqBuffer bytes.Buffer
+	json.NewEncoder(&reqBuffer).Encode(rekeyReq)
+	url := fmt.Sprintf("https://%s/rekey", apiEndpoint)
+	rsp, err := w.client.Post(url, "application/json", &reqBuffer)
+	if err != nil {
+		return fmt.Errorf("Error while communicating with WireGate Control: %s", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	return fmt.Errorf("Server error (%d): %s", rsp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// rekey moves the session to a new keypair. The server adds the new key as a
+// peer next to the old one, then the interface switches to the new private
+// key and handshakes, which has the server hand the old peer's traffic over.
+func (s *Session) rekey() error {
+	// Failed rotations are retried after another interval
+	s.keyCreatedAt = time.Now()
+	privKey, pubKey, err := wg.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	proof, err := wg.SealRekeyProof(pubKey, s.privKey, s.node.ServerPubKey)
+	if err != nil {
+		return err
+	}
+	err = s.httpClient.rekeyNode(&wg.RekeyRequest{PublicKey: s.pubKey, NewPublicKey: pubKey, Proof: proof}, s.service.HTTPEndpoint)
+	if err != nil {
+		return err
+	}
+	if err := setPrivateKey(s.iface.Name, privKey); err != nil {
+		// The interface still has the old key, so the server has to as well
+		proof, sealErr := wg.SealRekeyProof(s.pubKey, privKey, s.node.ServerPubKey)
+		if sealErr == nil {
+			sealErr = s.httpClient.rekeyNode(&wg.RekeyRequest{PublicKey: pubKey, NewPublicKey: s.pubKey, Proof: proof}, s.service.HTTPEndpoint)
+		}
+		if sealErr != nil {
+			log.Errorf("Unable to switch the server back to the old key, registering again: %s", sealErr)
+		}
+		return err
+	}
+	pokeTunnel(s.node.ServerPeerIP)
+	s.mu.Lock()
+	s.privKey, s.pubKey = privKey, pubKey
+	s.mu.Unlock()
+	if s.mesh != nil {
+		// Direct peers' preshared keys are derived from both keys, so they
+		// are added again with the ones the next membership brings
+		s.mesh.Close()
+		s.mesh.ownPubKey, s.mesh.privKey = pubKey, privKey
+	}
+	s.saveState()
+	log.Infof("Rotated WireGuard key, public key is now %s", pubKey)
+	return nil
+}
+
+// pokeTunnel sends a datagram to the server's VPN IP, so WireGuard handshakes
+// with the server right away instead of when the next packet comes along.
+func pokeTunnel(serverPeerIP string) {
+	conn, err := net.Dial("udp", net.JoinHostPort(serverPeerIP, "9"))
+	if err != nil {
+		log.Debugf("Unable to send a packet through the tunnel: %s", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte{0})
+}
+
+// untilRekey returns a channel that's closed when the session is closed or
+// its key is due for rotation, and a func to call once it's not needed.
+func (s *Session) untilRekey() (<-chan struct{}, func()) {
+	if s.iface.RekeyInterval <= 0 {
+		return s.done, func() {}
+	}
+	due := s.keyCreatedAt.Add(time.Duration(s.iface.RekeyInterval) * time.Second)
+	timer := time.NewTimer(time.Until(due))
+	stop := make(chan struct{})
+	released := make(chan struct{})
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-s.done:
+		case <-timer.C:
+		case <-released:
+			return
+		}
+		close(stop)
+	}()
+	return stop, func() { close(released) }
+}
+
+// stopped tells why the heart beat was stopped.
+func (s *Session) stopped() error {
+	select {
+	case <-s.done:
+		return errSessionClosed
+	default:
+		return errRekeyDue
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -12,7 +13,11 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,17 +26,64 @@ import (
 )
 
 type ServerConfig struct {
-	iface           string
-	wgIface         string
-	wgPort          int
-	wgCIDR          string
-	mdnsServiceDesc string
-	httpPort        int
-	vpnPassword     string
-	purgeInterval   int
+	iface             string
+	wgIface           string
+	wgPort            int
+	wgCIDR            string
+	wgCIDRPool        string
+	mdnsServiceDesc   string
+	network           string
+	httpPort          int
+	vpnPassword       string
+	purgeInterval     int
+	purgeDeadline     int
+	heartBeatInterval int
+	handshakeLiveness bool
+	mesh              bool
+	maxLease          int
+	pskLifetime       int
+	firewall          string
+	gateway           string
+	dns               string
+	allowSubnets      string
+	postUp            string
+	postDown          string
+	staticPeers       []wg.StaticPeer
+	users             map[string]string
+	acl               *wg.ACLPolicy
+	export            string
+	debug             bool
+	// Where the config came from, to reload it on SIGHUP
+	configPath string
+	args       []string
 }
 
-func generateTLSCertKeyFiles(ifaceIP *net.IP) (string, string) {
+// serviceInfo returns what the server advertises over mDNS, with the free IPs
+// and auth mode as they are when it's called.
+func serviceInfo(conf *ServerConfig, registry *wg.Registry, httpAPI *wg.HttpApi, publicKey string, lanIPs []net.IP) func() *wg.ServiceInfo {
+	var ipv6 bool
+	for _, ip := range lanIPs {
+		if ip.To4() == nil {
+			ipv6 = true
+		}
+	}
+	description, network, fingerprint := conf.mdnsServiceDesc, conf.network, wg.KeyFingerprint(publicKey)
+	return func() *wg.ServiceInfo {
+		total, free, _ := registry.IPCounts()
+		return &wg.ServiceInfo{
+			Version:     wg.MDNSProtocolVersion,
+			Description: description,
+			Network:     network,
+			Fingerprint: fingerprint,
+			AuthMode:    httpAPI.AuthMode(),
+			Capacity:    total,
+			FreeIPs:     free,
+			IPv6:        ipv6,
+		}
+	}
+}
+
+func generateTLSCertKeyFiles(ifaceIPs []net.IP) (string, string) {
 	// Based on https://golang.org/src/crypto/tls/generate_cert.go
 	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -57,7 +109,7 @@ func generateTLSCertKeyFiles(ifaceIP *net.IP) (string, string) {
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
-	certTemplate.IPAddresses = append(certTemplate.IPAddresses, *ifaceIP)
+	certTemplate.IPAddresses = append(certTemplate.IPAddresses, ifaceIPs...)
 	certBytes, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &privKey.PublicKey, privKey)
 	if err != nil {
 		log.Errorf("Error while generating x509 certificate: %s", err)
@@ -96,8 +148,162 @@ func generateTLSCertKeyFiles(ifaceIP *net.IP) (string, string) {
 	return certOut.Name(), keyOut.Name()
 }
 
+// exportServerConfig writes a wg-quick config for the interface the server
+// would create.
+func exportServerConfig(path string, wgctrl *wg.ShellWireguardControl, ipgen *wg.SimpleIPGen, wgPrivateKey string) {
+	conf := &wg.WgQuickConfig{
+		Interface: wg.WgQuickInterface{
+			Address:    fmt.Sprintf("%s/%s", ipgen.BaseIP, ipgen.CIDR),
+			PrivateKey: wgPrivateKey,
+		},
+	}
+	if wgctrl.Firewall != nil {
+		conf.Interface.PostUp, conf.Interface.PostDown = wgctrl.Firewall.ShellCommands()
+	}
+	if wgctrl.PostUp != "" {
+		conf.Interface.PostUp = joinShellCommands(conf.Interface.PostUp, wgctrl.PostUp)
+	}
+	if wgctrl.PostDown != "" {
+		conf.Interface.PostDown = joinShellCommands(wgctrl.PostDown, conf.Interface.PostDown)
+	}
+	conf.Interface.ListenPort, _ = strconv.Atoi(wgctrl.ListenPort)
+	if err := ioutil.WriteFile(path, []byte(conf.String()), 0600); err != nil {
+		log.Errorf("Error while writing wg-quick config to %s: %s", path, err)
+		os.Exit(1)
+	}
+	log.Infof("Wrote wg-quick config for %s to %s", wgctrl.InterfaceName, path)
+}
+
+// checkIPForwarding warns if the kernel won't forward traffic, in which case
+// consequence happens.
+func checkIPForwarding(consequence string) {
+	forwarding, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		log.Warnf("Unable to check whether IP forwarding is enabled: %s", err)
+	} else if strings.TrimSpace(string(forwarding)) != "1" {
+		log.Warnf("IP forwarding is disabled, %s. Enable it with 'sysctl -w net.ipv4.ip_forward=1'", consequence)
+	}
+}
+
+func joinShellCommands(first, second string) string {
+	if first == "" {
+		return second
+	}
+	if second == "" {
+		return first
+	}
+	return first + "; " + second
+}
+
+// reloadServerConfig re-reads the config file and flags and applies the
+// settings that can change without recreating the WireGuard interface. It
+// returns the config now in effect.
+func reloadServerConfig(conf *ServerConfig, registry *wg.Registry, httpAPI *wg.HttpApi) *ServerConfig {
+	if conf.configPath == "" {
+		log.Info("Received SIGHUP, but there's no '-config' file to reload")
+		return conf
+	}
+	log.Infof("Reloading config from %s", conf.configPath)
+	newConf, err := loadServerConfig(conf.args)
+	if err != nil {
+		log.Errorf("Not reloading invalid config: %s", err)
+		return conf
+	}
+	for _, name := range conf.restartRequiredChanges(newConf) {
+		log.Warnf("Changing '%s' requires a restart, keeping the current value", name)
+	}
+	setupLogging(newConf.debug)
+	httpAPI.UpdateSettings(newConf.vpnPassword, time.Duration(newConf.heartBeatInterval)*time.Second, time.Duration(newConf.purgeDeadline)*time.Second)
+	if newConf.purgeDeadline != conf.purgeDeadline || newConf.purgeInterval != conf.purgeInterval || newConf.handshakeLiveness != conf.handshakeLiveness {
+		log.Infof("Restarting registry purger with a deadline of %ds every %ds", newConf.purgeDeadline, newConf.purgeInterval)
+		registry.StopPurging()
+		registry.HandshakeLiveness = newConf.handshakeLiveness
+		registry.StartPurging(newConf.purgeDeadline, newConf.purgeInterval)
+	}
+	if err := registry.SetStaticPeers(newConf.staticPeers); err != nil {
+		log.Errorf("Error while updating static peers: %s", err)
+	}
+	httpAPI.UpdateUsers(newConf.users)
+	if !reflect.DeepEqual(newConf.acl, conf.acl) {
+		log.Info("Applying new ACL policy")
+		registry.SetACL(newConf.acl)
+	}
+	// Settings that need a restart stay as they are until then
+	kept := *conf
+	kept.vpnPassword = newConf.vpnPassword
+	kept.heartBeatInterval = newConf.heartBeatInterval
+	kept.purgeDeadline = newConf.purgeDeadline
+	kept.purgeInterval = newConf.purgeInterval
+	kept.handshakeLiveness = newConf.handshakeLiveness
+	kept.staticPeers = newConf.staticPeers
+	kept.users = newConf.users
+	kept.acl = newConf.acl
+	kept.debug = newConf.debug
+	log.Info("Reloaded config")
+	return &kept
+}
+
+// enforceACL keeps the firewall's rules between peers in line with the
+// registry's ACL policy as nodes come and go. The returned func stops it.
+func enforceACL(registry *wg.Registry, firewall wg.Firewall) func() {
+	changes, unsubscribe := registry.Subscribe()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var applied []wg.PeerRule
+		for {
+			if rules := registry.PeerRules(); applied == nil || !reflect.DeepEqual(rules, applied) {
+				if err := firewall.SetPeerRules(rules); err != nil {
+					log.Errorf("Error while applying ACL: %s", err)
+				} else {
+					log.Debugf("Applied %d firewall rules between peers", len(rules))
+					applied = rules
+				}
+			}
+			select {
+			case <-changes:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		unsubscribe()
+		close(done)
+		<-stopped
+	}
+}
+
+// How long releasing the server's resources may take before it gives up and
+// exits, and how much of that nodes get to hear about the shutdown.
+const shutdownTimeout = 15 * time.Second
+const httpStopTimeout = 10 * time.Second
+
 func server_main(conf *ServerConfig) {
-	ipgen, err := wg.NewSimpleIPGen(conf.wgCIDR)
+	// Releases what the server set up so far, newest first
+	var cleanups []func()
+	shutdown := func(exitCode int) {
+		watchdog := time.AfterFunc(shutdownTimeout, func() {
+			log.Errorf("Shutdown took longer than %s, exiting anyway", shutdownTimeout)
+			os.Exit(1)
+		})
+		defer watchdog.Stop()
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+		os.Exit(exitCode)
+	}
+
+	wgCIDR, err := conf.vpnCIDR()
+	if err != nil {
+		log.Errorf("Error while choosing the VPN subnet: %s", err)
+		os.Exit(1)
+	}
+	if conf.wgCIDR == "" {
+		log.Infof("Picked %s as the VPN subnet, no route on this computer overlaps it", wgCIDR)
+	}
+	ipgen, err := wg.NewSimpleIPGen(wgCIDR)
 	if err != nil {
 		log.Errorf("Error generating WireGuard subnet: %s", err)
 		os.Exit(1)
@@ -113,76 +319,169 @@ func server_main(conf *ServerConfig) {
 		os.Exit(1)
 	}
 	log.Infof("Generated private WireGuard key and saved to %s", wgPrivateKeyPath)
-	wgctrl, err := wg.NewShellWireguardControl(ipgen.BaseIP, ipgen.SubnetIP, ipgen.CIDR, strconv.Itoa(conf.wgPort), conf.wgIface, conf.iface, wgPrivateKeyPath)
+	cleanups = append(cleanups, func() {
+		log.Info("Removing private WireGuard key")
+		os.RemoveAll(filepath.Dir(wgPrivateKeyPath))
+	})
+	lanIfaces, err := conf.lanInterfaces()
+	if err != nil {
+		log.Errorf("Error while looking for the LAN interface: %s", err)
+		shutdown(1)
+	}
+	if conf.iface == "" {
+		log.Infof("Using %s, which the default route goes out of, as the LAN interface", lanIfaces[0])
+	}
+	// Clients not told otherwise use the first interface's first address
+	wgctrl, err := wg.NewShellWireguardControl(ipgen.BaseIP, ipgen.SubnetIP, ipgen.CIDR, strconv.Itoa(conf.wgPort), conf.wgIface, lanIfaces[0], wgPrivateKeyPath)
 	if err != nil {
 		log.Errorf("Error while creating WireGate controller : %s", err)
-		os.Exit(1)
+		shutdown(1)
+	}
+	var lanSubnets, endpoints []string
+	var lanIPs []net.IP
+	for _, iface := range lanIfaces {
+		subnets, err := wg.InterfaceSubnets(iface)
+		if err != nil {
+			log.Errorf("Error while looking up the LAN's subnets: %s", err)
+			shutdown(1)
+		}
+		lanSubnets = append(lanSubnets, subnets...)
+		ips, err := wg.InterfaceAddresses(iface)
+		if err != nil {
+			log.Errorf("Error while looking up the LAN's addresses: %s", err)
+			shutdown(1)
+		}
+		for _, ip := range ips {
+			lanIPs = append(lanIPs, ip)
+			endpoints = append(endpoints, net.JoinHostPort(ip.String(), strconv.Itoa(conf.wgPort)))
+		}
+	}
+	wgctrl.Firewall, err = wg.NewFirewall(conf.firewall, &wg.FirewallConfig{
+		WGInterface:   conf.wgIface,
+		LANInterfaces: lanIfaces,
+		Subnet:        fmt.Sprintf("%s/%s", ipgen.SubnetIP, ipgen.CIDR),
+		Gateway:       conf.gateway,
+		LANSubnets:    lanSubnets,
+	})
+	if err != nil {
+		log.Errorf("Error while setting up firewall: %s", err)
+		shutdown(1)
+	}
+	log.Debugf("Using %s firewall backend", wgctrl.Firewall.Name())
+	wgctrl.PostUp = conf.postUp
+	wgctrl.PostDown = conf.postDown
+	if conf.export != "" {
+		exportServerConfig(conf.export, wgctrl, ipgen, wgPrivateKey)
+		shutdown(0)
 	}
 	err = wgctrl.CreateInterface()
 	if err != nil {
 		log.Errorf("Error while creating WireGuard interface: %s", err)
-		os.Exit(1)
+		shutdown(1)
 	}
+	cleanups = append(cleanups, func() {
+		log.Info("Destroying interface")
+		if err := wgctrl.DestroyInterface(); err != nil {
+			log.Errorf("Error while destroying WireGuard interface: %s", err)
+		}
+	})
 	err = wgctrl.AddInterfaceRoute()
 	if err != nil {
 		log.Errorf("Error while adding WireGuard interface route: %s", err)
-		os.Exit(1)
+		shutdown(1)
 	}
-	log.Infof("Created WireGuard interface %s, bridged to %s, and started WireGuard server on %s", conf.wgIface, conf.iface, wgctrl.EndpointIPPortPair)
+	log.Infof("Created WireGuard interface %s, bridged to %s, and started WireGuard server on %s", conf.wgIface, strings.Join(lanIfaces, ", "), strings.Join(endpoints, ", "))
+	log.Infof("Running in %s gateway mode", conf.gateway)
+	checkIPForwarding("clients won't reach each other or the LAN through this server")
 	registry := wg.NewRegistry(ipgen, wgctrl)
-	ifaceIP := net.ParseIP(wgctrl.EndpointIP)
-	mdnsServer := wg.NewMDNSServer(conf.mdnsServiceDesc, &ifaceIP, conf.httpPort)
+	wgctrl.ReplaceAbandoned = registry.AbandonRekey
+	registry.HandshakeLiveness = conf.handshakeLiveness
+	registry.PresharedKeyLifetime = time.Duration(conf.pskLifetime) * time.Second
+	if err := registry.SetStaticPeers(conf.staticPeers); err != nil {
+		log.Errorf("Error while adding static peers: %s", err)
+		shutdown(1)
+	}
+	if conf.acl != nil && conf.mesh {
+		log.Warn("In mesh mode clients talk to each other directly, so the ACL only hides peers from each other, the server's firewall doesn't filter their traffic")
+	}
+	registry.SetACL(conf.acl)
+	stopEnforcing := enforceACL(registry, wgctrl.Firewall)
+	cleanups = append(cleanups, stopEnforcing)
 	httpAPI := &wg.HttpApi{
 		Registry:           registry,
 		EndpointIPPortPair: wgctrl.EndpointIPPortPair,
 		VPNPassword:        conf.vpnPassword,
 		WGServerPublicKey:  wgPublicKey,
+		WGServerPrivateKey: wgPrivateKey,
 		WGServerPeerIP:     ipgen.BaseIP,
+		Mesh:               conf.mesh,
+		HeartBeatInterval:  time.Duration(conf.heartBeatInterval) * time.Second,
+		PurgeDeadline:      time.Duration(conf.purgeDeadline) * time.Second,
+		MaxLease:           time.Duration(conf.maxLease) * time.Second,
+		Gateway:            conf.gateway,
+		LANSubnets:         lanSubnets,
+		DNS:                conf.dnsServers(),
+		Users:              conf.users,
+
+		AdvertisableSubnets: conf.advertisableSubnets(),
+		Endpoints:           endpoints,
 	}
 
-	httpCertPath, httpKeyPath := generateTLSCertKeyFiles(&ifaceIP)
-	log.Infof("Generated TLS cert at %s and key at %s", httpCertPath, httpKeyPath)
+	mdnsServer := wg.NewMDNSServer(serviceInfo(conf, registry, httpAPI, wgPublicKey, lanIPs), lanIPs, conf.httpPort)
 
-	// define cleanup function to use from now on.
-	cleanup := func() {
-		log.Info("Stopping http api")
-		err := httpAPI.Stop()
-		if err != nil {
-			log.Errorf("Error while stopping WireGate HTTP Control: %s", err)
-		}
-		log.Info("Stopping mdns server")
-		mdnsServer.Stop()
-		log.Info("Destroying interface")
-		err = wgctrl.DestroyInterface()
-		if err != nil {
-			log.Errorf("Error while destroying WireGuard interface: %s", err)
-		}
-		os.Exit(0)
-	}
+	httpCertPath, httpKeyPath := generateTLSCertKeyFiles(lanIPs)
+	log.Infof("Generated TLS cert at %s and key at %s", httpCertPath, httpKeyPath)
+	cleanups = append(cleanups, func() {
+		log.Info("Removing TLS cert and key")
+		os.Remove(httpCertPath)
+		os.RemoveAll(filepath.Dir(httpKeyPath))
+	})
 
 	httpRunning := make(chan struct{})
 	log.Info("Starting TLS HTTP Server...")
 	// TODO: check if HTTP server came up alright
 	httpAPI.Start(conf.httpPort, httpCertPath, httpKeyPath, httpRunning)
+	cleanups = append(cleanups, func() {
+		log.Info("Stopping http api")
+		ctx, cancel := context.WithTimeout(context.Background(), httpStopTimeout)
+		defer cancel()
+		if err := httpAPI.Stop(ctx); err != nil {
+			log.Errorf("Error while stopping WireGate HTTP Control: %s", err)
+		}
+	})
 	log.Infof("Starting MDNS server...")
 	err = mdnsServer.Start()
 	if err != nil {
-		cleanup()
 		log.Errorf("Failed to start mdns server: %s", err)
-		os.Exit(1)
+		shutdown(1)
 	}
-
-	termination := make(chan os.Signal, 1)
-	signal.Notify(termination, os.Interrupt)
-	go func() {
-		s := <-termination
-		log.Infof("\nReceived signal %s, terminating...\n", s)
-		cleanup()
-	}()
+	cleanups = append(cleanups, func() {
+		log.Info("Stopping mdns server")
+		mdnsServer.Stop()
+	})
 
 	log.Info("Starting registry purger")
-	registry.StartPurging(conf.purgeInterval, conf.purgeInterval)
+	registry.StartPurging(conf.purgeDeadline, conf.purgeInterval)
+	cleanups = append(cleanups, func() {
+		log.Info("Stopping registry purger")
+		registry.StopPurging()
+	})
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	log.Info("Server ready")
-	<-httpRunning
+	for {
+		select {
+		case s := <-signals:
+			if s == syscall.SIGHUP {
+				conf = reloadServerConfig(conf, registry, httpAPI)
+				continue
+			}
+			log.Infof("Received signal %s, shutting down", s)
+			shutdown(0)
+		case <-httpRunning:
+			log.Error("WireGate HTTP Control stopped, shutting down")
+			shutdown(1)
+		}
+	}
 }
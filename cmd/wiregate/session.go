@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	wg "github.com/sirmackk/wiregate"
+)
+
+const minReconnectBackoff = time.Second
+const maxReconnectBackoff = time.Minute
+
+// Session holds what a client needs to stay connected to a WireGate server:
+// the service it found, its credentials and its current registration.
+type Session struct {
+	httpClient *WireGateHTTPClient
+	// Guards service, node and the connection state, which Status and Leave
+	// read while Run may be changing them
+	mu        sync.Mutex
+	service   *WireGateService
+	user      string
+	password  string
+	privKey   string
+	pubKey    string
+	iface     *WGInterfaceConfig
+	node      *RegisteredNode
+	mesh      *MeshRouter
+	connected bool
+	lastError string
+	since     time.Time
+	// Closed by Close to stop Run
+	done      chan struct{}
+	closeOnce sync.Once
+	// When the current keypair was created, to rotate it every
+	// iface.RekeyInterval seconds
+	keyCreatedAt time.Time
+}
+
+func NewSession(httpClient *WireGateHTTPClient, service *WireGateService, user, password, privKey, pubKey string, iface *WGInterfaceConfig, node *RegisteredNode) *Session {
+	s := &Session{
+		httpClient: httpClient,
+		service:    service,
+		user:       user,
+		password:   password,
+		privKey:    privKey,
+		pubKey:     pubKey,
+		iface:      iface,
+		node:       node,
+		connected:  true,
+		since:      time.Now(),
+		done:       make(chan struct{}),
+
+		keyCreatedAt: time.Now(),
+	}
+	if node.Mesh {
+		log.Info("Server runs in mesh mode, connecting to other peers directly")
+		s.mesh = NewMeshRouter(iface.Name, pubKey, privKey, node.ServerPubKey)
+	}
+	return s
+}
+
+// connect registers a new keypair with service, as user if set, and sets up
+// iface for it, returning a session ready to Run.
+func connect(httpClient *WireGateHTTPClient, iface *WGInterfaceConfig, service *WireGateService, user, password string) (*Session, error) {
+	if _, err := net.InterfaceByName(iface.Name); err == nil {
+		return nil, fmt.Errorf("%w: %s, refusing to touch it", errInterfaceExists, iface.Name)
+	}
+	privKey, pubKey, err := wg.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	registeredNode, err := httpClient.registerNode(&wg.RegistrationRequest{PublicKey: pubKey, User: user, Password: password, Gateway: iface.Gateway, Subnets: iface.Subnets}, service.HTTPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	// Checking for overlaps and recording the new subnet must not interleave
+	// with another session doing the same
+	interfaceSetupMu.Lock()
+	defer interfaceSetupMu.Unlock()
+	subnet, err := registeredNode.Subnet()
+	if err == nil {
+		err = checkSubnetOverlap(iface.Name, subnet)
+	}
+	if err == nil {
+		err = checkRouteOverlap(iface.Name, subnet)
+	}
+	if err == nil {
+		if err = createWGInterface(iface, privKey, registeredNode); err != nil {
+			err = fmt.Errorf("Unable to set up WireGuard interface: %s", err)
+		}
+	}
+	if err != nil {
+		httpClient.unregisterNode(pubKey, service.HTTPEndpoint)
+		return nil, err
+	}
+	log.Infof("Connected %s to WireGate server %s as %s/%s", iface.Name, service.Host, registeredNode.IP, registeredNode.CIDR)
+	if len(iface.Subnets) > 0 {
+		log.Infof("Routing %s for the other clients", strings.Join(iface.Subnets, ", "))
+		checkIPForwarding("other clients won't reach the subnets behind this one")
+	}
+	s := NewSession(httpClient, service, user, password, privKey, pubKey, iface, registeredNode)
+	s.saveState()
+	return s, nil
+}
+
+// Serializes connect's interface setup across sessions.
+var interfaceSetupMu sync.Mutex
+
+// Run keeps the session alive, retrying with exponential backoff when the
+// server can't be reached, registering again with the same key if the server
+// forgot about this node, following the server if its address changes and
+// rotating the node's key every iface.RekeyInterval seconds.
+// It only returns if the session can't be recovered or was closed.
+func (s *Session) Run() error {
+	backoff := minReconnectBackoff
+	failures := 0
+	for {
+		started := time.Now()
+		err := s.StartHeartBeat()
+		if err == errSessionClosed {
+			return err
+		}
+		if err == errRekeyDue {
+			if err := s.rekey(); err != nil {
+				log.Errorf("Unable to rotate WireGuard key, keeping the current one for another %ds: %s", s.iface.RekeyInterval, err)
+			}
+			backoff = minReconnectBackoff
+			failures = 0
+			continue
+		}
+		s.setConnected(false, err)
+		if time.Since(started) > maxReconnectBackoff || err == errServerShuttingDown {
+			backoff = minReconnectBackoff
+			failures = 0
+		}
+		if err == errServerShuttingDown {
+			// The server forgets all nodes, so the next heart beat after it's
+			// back gets errNodeNotFound and registers again.
+			log.Info("WireGate server is shutting down, waiting for it to come back")
+			if _, open := s.waitForServer(backoff); !open {
+				return errSessionClosed
+			}
+			continue
+		}
+		if err == errNodeNotFound {
+			log.Info("WireGate server no longer knows this node, registering again")
+			err = s.reregister()
+			if err == nil {
+				backoff = minReconnectBackoff
+				failures = 0
+				continue
+			}
+			if err == errBadPassword || errors.Is(err, errSubnetOverlap) {
+				return err
+			}
+		}
+		failures++
+		log.Errorf("Lost WireGate server (attempt %d), retrying in %s: %s", failures, backoff, err)
+		moved, open := s.waitForServer(backoff)
+		if !open {
+			return errSessionClosed
+		}
+		if moved {
+			backoff = minReconnectBackoff
+			continue
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// Close stops Run and the heart beat. It doesn't unregister the node or
+// touch the interface.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *Session) setConnected(connected bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if connected != s.connected {
+		s.since = time.Now()
+	}
+	s.connected = connected
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
+	}
+}
+
+// SessionStatus describes a session for 'wiregate status'.
+type SessionStatus struct {
+	Interface string
+	Server    string
+	Endpoint  string
+	Address   string
+	Connected bool
+	Since     time.Time
+	LastError string `json:",omitempty"`
+}
+
+func (s *Session) Status() *SessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &SessionStatus{
+		Interface: s.iface.Name,
+		Server:    s.service.Host,
+		Endpoint:  s.service.HTTPEndpoint,
+		Address:   fmt.Sprintf("%s/%s", s.node.IP, s.node.CIDR),
+		Connected: s.connected,
+		Since:     s.since,
+		LastError: s.lastError,
+	}
+}
+
+func (s *Session) reregister() error {
+	registerReq := &wg.RegistrationRequest{
+		PublicKey:   s.pubKey,
+		User:        s.user,
+		Password:    s.password,
+		PreferredIP: s.node.IP,
+		Gateway:     s.iface.Gateway,
+		Subnets:     s.iface.Subnets,
+	}
+	node, err := s.httpClient.registerNode(registerReq, s.service.HTTPEndpoint)
+	if err != nil {
+		return err
+	}
+	// A server that restarted may have picked another VPN subnet
+	subnet, err := node.Subnet()
+	if err != nil {
+		return err
+	}
+	if oldSubnet, _ := s.node.Subnet(); oldSubnet == nil || oldSubnet.String() != subnet.String() {
+		if err := checkRouteOverlap(s.iface.Name, subnet); err != nil {
+			s.httpClient.unregisterNode(s.pubKey, s.service.HTTPEndpoint)
+			return err
+		}
+	}
+	if err := reconfigureWGInterface(s.iface, s.node, node); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.node = node
+	s.mu.Unlock()
+	log.Infof("Registered again as %s/%s", node.IP, node.CIDR)
+	return nil
+}
+
+// waitForServer waits for d while following the server over mDNS, returning
+// early if it shows up at a new address. It reports whether the server moved
+// and whether the session is still open.
+func (s *Session) waitForServer(d time.Duration) (moved, open bool) {
+	browser := browseServices("")
+	defer browser.Stop()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.done:
+			return false, false
+		case <-timer.C:
+			return false, true
+		case <-browser.Updates():
+			if s.follow(browser.Services()) {
+				return true, true
+			}
+		}
+	}
+}
+
+// follow switches to the server's new address if it's among services at one.
+func (s *Session) follow(services []*WireGateService) bool {
+	s.mu.Lock()
+	current := s.service
+	s.mu.Unlock()
+	for _, svc := range services {
+		if !sameService(svc, current) || svc.HTTPEndpoint == current.HTTPEndpoint {
+			continue
+		}
+		log.Infof("WireGate server %s moved from %s to %s", svc.Host, current.HTTPEndpoint, svc.HTTPEndpoint)
+		// The node is replaced rather than changed, since the heart beat may
+		// still be reading the old one
+		s.mu.Lock()
+		s.service = svc
+		node := *s.node
+		_, port, err := net.SplitHostPort(node.EndpointIPPortPair)
+		if err == nil {
+			node.EndpointIPPortPair = net.JoinHostPort(svc.Addr, port)
+			s.node = &node
+		}
+		s.mu.Unlock()
+		s.saveState()
+		if err == nil {
+			setEndpoint := exec.Command("wg", "set", s.iface.Name, "peer", node.ServerPubKey, "endpoint", node.EndpointIPPortPair)
+			if out, err := setEndpoint.CombinedOutput(); err != nil {
+				log.Errorf("Unable to point WireGuard at %s: %s\n%s", node.EndpointIPPortPair, err, out)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// saveState records the session so 'wiregate client -leave' can clean up
+// after it if the client doesn't exit cleanly.
+func (s *Session) saveState() {
+	s.mu.Lock()
+	state := &sessionState{Interface: s.iface.Name, PublicKey: s.pubKey, Server: s.service.Host, HTTPEndpoint: s.service.HTTPEndpoint}
+	if subnet, err := s.node.Subnet(); err == nil {
+		state.Subnet = subnet.String()
+	}
+	s.mu.Unlock()
+	if err := writeSessionState(state); err != nil {
+		log.Errorf("Unable to save session, 'wiregate client -leave' won't be able to unregister it: %s", err)
+	}
+}
+
+// Leave unregisters the node from the server it's currently using and
+// forgets the session.
+func (s *Session) Leave() {
+	s.mu.Lock()
+	endpoint := s.service.HTTPEndpoint
+	s.mu.Unlock()
+	leave(s.httpClient, s.pubKey, endpoint)
+	removeSessionState(s.iface.Name)
+}
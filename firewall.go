@@ -0,0 +1,341 @@
+package wiregate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Firewall backends the server can set its forwarding and NAT rules up with.
+const (
+	FirewallAuto     = "auto"
+	FirewallNftables = "nftables"
+	FirewallIptables = "iptables"
+	FirewallNone     = "none"
+)
+
+// Firewall installs the rules that let VPN traffic through the server, as far
+// as its gateway mode allows, and masquerade it out of the LAN interface.
+// Anything else coming from the VPN isn't forwarded. Rules live in a table or
+// chains of their own, named after the WireGuard interface, so setting up
+// removes any left behind by a server that crashed.
+type Firewall interface {
+	Name() string
+	Setup() error
+	Teardown() error
+	// SetPeerRules replaces the rules for traffic between peers, which
+	// allow everything until it's called.
+	SetPeerRules(rules []PeerRule) error
+	// ShellCommands returns shell commands equivalent to Setup and Teardown,
+	// eg. for wg-quick's PostUp and PostDown.
+	ShellCommands() (up, down string)
+}
+
+// FirewallConfig describes the traffic a Firewall lets through.
+type FirewallConfig struct {
+	WGInterface string
+	// Where traffic to the LAN or the internet leaves the server
+	LANInterfaces []string
+	// The VPN subnet in CIDR notation
+	Subnet string
+	// One of the Gateway* modes, an empty one isolates clients
+	Gateway string
+	// Subnets of the LAN clients may reach in GatewayLAN mode
+	LANSubnets []string
+}
+
+// NewFirewall returns the firewall backend named by backend, or for
+// FirewallAuto nftables if 'nft' is installed and iptables otherwise.
+func NewFirewall(backend string, conf *FirewallConfig) (Firewall, error) {
+	if backend == FirewallAuto {
+		if _, err := lookPath("nft"); err == nil {
+			backend = FirewallNftables
+		} else if _, err := lookPath("iptables"); err == nil {
+			backend = FirewallIptables
+		} else {
+			return nil, fmt.Errorf("Neither 'nft' nor 'iptables' found, install one or set up the firewall yourself")
+		}
+	}
+	switch backend {
+	case FirewallNftables:
+		return newNftablesFirewall(conf), nil
+	case FirewallIptables:
+		return newIptablesFirewall(conf), nil
+	case FirewallNone:
+		return &commandFirewall{name: FirewallNone}, nil
+	}
+	return nil, fmt.Errorf("Unknown firewall backend %q", backend)
+}
+
+// commandFirewall sets up and tears down rules by running commands.
+type commandFirewall struct {
+	name string
+	// Removes leftovers from a previous run, failures are ignored since
+	// there usually aren't any
+	cleanup  [][]string
+	setup    [][]string
+	teardown [][]string
+	// Returns the commands replacing the rules between peers
+	peerRules func(rules []PeerRule) [][]string
+	// Returns a command and the script for it to read from stdin that run
+	// cmds in a single transaction
+	atomically func(cmds [][]string) (cmd []string, script string)
+}
+
+func (f *commandFirewall) Name() string {
+	return f.name
+}
+
+func (f *commandFirewall) Setup() error {
+	for _, args := range f.cleanup {
+		execCommand(args[0], args[1:]...).CombinedOutput()
+	}
+	for _, args := range f.setup {
+		if out, err := execCommand(args[0], args[1:]...).CombinedOutput(); err != nil {
+			for _, args := range f.cleanup {
+				execCommand(args[0], args[1:]...).CombinedOutput()
+			}
+			return fmt.Errorf("Setting up %s firewall rules failed when calling '%s': %s\n%s", f.name, strings.Join(args, " "), err, out)
+		}
+	}
+	return nil
+}
+
+// Teardown runs every teardown command even if some fail, so one rule that's
+// already gone doesn't leave the others behind, and returns all failures.
+func (f *commandFirewall) Teardown() error {
+	var failures []string
+	for _, args := range f.teardown {
+		if out, err := execCommand(args[0], args[1:]...).CombinedOutput(); err != nil {
+			failures = append(failures, fmt.Sprintf("calling '%s': %s\n%s", strings.Join(args, " "), err, out))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Removing %s firewall rules failed when %s", f.name, strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// SetPeerRules replaces the rules between peers in a single transaction, so
+// peers never see a half updated policy.
+func (f *commandFirewall) SetPeerRules(rules []PeerRule) error {
+	if f.peerRules == nil {
+		return nil
+	}
+	cmd, script := f.atomically(f.peerRules(rules))
+	if out, err := execCommandWithInput(script, cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Updating %s firewall rules between peers failed when calling '%s': %s\n%s", f.name, strings.Join(cmd, " "), err, out)
+	}
+	return nil
+}
+
+func (f *commandFirewall) ShellCommands() (string, string) {
+	return shellCommands(f.setup), shellCommands(f.teardown)
+}
+
+func shellCommands(cmds [][]string) string {
+	lines := make([]string, len(cmds))
+	for i, args := range cmds {
+		quoted := make([]string, len(args))
+		for j, arg := range args {
+			quoted[j] = shellQuote(arg)
+		}
+		lines[i] = strings.Join(quoted, " ")
+	}
+	return strings.Join(lines, "; ")
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./:,=+-]+$`)
+
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+var nftUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// nftablesTable names the table holding the rules for wgIface.
+func nftablesTable(wgIface string) string {
+	return "wiregate_" + nftUnsafe.ReplaceAllString(wgIface, "_")
+}
+
+func newNftablesFirewall(conf *FirewallConfig) *commandFirewall {
+	table := "ip " + nftablesTable(conf.WGInterface)
+	nft := func(cmd string, args ...interface{}) []string {
+		return []string{"nft", fmt.Sprintf(cmd, args...)}
+	}
+	setup := [][]string{
+		nft("add table %s", table),
+		nft("add chain %s forward { type filter hook forward priority 0; policy accept; }", table),
+		nft("add chain %s postrouting { type nat hook postrouting priority 100; }", table),
+		nft("add chain %s peers", table),
+		// Peers can't spoof their source, WireGuard drops packets from IPs
+		// other than the sender's allowed-ips, which include its subnets
+		nft(`add rule %s forward iifname "%s" oifname "%s" jump peers`, table, conf.WGInterface, conf.WGInterface),
+		nft(`add rule %s forward iifname "%s" oifname "%s" drop`, table, conf.WGInterface, conf.WGInterface),
+	}
+	for _, lanIface := range conf.LANInterfaces {
+		switch conf.Gateway {
+		case GatewayLAN:
+			for _, lan := range conf.LANSubnets {
+				setup = append(setup,
+					nft(`add rule %s forward iifname "%s" oifname "%s" ip saddr %s ip daddr %s accept`, table, conf.WGInterface, lanIface, conf.Subnet, lan),
+					nft(`add rule %s postrouting oifname "%s" ip saddr %s ip daddr %s masquerade`, table, lanIface, conf.Subnet, lan))
+			}
+		case GatewayExit:
+			setup = append(setup,
+				nft(`add rule %s forward iifname "%s" oifname "%s" ip saddr %s accept`, table, conf.WGInterface, lanIface, conf.Subnet),
+				nft(`add rule %s postrouting oifname "%s" ip saddr %s masquerade`, table, lanIface, conf.Subnet))
+		}
+	}
+	setup = append(setup,
+		nft(`add rule %s forward oifname "%s" ip daddr %s accept`, table, conf.WGInterface, conf.Subnet),
+		nft(`add rule %s forward iifname "%s" drop`, table, conf.WGInterface))
+	peerRules := func(rules []PeerRule) [][]string {
+		cmds := [][]string{
+			nft("flush chain %s peers", table),
+			nft("add rule %s peers ct state established,related accept", table),
+		}
+		for _, rule := range rules {
+			match := ""
+			if rule.SourceIP != "" {
+				match += " ip saddr " + rule.SourceIP
+			}
+			if rule.DestIP != "" {
+				match += " ip daddr " + rule.DestIP
+			}
+			if len(rule.Ports) == 0 {
+				cmds = append(cmds, nft("add rule %s peers%s accept", table, match))
+			}
+			for _, port := range rule.Ports {
+				proto := port.Proto
+				if proto == "" {
+					proto = "{ tcp, udp }"
+				}
+				cmds = append(cmds, nft("add rule %s peers%s meta l4proto %s th dport %d-%d accept", table, match, proto, port.First, port.Last))
+			}
+		}
+		return cmds
+	}
+	return &commandFirewall{
+		name:       FirewallNftables,
+		cleanup:    [][]string{nft("delete table %s", table)},
+		setup:      append(setup, peerRules(allowAllPeers)...),
+		teardown:   [][]string{nft("delete table %s", table)},
+		peerRules:  peerRules,
+		atomically: nftScript,
+	}
+}
+
+// nftScript turns nft commands into a script 'nft -f' applies atomically.
+func nftScript(cmds [][]string) ([]string, string) {
+	var script strings.Builder
+	for _, args := range cmds {
+		script.WriteString(strings.Join(args[1:], " ") + "\n")
+	}
+	return []string{"nft", "-f", "-"}, script.String()
+}
+
+// iptablesChain names the chains, in the filter and nat tables, holding the
+// rules for wgIface.
+func iptablesChain(wgIface string) string {
+	return "WIREGATE-" + wgIface
+}
+
+// iptablesPeersChain names the chain holding the rules between peers.
+func iptablesPeersChain(wgIface string) string {
+	return "WIREGATE-P-" + wgIface
+}
+
+func newIptablesFirewall(conf *FirewallConfig) *commandFirewall {
+	chain := iptablesChain(conf.WGInterface)
+	peersChain := iptablesPeersChain(conf.WGInterface)
+	removeChains := [][]string{
+		{"iptables", "-D", "FORWARD", "-j", chain},
+		{"iptables", "-F", chain},
+		{"iptables", "-X", chain},
+		{"iptables", "-F", peersChain},
+		{"iptables", "-X", peersChain},
+		{"iptables", "-t", "nat", "-D", "POSTROUTING", "-j", chain},
+		{"iptables", "-t", "nat", "-F", chain},
+		{"iptables", "-t", "nat", "-X", chain},
+	}
+	setup := [][]string{
+		{"iptables", "-N", chain},
+		{"iptables", "-t", "nat", "-N", chain},
+		{"iptables", "-N", peersChain},
+		{"iptables", "-A", chain, "-i", conf.WGInterface, "-o", conf.WGInterface, "-j", peersChain},
+		{"iptables", "-A", chain, "-i", conf.WGInterface, "-o", conf.WGInterface, "-j", "DROP"},
+	}
+	for _, lanIface := range conf.LANInterfaces {
+		switch conf.Gateway {
+		case GatewayLAN:
+			for _, lan := range conf.LANSubnets {
+				setup = append(setup,
+					[]string{"iptables", "-A", chain, "-i", conf.WGInterface, "-o", lanIface, "-s", conf.Subnet, "-d", lan, "-j", "ACCEPT"},
+					[]string{"iptables", "-t", "nat", "-A", chain, "-o", lanIface, "-s", conf.Subnet, "-d", lan, "-j", "MASQUERADE"})
+			}
+		case GatewayExit:
+			setup = append(setup,
+				[]string{"iptables", "-A", chain, "-i", conf.WGInterface, "-o", lanIface, "-s", conf.Subnet, "-j", "ACCEPT"},
+				[]string{"iptables", "-t", "nat", "-A", chain, "-o", lanIface, "-s", conf.Subnet, "-j", "MASQUERADE"})
+		}
+	}
+	setup = append(setup,
+		[]string{"iptables", "-A", chain, "-o", conf.WGInterface, "-d", conf.Subnet, "-j", "ACCEPT"},
+		[]string{"iptables", "-A", chain, "-i", conf.WGInterface, "-j", "DROP"},
+		// First, so a DROP policy or rules added by eg. Docker don't win
+		[]string{"iptables", "-I", "FORWARD", "-j", chain},
+		[]string{"iptables", "-t", "nat", "-A", "POSTROUTING", "-j", chain})
+	peerRules := func(rules []PeerRule) [][]string {
+		cmds := [][]string{
+			{"iptables", "-F", peersChain},
+			{"iptables", "-A", peersChain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		}
+		for _, rule := range rules {
+			match := []string{"iptables", "-A", peersChain}
+			if rule.SourceIP != "" {
+				match = append(match, "-s", rule.SourceIP)
+			}
+			if rule.DestIP != "" {
+				match = append(match, "-d", rule.DestIP)
+			}
+			if len(rule.Ports) == 0 {
+				cmds = append(cmds, append(match, "-j", "ACCEPT"))
+			}
+			for _, port := range rule.Ports {
+				protos := []string{port.Proto}
+				if port.Proto == "" {
+					protos = []string{"tcp", "udp"}
+				}
+				for _, proto := range protos {
+					ports := fmt.Sprintf("%d:%d", port.First, port.Last)
+					cmds = append(cmds, append(append([]string(nil), match...), "-p", proto, "--dport", ports, "-j", "ACCEPT"))
+				}
+			}
+		}
+		return cmds
+	}
+	return &commandFirewall{
+		name:       FirewallIptables,
+		cleanup:    removeChains,
+		setup:      append(setup, peerRules(allowAllPeers)...),
+		teardown:   removeChains,
+		peerRules:  peerRules,
+		atomically: iptablesRestoreScript,
+	}
+}
+
+// iptablesRestoreScript turns iptables commands on the filter table into a
+// script 'iptables-restore' commits atomically, leaving other chains alone.
+func iptablesRestoreScript(cmds [][]string) ([]string, string) {
+	var script strings.Builder
+	script.WriteString("*filter\n")
+	for _, args := range cmds {
+		script.WriteString(strings.Join(args[1:], " ") + "\n")
+	}
+	script.WriteString("COMMIT\n")
+	return []string{"iptables-restore", "--noflush"}, script.String()
+}
@@ -0,0 +1,233 @@
+package wiregate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testFirewallConfig = &FirewallConfig{
+	WGInterface:   "wg-lan0",
+	LANInterfaces: []string{"eth0"},
+	Subnet:        "10.24.99.0/24",
+}
+
+// recordCommands mocks execCommand and execCommandWithInput, recording the
+// commands run, followed by their input if any, and failing those for which
+// fail returns true.
+func recordCommands(fail func(args []string) bool) *[][]string {
+	var calls [][]string
+	record := func(call []string) Commander {
+		calls = append(calls, call)
+		if fail != nil && fail(call) {
+			return NewMockCommand(call[0], "Failure", "Bad args", call[1:]...)
+		}
+		return NewMockCommand(call[0], "", "", call[1:]...)
+	}
+	execCommand = func(cmd string, args ...string) Commander {
+		return record(append([]string{cmd}, args...))
+	}
+	execCommandWithInput = func(input, cmd string, args ...string) Commander {
+		return record(append(append([]string{cmd}, args...), input))
+	}
+	return &calls
+}
+
+func TestNewFirewall(t *testing.T) {
+	var firewallTests = []struct {
+		name      string
+		backend   string
+		installed []string
+		expected  string
+	}{
+		{"Auto prefers nftables", FirewallAuto, []string{"nft", "iptables"}, FirewallNftables},
+		{"Auto falls back to iptables", FirewallAuto, []string{"iptables"}, FirewallIptables},
+		{"Auto without tools", FirewallAuto, nil, ""},
+		{"Explicit iptables", FirewallIptables, []string{"nft", "iptables"}, FirewallIptables},
+		{"None", FirewallNone, nil, FirewallNone},
+		{"Unknown", "pf", nil, ""},
+	}
+	for _, tt := range firewallTests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookPath = func(file string) (string, error) {
+				for _, installed := range tt.installed {
+					if file == installed {
+						return "/usr/sbin/" + file, nil
+					}
+				}
+				return "", fmt.Errorf("%s not found", file)
+			}
+			fw, err := NewFirewall(tt.backend, testFirewallConfig)
+			if tt.expected == "" {
+				if err == nil {
+					t.Errorf("Expected error, got %s firewall", fw.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if fw.Name() != tt.expected {
+				t.Errorf("Expected %s firewall, got %s", tt.expected, fw.Name())
+			}
+		})
+	}
+}
+
+func TestNftablesFirewall(t *testing.T) {
+	calls := recordCommands(nil)
+	fw, _ := NewFirewall(FirewallNftables, testFirewallConfig)
+	if err := fw.Setup(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Leftovers are removed first
+	if !reflect.DeepEqual((*calls)[0], []string{"nft", "delete table ip wiregate_wg_lan0"}) {
+		t.Errorf("Expected leftover table to be removed first, got %v", (*calls)[0])
+	}
+	for _, call := range *calls {
+		if strings.Contains(call[1], "masquerade") {
+			t.Errorf("Isolated VPN shouldn't be masqueraded: %s", call[1])
+		}
+	}
+	dropped := false
+	for _, call := range *calls {
+		dropped = dropped || call[1] == `add rule ip wiregate_wg_lan0 forward iifname "wg-lan0" drop`
+	}
+	if !dropped {
+		t.Errorf("Expected other traffic from the VPN to be dropped, ran %v", *calls)
+	}
+	// Peers reach each other until an ACL policy says otherwise
+	last := (*calls)[len(*calls)-1]
+	if last[1] != "add rule ip wiregate_wg_lan0 peers accept" {
+		t.Errorf("Expected peers to be allowed by default, got %v", last)
+	}
+
+	*calls = nil
+	err := fw.SetPeerRules([]PeerRule{
+		{SourceIP: "10.24.99.2", DestIP: "10.24.99.3"},
+		{SourceIP: "10.24.99.3", DestIP: "10.24.99.2", Ports: []PortRange{{Proto: "tcp", First: 22, Last: 22}, {First: 8000, Last: 8100}}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// In one transaction, so peers never see a half updated policy
+	expectedRules := [][]string{{"nft", "-f", "-", `flush chain ip wiregate_wg_lan0 peers
+add rule ip wiregate_wg_lan0 peers ct state established,related accept
+add rule ip wiregate_wg_lan0 peers ip saddr 10.24.99.2 ip daddr 10.24.99.3 accept
+add rule ip wiregate_wg_lan0 peers ip saddr 10.24.99.3 ip daddr 10.24.99.2 meta l4proto tcp th dport 22-22 accept
+add rule ip wiregate_wg_lan0 peers ip saddr 10.24.99.3 ip daddr 10.24.99.2 meta l4proto { tcp, udp } th dport 8000-8100 accept
+`}}
+	if !reflect.DeepEqual(*calls, expectedRules) {
+		t.Errorf("Expected peer rules %v, got %v", expectedRules, *calls)
+	}
+
+	for _, tt := range []struct {
+		gateway  string
+		expected string
+	}{
+		{GatewayLAN, `add rule ip wiregate_wg_lan0 postrouting oifname "eth0" ip saddr 10.24.99.0/24 ip daddr 192.168.1.0/24 masquerade`},
+		{GatewayExit, `add rule ip wiregate_wg_lan0 postrouting oifname "eth0" ip saddr 10.24.99.0/24 masquerade`},
+	} {
+		conf := *testFirewallConfig
+		conf.Gateway = tt.gateway
+		conf.LANSubnets = []string{"192.168.1.0/24"}
+		fw, _ := NewFirewall(FirewallNftables, &conf)
+		*calls = nil
+		fw.Setup()
+		found := false
+		for _, call := range *calls {
+			found = found || call[1] == tt.expected
+		}
+		if !found {
+			t.Errorf("Expected %s mode to run %s, ran %v", tt.gateway, tt.expected, *calls)
+		}
+	}
+
+	// Traffic may leave through any of several LAN interfaces
+	conf := *testFirewallConfig
+	conf.Gateway = GatewayExit
+	conf.LANInterfaces = []string{"eth0", "wlan0"}
+	*calls = nil
+	multi, _ := NewFirewall(FirewallNftables, &conf)
+	multi.Setup()
+	masqueraded := 0
+	for _, call := range *calls {
+		if strings.HasSuffix(call[1], "ip saddr 10.24.99.0/24 masquerade") {
+			masqueraded++
+		}
+	}
+	if masqueraded != 2 {
+		t.Errorf("Expected traffic to be masqueraded out of both LAN interfaces, ran %v", *calls)
+	}
+
+	*calls = nil
+	if err := fw.Teardown(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(*calls, [][]string{{"nft", "delete table ip wiregate_wg_lan0"}}) {
+		t.Errorf("Unexpected teardown commands %v", *calls)
+	}
+}
+
+func TestIptablesFirewall(t *testing.T) {
+	calls := recordCommands(func(args []string) bool {
+		return reflect.DeepEqual(args, []string{"iptables", "-t", "nat", "-N", "WIREGATE-wg-lan0"})
+	})
+	fw, _ := NewFirewall(FirewallIptables, testFirewallConfig)
+	if err := fw.Setup(); err == nil {
+		t.Fatalf("Expected setup to fail")
+	}
+	// The rules already added must be removed again
+	last := (*calls)[len(*calls)-1]
+	if !reflect.DeepEqual(last, []string{"iptables", "-t", "nat", "-X", "WIREGATE-wg-lan0"}) {
+		t.Errorf("Expected partial rules to be removed after failing, last command was %v", last)
+	}
+
+	calls = recordCommands(nil)
+	fw.SetPeerRules([]PeerRule{{SourceIP: "10.24.99.2", DestIP: "10.24.99.3", Ports: []PortRange{{First: 53, Last: 53}}}})
+	expectedRules := [][]string{{"iptables-restore", "--noflush", `*filter
+-F WIREGATE-P-wg-lan0
+-A WIREGATE-P-wg-lan0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+-A WIREGATE-P-wg-lan0 -s 10.24.99.2 -d 10.24.99.3 -p tcp --dport 53:53 -j ACCEPT
+-A WIREGATE-P-wg-lan0 -s 10.24.99.2 -d 10.24.99.3 -p udp --dport 53:53 -j ACCEPT
+COMMIT
+`}}
+	if !reflect.DeepEqual(*calls, expectedRules) {
+		t.Errorf("Expected peer rules %v, got %v", expectedRules, *calls)
+	}
+
+	// Every step runs even if earlier ones fail, and all failures are reported
+	calls = recordCommands(func(args []string) bool {
+		return args[1] == "-D" || args[len(args)-1] == "WIREGATE-P-wg-lan0"
+	})
+	err := fw.Teardown()
+	if err == nil {
+		t.Fatalf("Expected teardown to fail")
+	}
+	if len(*calls) != 8 || !strings.Contains(err.Error(), "-D FORWARD") || !strings.Contains(err.Error(), "-X WIREGATE-P-wg-lan0") {
+		t.Errorf("Expected every teardown step to run and its failures reported, ran %v: %s", *calls, err)
+	}
+}
+
+func TestFirewallShellCommands(t *testing.T) {
+	fw, _ := NewFirewall(FirewallNftables, testFirewallConfig)
+	up, down := fw.ShellCommands()
+	if !strings.HasPrefix(up, "nft 'add table ip wiregate_wg_lan0'; ") {
+		t.Errorf("Unexpected PostUp %q", up)
+	}
+	if !strings.Contains(up, `'add rule ip wiregate_wg_lan0 forward iifname "wg-lan0" drop'`) {
+		t.Errorf("Unexpected PostUp %q", up)
+	}
+	if down != "nft 'delete table ip wiregate_wg_lan0'" {
+		t.Errorf("Unexpected PostDown %q", down)
+	}
+
+	fw, _ = NewFirewall(FirewallNone, testFirewallConfig)
+	if up, down := fw.ShellCommands(); up != "" || down != "" {
+		t.Errorf("Expected no commands without a firewall, got %q and %q", up, down)
+	}
+	if shellQuote("it's") != `'it'\''s'` {
+		t.Errorf("Unexpected quoting %s", shellQuote("it's"))
+	}
+}
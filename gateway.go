@@ -0,0 +1,74 @@
+package wiregate
+
+import (
+	"fmt"
+	"net"
+)
+
+// Gateway modes, from the least to the most traffic the server forwards for
+// its clients.
+const (
+	// Clients only reach each other
+	GatewayIsolated = "isolated"
+	// Clients also reach the server's LAN
+	GatewayLAN = "lan"
+	// Clients send all their traffic through the server
+	GatewayExit = "exit"
+)
+
+var gatewayLevels = map[string]int{
+	GatewayIsolated: 0,
+	GatewayLAN:      1,
+	GatewayExit:     2,
+}
+
+// ValidateGatewayMode returns an error unless mode is one of the gateway modes.
+func ValidateGatewayMode(mode string) error {
+	if _, ok := gatewayLevels[mode]; !ok {
+		return fmt.Errorf("Unknown gateway mode %q, expected isolated, lan or exit", mode)
+	}
+	return nil
+}
+
+// NegotiateGateway returns the gateway mode a client that asked for requested
+// gets from a server offering offered, the more restrictive of the two. An
+// empty request takes whatever the server offers.
+func NegotiateGateway(offered, requested string) string {
+	level, ok := gatewayLevels[requested]
+	if !ok || level > gatewayLevels[offered] {
+		return offered
+	}
+	return requested
+}
+
+// GatewayRoutes returns the subnets clients in gateway mode should route
+// through the server, given the subnets of the server's LAN.
+func GatewayRoutes(mode string, lanSubnets []string) []string {
+	switch mode {
+	case GatewayLAN:
+		return lanSubnets
+	case GatewayExit:
+		return []string{"0.0.0.0/0"}
+	}
+	return nil
+}
+
+// InterfaceSubnets returns the IPv4 subnets ifaceName is directly connected to.
+func InterfaceSubnets(ifaceName string) ([]string, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve local interface %s: %s", ifaceName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get addresses from interface %s: %s", ifaceName, err)
+	}
+	var subnets []string
+	for _, addr := range addrs {
+		if ipnetAddr, ok := addr.(*net.IPNet); ok && ipnetAddr.IP.To4() != nil {
+			subnet := &net.IPNet{IP: ipnetAddr.IP.Mask(ipnetAddr.Mask), Mask: ipnetAddr.Mask}
+			subnets = append(subnets, subnet.String())
+		}
+	}
+	return subnets, nil
+}
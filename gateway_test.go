@@ -0,0 +1,42 @@
+package wiregate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateGateway(t *testing.T) {
+	var gatewayTests = []struct {
+		offered   string
+		requested string
+		expected  string
+	}{
+		{GatewayExit, "", GatewayExit},
+		{GatewayExit, GatewayLAN, GatewayLAN},
+		{GatewayLAN, GatewayExit, GatewayLAN},
+		{GatewayIsolated, GatewayExit, GatewayIsolated},
+		{GatewayLAN, GatewayIsolated, GatewayIsolated},
+		{GatewayLAN, "everything", GatewayLAN},
+	}
+	for _, tt := range gatewayTests {
+		if mode := NegotiateGateway(tt.offered, tt.requested); mode != tt.expected {
+			t.Errorf("Server offering %s, client asking for %q: expected %s, got %s", tt.offered, tt.requested, tt.expected, mode)
+		}
+	}
+	if err := ValidateGatewayMode("everything"); err == nil {
+		t.Errorf("Expected error for unknown gateway mode")
+	}
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	lan := []string{"192.168.1.0/24"}
+	if routes := GatewayRoutes(GatewayIsolated, lan); len(routes) != 0 {
+		t.Errorf("Expected no routes in isolated mode, got %v", routes)
+	}
+	if routes := GatewayRoutes(GatewayLAN, lan); !reflect.DeepEqual(routes, lan) {
+		t.Errorf("Expected LAN routes, got %v", routes)
+	}
+	if routes := GatewayRoutes(GatewayExit, lan); !reflect.DeepEqual(routes, []string{"0.0.0.0/0"}) {
+		t.Errorf("Expected default route, got %v", routes)
+	}
+}
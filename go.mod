@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/ideasynthesis/mdns v0.3.3
+	github.com/miekg/dns v1.1.3
 	github.com/sirupsen/logrus v1.4.2
 	golang.org/x/crypto v0.0.0-20191205161847-0a08dada0ff9
 	golang.org/x/net v0.0.0-20191204025024-5ee1b9f4859a // indirect
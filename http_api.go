@@ -3,25 +3,79 @@ package wiregate
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// How often the membership stream sends a keepalive if HttpApi has no
+// HeartBeatInterval. Every keepalive counts as a heartbeat from the node.
+var streamPingInterval = 5 * time.Second
+
 type HttpApi struct {
-	server             *http.Server
-	running            bool
+	server  *http.Server
+	running bool
+	// Guards the settings UpdateSettings changes while serving, stopping and
+	// streams
+	settingsMu sync.RWMutex
+	// Closed when the server starts shutting down
+	stopping chan struct{}
+	// Open membership streams by node key, guarded by settingsMu
+	streams            map[string]int
 	Registry           *Registry
 	EndpointIPPortPair string
 	VPNPassword        string
 	WGServerPublicKey  string
 	WGServerPeerIP     string
+	Mesh               bool
+	// Advertised to clients, who should beat at HeartBeatInterval and will be
+	// purged after PurgeDeadline without one.
+	HeartBeatInterval time.Duration
+	PurgeDeadline     time.Duration
+	// Longest lease granted to nodes that register without heart beating,
+	// 0 disables such registrations.
+	MaxLease time.Duration
+	// The most a client may route through the server, one of the Gateway*
+	// modes, an empty one isolates clients. LANSubnets are routed in
+	// GatewayLAN mode, and clients in GatewayExit mode use DNS.
+	Gateway    string
+	LANSubnets []string
+	DNS        []string
+	// Passwords of users who register under their own name instead of with
+	// VPNPassword, for ACL policies
+	Users map[string]string
+	// Subnets nodes may advertise subnets within, to route them for the
+	// other nodes. Nodes can't advertise any without them.
+	AdvertisableSubnets []string
+	// Seals rotated preshared keys for the nodes they belong to, which
+	// aren't sent in membership updates without it
+	WGServerPrivateKey string
+	// Every address:port the server's WireGuard listens on, IPv4 and IPv6,
+	// for clients to pick one they can reach
+	Endpoints []string
 }
 
 type RegistrationRequest struct {
 	PublicKey string
 	Password  string
+	// User registers the node as this user, authenticated by Password.
+	User string `json:",omitempty"`
+	// PreferredIP is the VPN IP a re-registering node had before, if any.
+	PreferredIP string `json:",omitempty"`
+	// Lease asks for the node to be kept for this many seconds without heart
+	// beats, eg. for static wg-quick configs. The server may shorten it.
+	Lease int `json:",omitempty"`
+	// Gateway is the gateway mode the node wants, the server grants it if it
+	// offers that much. Empty takes what the server offers.
+	Gateway string `json:",omitempty"`
+	// Subnets behind the node it routes for the other nodes, eg. a lab's LAN
+	Subnets []string `json:",omitempty"`
 }
 
 type RegistrationReply struct {
@@ -31,18 +85,100 @@ type RegistrationReply struct {
 	AllowedIPs         []string
 	WGServerPublicKey  string
 	WGServerPeerIP     string
+	Mesh               bool `json:",omitempty"`
+	// Seconds between heart beats and seconds the server waits for one before
+	// purging the node.
+	HeartBeatInterval    int `json:",omitempty"`
+	HeartBeatGracePeriod int `json:",omitempty"`
+	// Seconds the node's lease lasts, if it asked for one.
+	Lease int `json:",omitempty"`
+	// The gateway mode granted, empty if the node is isolated, the subnets the
+	// node should route through the server for it and the DNS servers it
+	// should use.
+	Gateway string   `json:",omitempty"`
+	Routes  []string `json:",omitempty"`
+	DNS     []string `json:",omitempty"`
+	// WireGuard preshared key for the server peer, if the server uses them
+	PresharedKey string `json:",omitempty"`
+	// All of the server's WireGuard endpoints, EndpointIPPortPair among
+	// them, if it listens on several addresses
+	Endpoints []string `json:",omitempty"`
+}
+
+// ProvisionRequest asks the server to register a peer that can't run the
+// WireGate client, eg. a phone, on its behalf.
+type ProvisionRequest struct {
+	Password string
+	User     string `json:",omitempty"`
+	// Seconds to keep the peer registered, capped by the server's MaxLease
+	Lease int
 }
 
+// ProvisionReply holds a wg-quick config for the provisioned peer, including
+// its private key.
+type ProvisionReply struct {
+	NodeIp    string
+	PublicKey string
+	Lease     int
+	Config    string
+}
+
+// Seconds between keepalives provisioned peers send, to keep NAT mappings
+// open on mobile networks.
+const provisionedKeepalive = 25
+
 type DeregistrationRequest struct {
 	PublicKey string
 }
 
+// RekeyRequest asks the server to move a node to NewPublicKey, keeping its VPN
+// IP. Proof is NewPublicKey sealed by SealRekeyProof with the node's current
+// private key, showing the request comes from the node itself.
+type RekeyRequest struct {
+	PublicKey    string
+	NewPublicKey string
+	Proof        string
+}
+
 type HeartBeatRequest struct {
 	PublicKey string
+	// Revision is the last membership revision the client has applied, or 0
+	// if it has none yet.
+	Revision uint64 `json:",omitempty"`
+	// PresharedKeyFingerprint is the KeyFingerprint of the preshared key the
+	// client uses, acknowledging a rotated one.
+	PresharedKeyFingerprint string `json:",omitempty"`
+}
+
+// MeshPeer describes a registered client as seen by the other clients.
+// Endpoint is only shared in mesh mode.
+type MeshPeer struct {
+	PublicKey string
+	VPNIP     string
+	Endpoint  string `json:",omitempty"`
+	// Subnets routed through the peer, which other clients route to the
+	// server
+	Subnets []string `json:",omitempty"`
+	// In mesh mode, the preshared key of the direct tunnel between the
+	// receiving node and the peer, sealed for the receiving node
+	PresharedKey string `json:",omitempty"`
 }
 
+// HeartBeatResponse carries the membership at Revision. If Full is set,
+// AllowedIPs and Peers describe every registered node, otherwise Changes
+// lists what happened since the revision sent in the request.
 type HeartBeatResponse struct {
-	AllowedIPs []string
+	Revision   uint64
+	Full       bool               `json:",omitempty"`
+	AllowedIPs []string           `json:",omitempty"`
+	Peers      []MeshPeer         `json:",omitempty"`
+	Changes    []MembershipChange `json:",omitempty"`
+	// ShuttingDown tells the node the server is going away and will forget
+	// it, so it should stop beating and register again once it's back.
+	ShuttingDown bool `json:",omitempty"`
+	// The node's current preshared key, sealed for it by SealPresharedKey
+	// since anyone may ask for a node's membership
+	PresharedKey string `json:",omitempty"`
 }
 
 func (h *HttpApi) registerNode(w http.ResponseWriter, req *http.Request) {
@@ -59,25 +195,77 @@ func (h *HttpApi) registerNode(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if r.Password != h.VPNPassword {
+	if !h.authenticate(r.User, r.Password) {
 		log.Infof("registerNode received request with bad password from %s", req.RemoteAddr)
 		http.Error(w, "Bad password", http.StatusForbidden)
 		return
 	}
-	n, err := h.Registry.Put(r.PublicKey)
+	if r.Lease < 0 || r.Lease > 0 && h.MaxLease == 0 {
+		log.Infof("registerNode received request for a lease it can't grant from %s", req.RemoteAddr)
+		http.Error(w, "Leases are disabled", http.StatusBadRequest)
+		return
+	}
+	lease := time.Duration(r.Lease) * time.Second
+	if lease > h.MaxLease {
+		lease = h.MaxLease
+	}
+	if err := CheckAdvertisedSubnets(r.Subnets, h.AdvertisableSubnets); err != nil {
+		log.Infof("registerNode refused subnets advertised by %s: %s", req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	psk, err := h.newPresharedKey()
 	if err != nil {
-		log.Errorf("registerNode unable to service request from %s (pubkey: %s) due to: %s", req.RemoteAddr, r.PublicKey, err)
+		log.Errorf("registerNode unable to generate preshared key for %s: %s", req.RemoteAddr, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	n, err := h.Registry.Register(&Registration{
+		PublicKey:    r.PublicKey,
+		PreferredIP:  r.PreferredIP,
+		User:         r.User,
+		Subnets:      r.Subnets,
+		PresharedKey: psk,
+	})
+	if err != nil {
+		log.Errorf("registerNode unable to service request from %s (pubkey: %s) due to: %s", req.RemoteAddr, r.PublicKey, err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrNoIPsLeft):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, ErrSubnetTaken):
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if lease > 0 {
+		h.Registry.SetExpiry(r.PublicKey, time.Now().Add(lease).Unix())
+	}
 
+	heartBeatInterval, purgeDeadline := h.heartBeatTimings()
+	gateway := h.gatewayMode(r.Gateway)
 	response := &RegistrationReply{
 		NodeIp:             n.VPNIP,
 		NodeCIDR:           n.CIDR,
 		EndpointIPPortPair: h.EndpointIPPortPair,
-		AllowedIPs:         h.Registry.GetRegisteredIPs(),
+		AllowedIPs:         h.Registry.RegisteredIPsFor(r.PublicKey),
 		WGServerPublicKey:  h.WGServerPublicKey,
 		WGServerPeerIP:     h.WGServerPeerIP,
+		Mesh:               h.Mesh,
+
+		HeartBeatInterval:    int(heartBeatInterval / time.Second),
+		HeartBeatGracePeriod: int(purgeDeadline / time.Second),
+		Lease:                int(lease / time.Second),
+
+		Routes: GatewayRoutes(gateway, h.LANSubnets),
+		DNS:    h.gatewayDNS(gateway),
+
+		PresharedKey: psk,
+		Endpoints:    h.Endpoints,
+	}
+	if gateway != GatewayIsolated {
+		response.Gateway = gateway
 	}
 	log.Debugf("registerNode preparing registration repsonse to %s: %#v", req.RemoteAddr, response)
 	err = json.NewEncoder(w).Encode(response)
@@ -89,6 +277,91 @@ func (h *HttpApi) registerNode(w http.ResponseWriter, req *http.Request) {
 	log.Infof("Successfully registered node %s/%s with pubkey %s as requested by %s", n.VPNIP, n.CIDR, r.PublicKey, req.RemoteAddr)
 }
 
+// provisionNode generates a keypair, registers it as a leased node and replies
+// with a wg-quick config for it.
+func (h *HttpApi) provisionNode(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		log.Errorf("provisionNode received request with method %s, expected POST from %s", req.Method, req.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var r ProvisionRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		log.Errorf("provisionNode received incorrect json request from %s: %v", req.RemoteAddr, err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !h.authenticate(r.User, r.Password) {
+		log.Infof("provisionNode received request with bad password from %s", req.RemoteAddr)
+		http.Error(w, "Bad password", http.StatusForbidden)
+		return
+	}
+	if r.Lease <= 0 || h.MaxLease == 0 {
+		http.Error(w, "Provisioned peers need a lease and leases must be enabled", http.StatusBadRequest)
+		return
+	}
+	lease := time.Duration(r.Lease) * time.Second
+	if lease > h.MaxLease {
+		lease = h.MaxLease
+	}
+	privKey, pubKey, err := GenerateKeyPair()
+	if err != nil {
+		log.Errorf("provisionNode unable to generate keys for %s: %s", req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	psk, err := h.newPresharedKey()
+	if err != nil {
+		log.Errorf("provisionNode unable to generate preshared key for %s: %s", req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := h.Registry.Register(&Registration{PublicKey: pubKey, User: r.User, PresharedKey: psk})
+	if err != nil {
+		log.Errorf("provisionNode unable to service request from %s due to: %s", req.RemoteAddr, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrNoIPsLeft) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	h.Registry.SetExpiry(pubKey, time.Now().Add(lease).Unix())
+
+	address := fmt.Sprintf("%s/%s", n.VPNIP, strings.TrimPrefix(n.CIDR, "/"))
+	allowedIPs := []string{h.WGServerPeerIP + "/32"}
+	if _, vpnSubnet, err := net.ParseCIDR(address); err == nil {
+		allowedIPs = []string{vpnSubnet.String()}
+	}
+	gateway := h.gatewayMode("")
+	allowedIPs = append(allowedIPs, GatewayRoutes(gateway, h.LANSubnets)...)
+	conf := &WgQuickConfig{
+		Interface: WgQuickInterface{
+			Address:    address,
+			PrivateKey: privKey,
+			DNS:        h.gatewayDNS(gateway),
+		},
+		Peers: []WgQuickPeer{{
+			PublicKey:           h.WGServerPublicKey,
+			PresharedKey:        psk,
+			Endpoint:            h.EndpointIPPortPair,
+			AllowedIPs:          allowedIPs,
+			PersistentKeepalive: provisionedKeepalive,
+		}},
+	}
+	response := &ProvisionReply{
+		NodeIp:    n.VPNIP,
+		PublicKey: pubKey,
+		Lease:     int(lease / time.Second),
+		Config:    conf.String(),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("provisionNode response to %s failed: %s", req.RemoteAddr, err)
+		return
+	}
+	log.Infof("Provisioned node %s with pubkey %s for %s as requested by %s", address, pubKey, lease, req.RemoteAddr)
+}
+
 func (h *HttpApi) unregisterNode(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodDelete {
 		log.Errorf("unregisterNode received request with method %s, expected POST from %s", req.Method, req.RemoteAddr)
@@ -112,6 +385,53 @@ func (h *HttpApi) unregisterNode(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// rekeyNode moves a node to a new public key, which it switches its own
+// interface to once the server replies.
+func (h *HttpApi) rekeyNode(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		log.Errorf("rekeyNode received request with method %s, expected POST from %s", req.Method, req.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var r RekeyRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		log.Errorf("rekeyNode received incorrect json from %s: %s", req.RemoteAddr, err)
+		http.Error(w, "Error while decoding json", http.StatusInternalServerError)
+		return
+	}
+	if h.WGServerPrivateKey == "" || !h.Registry.SupportsRekeying() {
+		http.Error(w, "Rekeying isn't supported by this server", http.StatusNotImplemented)
+		return
+	}
+	if err := ValidateKey(r.NewPublicKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := h.Registry.Get(r.PublicKey); err != nil {
+		log.Errorf("rekeyNode unable to service request from %s (pubkey %s) due to %s", req.RemoteAddr, r.PublicKey, err)
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	newPubKey, err := OpenRekeyProof(r.Proof, h.WGServerPrivateKey, r.PublicKey)
+	if err != nil || newPubKey != r.NewPublicKey {
+		log.Infof("rekeyNode received request with bad proof from %s (pubkey %s)", req.RemoteAddr, r.PublicKey)
+		http.Error(w, "Bad proof", http.StatusForbidden)
+		return
+	}
+	n, err := h.Registry.Rekey(r.PublicKey, r.NewPublicKey)
+	if err != nil {
+		log.Errorf("rekeyNode unable to service request from %s (pubkey %s) due to: %s", req.RemoteAddr, r.PublicKey, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrKeyTaken) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	log.Infof("Rekeyed node %s from pubkey %s to %s as requested by %s", n.VPNIP, r.PublicKey, r.NewPublicKey, req.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *HttpApi) heartBeat(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
 		log.Errorf("heartBeat received request with method %s, expected POST from %s", req.Method, req.RemoteAddr)
@@ -133,9 +453,14 @@ func (h *HttpApi) heartBeat(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	n.Beat()
+	h.updateEndpoint(hb.PublicKey)
+	h.acknowledgePresharedKey(&hb)
 
-	response := &HeartBeatResponse{
-		AllowedIPs: h.Registry.GetRegisteredIPs(),
+	response := h.membershipSince(hb.PublicKey, hb.Revision)
+	select {
+	case <-h.stoppingChan():
+		response.ShuttingDown = true
+	default:
 	}
 
 	log.Debugf("heartBeat preparing response to %s: %#v", req.RemoteAddr, response)
@@ -148,33 +473,391 @@ func (h *HttpApi) heartBeat(w http.ResponseWriter, req *http.Request) {
 	log.Infof("Successfully registered beat for pubkey %s request by %s", hb.PublicKey, req.RemoteAddr)
 }
 
+// events streams membership changes to a registered node as server-sent
+// events. The request body is a HeartBeatRequest, and the stream starts with
+// everything that changed since its revision.
+func (h *HttpApi) events(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		log.Errorf("events received request with method %s, expected POST from %s", req.Method, req.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var hb HeartBeatRequest
+	if err := json.NewDecoder(req.Body).Decode(&hb); err != nil {
+		log.Errorf("events received incorrect json from %s: %s", req.RemoteAddr, err)
+		http.Error(w, "Error while decoding json", http.StatusInternalServerError)
+		return
+	}
+	n, err := h.Registry.Get(hb.PublicKey)
+	if err != nil {
+		log.Errorf("events unable to service request from %s (pubkey %s) due to %s", req.RemoteAddr, hb.PublicKey, err)
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	updates, unsubscribe := h.Registry.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	h.trackStream(hb.PublicKey, 1)
+	defer h.trackStream(hb.PublicKey, -1)
+	n.Beat()
+	h.updateEndpoint(hb.PublicKey)
+	h.acknowledgePresharedKey(&hb)
+
+	revision := hb.Revision
+	sendMembership := func() error {
+		response := h.membershipSince(hb.PublicKey, revision)
+		revision = response.Revision
+		data, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: membership\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := sendMembership(); err != nil {
+		log.Errorf("events unable to send membership to %s (pubkey %s): %s", req.RemoteAddr, hb.PublicKey, err)
+		return
+	}
+	log.Infof("Streaming membership changes to pubkey %s at %s", hb.PublicKey, req.RemoteAddr)
+
+	ping := time.NewTicker(h.pingInterval())
+	defer ping.Stop()
+	stopping := h.stoppingChan()
+	for {
+		select {
+		case <-stopping:
+			log.Debugf("Telling pubkey %s the server is shutting down", hb.PublicKey)
+			data, _ := json.Marshal(&HeartBeatResponse{Revision: revision, ShuttingDown: true})
+			fmt.Fprintf(w, "event: shutdown\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		case <-req.Context().Done():
+			log.Infof("Membership stream to pubkey %s closed", hb.PublicKey)
+			return
+		case <-updates:
+			if err := sendMembership(); err != nil {
+				log.Errorf("events unable to send membership to %s (pubkey %s): %s", req.RemoteAddr, hb.PublicKey, err)
+				return
+			}
+		case <-ping.C:
+			if _, err := h.Registry.Get(hb.PublicKey); err != nil {
+				log.Infof("Closing membership stream to removed pubkey %s", hb.PublicKey)
+				return
+			}
+			n.Beat()
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (h *HttpApi) pingInterval() time.Duration {
+	if heartBeatInterval, _ := h.heartBeatTimings(); heartBeatInterval > 0 {
+		return heartBeatInterval
+	}
+	return streamPingInterval
+}
+
+// UpdateSettings changes the password and heart beat timings of a running
+// HttpApi. Nodes learn the new timings when they next register.
+func (h *HttpApi) UpdateSettings(vpnPassword string, heartBeatInterval, purgeDeadline time.Duration) {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	h.VPNPassword = vpnPassword
+	h.HeartBeatInterval = heartBeatInterval
+	h.PurgeDeadline = purgeDeadline
+}
+
+// UpdateUsers changes the users of a running HttpApi. Nodes that already
+// registered keep their user.
+func (h *HttpApi) UpdateUsers(users map[string]string) {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	h.Users = users
+}
+
+// AuthMode tells how nodes can authenticate: with the VPN password only, or
+// also as one of the users.
+func (h *HttpApi) AuthMode() string {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	if len(h.Users) > 0 {
+		return AuthPasswordUsers
+	}
+	return AuthPassword
+}
+
+func (h *HttpApi) passwordMatches(password string) bool {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	return password == h.VPNPassword
+}
+
+// authenticate checks password against user's, or VPNPassword if user is
+// empty.
+func (h *HttpApi) authenticate(user, password string) bool {
+	if user == "" {
+		return h.passwordMatches(password)
+	}
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	userPassword, ok := h.Users[user]
+	return ok && userPassword != "" && password == userPassword
+}
+
+func (h *HttpApi) heartBeatTimings() (time.Duration, time.Duration) {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	return h.HeartBeatInterval, h.PurgeDeadline
+}
+
+// gatewayMode returns the gateway mode a node that asked for requested gets.
+// Servers without a gateway mode isolate nodes.
+func (h *HttpApi) gatewayMode(requested string) string {
+	offered := h.Gateway
+	if offered == "" {
+		offered = GatewayIsolated
+	}
+	return NegotiateGateway(offered, requested)
+}
+
+// gatewayDNS returns the DNS servers nodes in gateway mode should use.
+func (h *HttpApi) gatewayDNS(gateway string) []string {
+	if gateway != GatewayExit {
+		return nil
+	}
+	return h.DNS
+}
+
+// updateEndpoint records the WireGuard endpoint of a beating node in mesh
+// mode. It's read from the server's WireGuard rather than the request, which
+// anyone who knows the node's public key can make.
+func (h *HttpApi) updateEndpoint(pubKey string) {
+	if h.Mesh {
+		h.Registry.LearnEndpoint(pubKey)
+	}
+}
+
+// membershipSince returns what changed since revision among the peers the
+// node with pubKey may see.
+func (h *HttpApi) membershipSince(pubKey string, revision uint64) *HeartBeatResponse {
+	response := h.membershipChanges(pubKey, revision)
+	response.PresharedKey = h.sealedPresharedKey(pubKey)
+	h.sealMeshPresharedKeys(pubKey, response)
+	return response
+}
+
+// sealMeshPresharedKeys gives the peers in response the preshared key of
+// their direct tunnel with the node with pubKey, sealed for that node. The
+// peers are copied, as the registry shares them between responses.
+func (h *HttpApi) sealMeshPresharedKeys(pubKey string, response *HeartBeatResponse) {
+	if !h.Mesh || h.WGServerPrivateKey == "" || !h.Registry.SupportsPresharedKeys() {
+		return
+	}
+	seal := func(p MeshPeer) MeshPeer {
+		if p.PublicKey == pubKey {
+			return p
+		}
+		psk, err := MeshPresharedKey(h.WGServerPrivateKey, pubKey, p.PublicKey)
+		if err == nil {
+			p.PresharedKey, err = SealPresharedKey(psk, h.WGServerPrivateKey, pubKey)
+		}
+		if err != nil {
+			log.Errorf("Unable to seal mesh preshared key of %s for %s: %s", p.PublicKey, pubKey, err)
+		}
+		return p
+	}
+	peers := make([]MeshPeer, 0, len(response.Peers))
+	for _, p := range response.Peers {
+		peers = append(peers, seal(p))
+	}
+	if response.Peers != nil {
+		response.Peers = peers
+	}
+	changes := make([]MembershipChange, 0, len(response.Changes))
+	for _, c := range response.Changes {
+		if !c.Removed {
+			c.Peer = seal(c.Peer)
+		}
+		changes = append(changes, c)
+	}
+	if response.Changes != nil {
+		response.Changes = changes
+	}
+}
+
+func (h *HttpApi) membershipChanges(pubKey string, revision uint64) *HeartBeatResponse {
+	current, changes, ok := h.Registry.MembershipSinceFor(pubKey, revision)
+	if ok {
+		return &HeartBeatResponse{Revision: current, Changes: changes}
+	}
+	current, peers := h.Registry.MembershipFor(pubKey)
+	response := &HeartBeatResponse{
+		Revision:   current,
+		Full:       true,
+		AllowedIPs: make([]string, 0, len(peers)),
+		Peers:      peers,
+	}
+	for _, p := range peers {
+		response.AllowedIPs = append(response.AllowedIPs, p.VPNIP)
+	}
+	return response
+}
+
+// newPresharedKey generates a preshared key for a registering node, or
+// returns an empty one if the registry can't install it.
+func (h *HttpApi) newPresharedKey() (string, error) {
+	if !h.Registry.SupportsPresharedKeys() {
+		return "", nil
+	}
+	return GeneratePresharedKey()
+}
+
+// acknowledgePresharedKey installs the rotated preshared key hb acknowledges,
+// if any.
+func (h *HttpApi) acknowledgePresharedKey(hb *HeartBeatRequest) {
+	if hb.PresharedKeyFingerprint == "" {
+		return
+	}
+	if err := h.Registry.AcknowledgePresharedKey(hb.PublicKey, hb.PresharedKeyFingerprint); err != nil {
+		log.Errorf("Unable to install the preshared key %s acknowledged: %s", hb.PublicKey, err)
+	}
+}
+
+// sealedPresharedKey returns the preshared key of the node with pubKey sealed
+// for it, or an empty string if there's none to send.
+func (h *HttpApi) sealedPresharedKey(pubKey string) string {
+	if h.WGServerPrivateKey == "" {
+		return ""
+	}
+	psk, err := h.Registry.PresharedKey(pubKey)
+	if err != nil || psk == "" {
+		return ""
+	}
+	sealed, err := SealPresharedKey(psk, h.WGServerPrivateKey, pubKey)
+	if err != nil {
+		log.Errorf("Unable to seal preshared key for %s: %s", pubKey, err)
+		return ""
+	}
+	return sealed
+}
+
+// stoppingChan returns the channel closed when the server starts shutting
+// down.
+func (h *HttpApi) stoppingChan() chan struct{} {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	if h.stopping == nil {
+		h.stopping = make(chan struct{})
+	}
+	return h.stopping
+}
+
+// trackStream counts a membership stream to the node with pubKey opening, with
+// delta 1, or closing, with delta -1.
+func (h *HttpApi) trackStream(pubKey string, delta int) {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	if h.streams == nil {
+		h.streams = make(map[string]int)
+	}
+	h.streams[pubKey] += delta
+	if h.streams[pubKey] <= 0 {
+		delete(h.streams, pubKey)
+	}
+}
+
+// pollingNodes returns how many heart beating nodes have no membership stream
+// open and learn about changes by polling.
+func (h *HttpApi) pollingNodes() int {
+	keys := h.Registry.HeartBeatingNodes()
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	polling := 0
+	for _, key := range keys {
+		if h.streams[key] == 0 {
+			polling++
+		}
+	}
+	return polling
+}
+
+// notifyShutdown tells streaming nodes right away, and polling nodes on their
+// next heart beat, that the server is shutting down.
+func (h *HttpApi) notifyShutdown() {
+	stopping := h.stoppingChan()
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	select {
+	case <-stopping:
+	default:
+		close(stopping)
+	}
+}
+
 func (h *HttpApi) Start(port int, httpCert, httpKey string, running chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", h.registerNode)
+	mux.HandleFunc("/provision", h.provisionNode)
+	mux.HandleFunc("/unregister", h.unregisterNode)
+	mux.HandleFunc("/rekey", h.rekeyNode)
+	mux.HandleFunc("/beat", h.heartBeat)
+	mux.HandleFunc("/events", h.events)
 	h.server = &http.Server{
-		Addr: fmt.Sprintf(":%d", port),
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
 	}
+	h.running = true
 
-	go func(running chan struct{}) {
-		defer func() {
-			h.server = nil
-		}()
-		http.HandleFunc("/register", h.registerNode)
-		http.HandleFunc("/unregister", h.unregisterNode)
-		http.HandleFunc("/beat", h.heartBeat)
-
+	go func(server *http.Server, running chan struct{}) {
 		log.Debugf("TLS HTTP server using cert: %s and key: %s", httpCert, httpKey)
-		log.Infof("Starting server on address: %v", h.server.Addr)
-		err := h.server.ListenAndServeTLS(httpCert, httpKey)
-		if err != nil {
+		log.Infof("Starting server on address: %v", server.Addr)
+		err := server.ListenAndServeTLS(httpCert, httpKey)
+		if err != http.ErrServerClosed {
 			log.Errorf("TLS HTTP server error: %s\n", err)
-			close(running)
 		}
-	}(running)
+		close(running)
+	}(h.server, running)
 }
 
-func (h *HttpApi) Stop() error {
+// Stop notifies nodes that the server is shutting down, gives those that poll
+// one heart beat interval to hear about it and then shuts the HTTP server
+// down. Membership streams are closed once they've sent the notice. If ctx
+// expires first, remaining connections are closed.
+func (h *HttpApi) Stop(ctx context.Context) error {
 	log.Info("Stopping TLS HTTP server")
-	if h.running {
-		return h.server.Shutdown(context.Background())
+	if !h.running {
+		return nil
+	}
+	h.running = false
+	// Streaming nodes hear about it right away, static and leased ones
+	// don't beat at all
+	polling := h.pollingNodes()
+	h.notifyShutdown()
+	if heartBeatInterval, _ := h.heartBeatTimings(); heartBeatInterval > 0 && polling > 0 {
+		log.Infof("Waiting %s for nodes to hear about the shutdown", heartBeatInterval)
+		drain := time.NewTimer(heartBeatInterval)
+		defer drain.Stop()
+		select {
+		case <-drain.C:
+		case <-ctx.Done():
+		}
+	}
+	if err := h.server.Shutdown(ctx); err != nil {
+		h.server.Close()
+		return err
 	}
 	return nil
 }
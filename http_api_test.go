@@ -1,11 +1,18 @@
 package wiregate
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRegisteringNewNodes(t *testing.T) {
@@ -53,7 +60,7 @@ func TestRegisteringNewNodes(t *testing.T) {
 
 func TestRemovingNode(t *testing.T) {
 	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
-	registry.Put("pubKey1")
+	registry.Register(&Registration{PublicKey: "pubKey1"})
 	api := HttpApi{Registry: registry, EndpointIPPortPair: "127.0.0.1:8083"}
 
 	var deletionTests = []struct {
@@ -91,7 +98,7 @@ func TestRemovingNode(t *testing.T) {
 
 func TestHeartBeat(t *testing.T) {
 	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
-	registry.Put("pubKey1")
+	registry.Register(&Registration{PublicKey: "pubKey1"})
 	api := HttpApi{Registry: registry, EndpointIPPortPair: "127.0.0.1:8083"}
 
 	var heartBeatTests = []struct {
@@ -101,7 +108,9 @@ func TestHeartBeat(t *testing.T) {
 		expectedStatus int
 		expectedRsp    string
 	}{
-		{"beatHeart", "POST", `{"publicKey":"pubKey1"}`, http.StatusOK, `{"AllowedIPs":["1.1.1.1"]}`},
+		{"beatHeart", "POST", `{"publicKey":"pubKey1"}`, http.StatusOK,
+			`{"Revision":1,"Full":true,"AllowedIPs":["1.1.1.1"],"Peers":[{"PublicKey":"pubKey1","VPNIP":"1.1.1.1"}]}`},
+		{"upToDate", "POST", `{"publicKey":"pubKey1","revision":1}`, http.StatusOK, `{"Revision":1}`},
 		{"badMethod", "GET", `{"publicKey":"pubKey1"}`, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)},
 		{"badJson", "POST", `{"publicKey":`, http.StatusInternalServerError, "Error while decoding json"},
 		{"badKey", "POST", `{"publicKey":"pubKey999"}`, http.StatusNotFound, "Node not found"},
@@ -127,3 +136,559 @@ func TestHeartBeat(t *testing.T) {
 		})
 	}
 }
+
+func TestMeshHeartBeat(t *testing.T) {
+	wgControl := &FakeEndpointWgControl{endpoints: map[string]string{"pubKey1": "192.168.1.20:41000"}}
+	registry := NewRegistry(&FakeIPGen{}, wgControl)
+	registry.Register(&Registration{PublicKey: "pubKey1"})
+	api := HttpApi{Registry: registry, EndpointIPPortPair: "127.0.0.1:8083", Mesh: true}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"publicKey":"pubKey1","revision":1}`)
+	req, err := http.NewRequest("POST", "/beat", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.168.1.20:55555"
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.heartBeat).ServeHTTP(rr, req)
+
+	expectedRsp := `{"Revision":2,"Changes":[{"Revision":2,"Peer":{"PublicKey":"pubKey1","VPNIP":"1.1.1.1","Endpoint":"192.168.1.20:41000"}}]}`
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status code %d, want %d", rr.Code, http.StatusOK)
+	}
+	if strings.TrimSuffix(rr.Body.String(), "\n") != expectedRsp {
+		t.Errorf("Unexpected response, got %#v, want %#v", rr.Body.String(), expectedRsp)
+	}
+
+	// Beats from anyone else can't move the node
+	buf.WriteString(`{"publicKey":"pubKey1","listenPort":41001,"revision":2}`)
+	req, _ = http.NewRequest("POST", "/beat", &buf)
+	req.RemoteAddr = "192.168.1.66:55555"
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.heartBeat).ServeHTTP(rr, req)
+	if n, _ := registry.Get("pubKey1"); n.Endpoint != "192.168.1.20:41000" {
+		t.Errorf("Expected the endpoint WireGuard saw, got %s", n.Endpoint)
+	}
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) string {
+	var event []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error while reading event stream: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(event, "\n")
+		}
+		event = append(event, line)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	streamPingInterval = 50 * time.Millisecond
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	n, _ := registry.Register(&Registration{PublicKey: "pubKey1"})
+	api := HttpApi{Registry: registry, EndpointIPPortPair: "127.0.0.1:8083"}
+	server := httptest.NewServer(http.HandlerFunc(api.events))
+	defer server.Close()
+
+	rsp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"publicKey":"pubKey1","revision":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code %d, want %d", rsp.StatusCode, http.StatusOK)
+	}
+	reader := bufio.NewReader(rsp.Body)
+
+	expectedEvent := "event: membership\ndata: {\"Revision\":1}"
+	if event := readEvent(t, reader); event != expectedEvent {
+		t.Errorf("Unexpected event, got %#v, want %#v", event, expectedEvent)
+	}
+
+	registry.Register(&Registration{PublicKey: "pubKey2"})
+	expectedEvent = `event: membership
+data: {"Revision":2,"Changes":[{"Revision":2,"Peer":{"PublicKey":"pubKey2","VPNIP":"1.1.1.2"}}]}`
+	if event := readEvent(t, reader); event != expectedEvent {
+		t.Errorf("Unexpected event, got %#v, want %#v", event, expectedEvent)
+	}
+
+	atomic.StoreInt64(&n.lastAliveAt, 0)
+	if event := readEvent(t, reader); event != ": ping" {
+		t.Errorf("Expected keepalive, got %#v", event)
+	}
+	if n.LastAliveAt() == 0 {
+		t.Errorf("Expected keepalive to count as a heart beat")
+	}
+
+	registry.Delete("pubKey1")
+	readEvent(t, reader)
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Expected stream to close after node was removed")
+	}
+}
+
+func TestShutdownNotice(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	registry.Register(&Registration{PublicKey: "pubKey1"})
+	api := HttpApi{Registry: registry, EndpointIPPortPair: "127.0.0.1:8083"}
+	server := httptest.NewServer(http.HandlerFunc(api.events))
+	defer server.Close()
+
+	rsp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"publicKey":"pubKey1","revision":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	reader := bufio.NewReader(rsp.Body)
+	readEvent(t, reader)
+
+	api.notifyShutdown()
+	api.notifyShutdown()
+	expectedEvent := "event: shutdown\ndata: {\"Revision\":1,\"ShuttingDown\":true}"
+	if event := readEvent(t, reader); event != expectedEvent {
+		t.Errorf("Unexpected event, got %#v, want %#v", event, expectedEvent)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Expected stream to close after the shutdown notice")
+	}
+
+	req, err := http.NewRequest("POST", "/beat", strings.NewReader(`{"publicKey":"pubKey1","revision":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.heartBeat).ServeHTTP(rr, req)
+	expected := `{"Revision":1,"ShuttingDown":true}`
+	if body := strings.TrimSpace(rr.Body.String()); body != expected {
+		t.Errorf("Unexpected heart beat response, got %s, want %s", body, expected)
+	}
+}
+
+func TestStopDrainsPollingNodes(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	registry.SetStaticPeers([]StaticPeer{{PublicKey: "staticKey"}})
+	registry.Register(&Registration{PublicKey: "leasedKey"})
+	registry.SetExpiry("leasedKey", time.Now().Unix()+3600)
+	var drainTests = []struct {
+		name      string
+		streaming []string
+		polling   []string
+		drains    bool
+	}{
+		{"static and leased nodes", nil, nil, false},
+		{"streaming node", []string{"pubKey1"}, nil, false},
+		{"polling node", []string{"pubKey1"}, []string{"pubKey2"}, true},
+	}
+	for _, tt := range drainTests {
+		for _, key := range append(tt.streaming, tt.polling...) {
+			registry.Register(&Registration{PublicKey: key})
+		}
+		api := HttpApi{Registry: registry, HeartBeatInterval: time.Hour, server: &http.Server{}, running: true}
+		for _, key := range tt.streaming {
+			api.trackStream(key, 1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		api.Stop(ctx)
+		cancel()
+		if drained := time.Since(start) >= 100*time.Millisecond; drained != tt.drains {
+			t.Errorf("%s: expected Stop to wait for polling nodes: %t, waited %s", tt.name, tt.drains, time.Since(start))
+		}
+		for _, key := range append(tt.streaming, tt.polling...) {
+			registry.Delete(key)
+		}
+	}
+}
+
+func TestEventStreamUnknownNode(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := HttpApi{Registry: registry}
+	req, err := http.NewRequest("POST", "/events", strings.NewReader(`{"publicKey":"pubKey1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.events).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestRegistrationAdvertisesHeartBeat(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := HttpApi{Registry: registry, HeartBeatInterval: 5 * time.Second, PurgeDeadline: 12 * time.Second}
+
+	req, err := http.NewRequest("POST", "/register", strings.NewReader(`{"publicKey":"pubKey1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+
+	var reply RegistrationReply
+	if err := json.NewDecoder(rr.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.HeartBeatInterval != 5 || reply.HeartBeatGracePeriod != 12 {
+		t.Errorf("Expected heart beat interval 5 and grace period 12, got %d and %d", reply.HeartBeatInterval, reply.HeartBeatGracePeriod)
+	}
+	if api.pingInterval() != 5*time.Second {
+		t.Errorf("Expected stream keepalives every 5s, got %s", api.pingInterval())
+	}
+}
+
+func TestRegistrationNegotiatesGateway(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := &HttpApi{Registry: registry, Gateway: GatewayExit, LANSubnets: []string{"192.168.1.0/24"}, DNS: []string{"192.168.1.1"}}
+
+	var gatewayTests = []struct {
+		requested string
+		gateway   string
+		routes    []string
+		dns       []string
+	}{
+		{"", GatewayExit, []string{"0.0.0.0/0"}, []string{"192.168.1.1"}},
+		{GatewayLAN, GatewayLAN, []string{"192.168.1.0/24"}, nil},
+		{GatewayIsolated, "", nil, nil},
+	}
+	for i, tt := range gatewayTests {
+		body := fmt.Sprintf(`{"publicKey":"pubKey%d","Gateway":"%s"}`, i, tt.requested)
+		req, err := http.NewRequest("POST", "/register", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+
+		var reply RegistrationReply
+		if err := json.NewDecoder(rr.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Gateway != tt.gateway || !reflect.DeepEqual(reply.Routes, tt.routes) || !reflect.DeepEqual(reply.DNS, tt.dns) {
+			t.Errorf("Asking for %q: expected %s mode with routes %v and DNS %v, got %s mode with %v and %v", tt.requested, tt.gateway, tt.routes, tt.dns, reply.Gateway, reply.Routes, reply.DNS)
+		}
+	}
+}
+
+func TestUpdatingSettings(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := HttpApi{Registry: registry, VPNPassword: "old", HeartBeatInterval: 5 * time.Second, PurgeDeadline: 12 * time.Second}
+	api.UpdateSettings("new", 10*time.Second, 30*time.Second)
+
+	var passwordTests = []struct {
+		jsonPayload    string
+		expectedStatus int
+	}{
+		{`{"publicKey":"pubKey1","password":"old"}`, http.StatusForbidden},
+		{`{"publicKey":"pubKey1","password":"new"}`, http.StatusOK},
+	}
+	for _, tt := range passwordTests {
+		req, err := http.NewRequest("POST", "/register", strings.NewReader(tt.jsonPayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Fatalf("Unexpected status code %d for %s, want %d", rr.Code, tt.jsonPayload, tt.expectedStatus)
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		var reply RegistrationReply
+		if err := json.NewDecoder(rr.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.HeartBeatInterval != 10 || reply.HeartBeatGracePeriod != 30 {
+			t.Errorf("Expected updated heart beat interval 10 and grace period 30, got %d and %d", reply.HeartBeatInterval, reply.HeartBeatGracePeriod)
+		}
+	}
+}
+
+func TestRegisteringAsUser(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := HttpApi{Registry: registry, VPNPassword: "shared", Users: map[string]string{"alice": "secret"}}
+
+	var userTests = []struct {
+		jsonPayload    string
+		expectedStatus int
+	}{
+		{`{"publicKey":"pubKey1","user":"alice","password":"shared"}`, http.StatusForbidden},
+		{`{"publicKey":"pubKey1","user":"mallory","password":"secret"}`, http.StatusForbidden},
+		{`{"publicKey":"pubKey1","user":"alice","password":"secret"}`, http.StatusOK},
+		{`{"publicKey":"pubKey2","password":"shared"}`, http.StatusOK},
+	}
+	for _, tt := range userTests {
+		req, err := http.NewRequest("POST", "/register", strings.NewReader(tt.jsonPayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("Unexpected status code %d for %s, want %d", rr.Code, tt.jsonPayload, tt.expectedStatus)
+		}
+	}
+	if n, err := registry.Get("pubKey1"); err != nil || n.User != "alice" {
+		t.Errorf("Expected pubKey1 to be registered as alice, got %+v", n)
+	}
+
+	api.UpdateUsers(nil)
+	req, _ := http.NewRequest("POST", "/register", strings.NewReader(`{"publicKey":"pubKey3","user":"alice","password":"secret"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected removed user to be refused, got status %d", rr.Code)
+	}
+}
+
+func TestRegisteringAdvertisedSubnets(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := HttpApi{Registry: registry, AdvertisableSubnets: []string{"192.168.0.0/16"}}
+
+	var subnetTests = []struct {
+		jsonPayload    string
+		expectedStatus int
+	}{
+		{`{"publicKey":"pubKey1","subnets":["10.0.0.0/8"]}`, http.StatusBadRequest},
+		{`{"publicKey":"pubKey1","subnets":["192.168.50.0/24"]}`, http.StatusOK},
+		{`{"publicKey":"pubKey2","subnets":["192.168.50.128/25"]}`, http.StatusConflict},
+	}
+	for _, tt := range subnetTests {
+		req, err := http.NewRequest("POST", "/register", strings.NewReader(tt.jsonPayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("Unexpected status code %d for %s, want %d", rr.Code, tt.jsonPayload, tt.expectedStatus)
+		}
+	}
+}
+
+func TestPresharedKeys(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakePSKWgControl{presharedKeys: make(map[string]string)})
+	serverPriv, serverPub, _ := GenerateKeyPair()
+	nodePriv, nodePub, _ := GenerateKeyPair()
+	api := HttpApi{Registry: registry, WGServerPublicKey: serverPub, WGServerPrivateKey: serverPriv}
+
+	req, _ := http.NewRequest("POST", "/register", strings.NewReader(fmt.Sprintf(`{"publicKey":%q}`, nodePub)))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+	var reply RegistrationReply
+	if err := json.NewDecoder(rr.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if ValidateKey(reply.PresharedKey) != nil {
+		t.Fatalf("Expected a preshared key in the registration reply, got %q", reply.PresharedKey)
+	}
+
+	registry.rotatePresharedKeys(time.Now().Unix() + 1)
+	req, _ = http.NewRequest("POST", "/beat", strings.NewReader(fmt.Sprintf(`{"publicKey":%q}`, nodePub)))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.heartBeat).ServeHTTP(rr, req)
+	var rsp HeartBeatResponse
+	if err := json.NewDecoder(rr.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.PresharedKey == "" || strings.Contains(rr.Body.String(), reply.PresharedKey) {
+		t.Fatalf("Expected a sealed preshared key in the heart beat response, got %q", rsp.PresharedKey)
+	}
+	psk, err := OpenPresharedKey(rsp.PresharedKey, nodePriv, serverPub)
+	current, _ := registry.PresharedKey(nodePub)
+	if err != nil || psk != current || psk == reply.PresharedKey {
+		t.Errorf("Expected the rotated preshared key %s, got %q (%v)", current, psk, err)
+	}
+
+	control := registry.WgControl.(*FakePSKWgControl)
+	if control.presharedKeys[nodePub] != reply.PresharedKey {
+		t.Fatalf("Expected the old preshared key to stay installed until acknowledged")
+	}
+	req, _ = http.NewRequest("POST", "/beat", strings.NewReader(fmt.Sprintf(`{"publicKey":%q,"presharedKeyFingerprint":%q}`, nodePub, KeyFingerprint(psk))))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.heartBeat).ServeHTTP(rr, req)
+	if control.presharedKeys[nodePub] != psk {
+		t.Errorf("Expected the acknowledged preshared key to be installed, got %q", control.presharedKeys[nodePub])
+	}
+}
+
+func TestMeshPresharedKeys(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakePSKWgControl{presharedKeys: make(map[string]string)})
+	serverPriv, serverPub, _ := GenerateKeyPair()
+	nodePriv, nodePub, _ := GenerateKeyPair()
+	_, peerPub, _ := GenerateKeyPair()
+	registry.Register(&Registration{PublicKey: nodePub})
+	registry.Register(&Registration{PublicKey: peerPub})
+	api := HttpApi{Registry: registry, WGServerPublicKey: serverPub, WGServerPrivateKey: serverPriv, Mesh: true}
+
+	req, _ := http.NewRequest("POST", "/beat", strings.NewReader(fmt.Sprintf(`{"publicKey":%q}`, nodePub)))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.heartBeat).ServeHTTP(rr, req)
+	var rsp HeartBeatResponse
+	if err := json.NewDecoder(rr.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := MeshPresharedKey(serverPriv, peerPub, nodePub)
+	for _, p := range rsp.Peers {
+		if p.PublicKey == nodePub {
+			if p.PresharedKey != "" {
+				t.Errorf("Expected no preshared key for the node itself, got %q", p.PresharedKey)
+			}
+			continue
+		}
+		if psk, err := OpenPresharedKey(p.PresharedKey, nodePriv, serverPub); err != nil || psk != expected {
+			t.Errorf("Expected the pair's preshared key %s sealed for the node, got %q (%v)", expected, psk, err)
+		}
+	}
+	if _, peers := registry.Membership(); peers[0].PresharedKey != "" || peers[1].PresharedKey != "" {
+		t.Errorf("Expected the registry's peers to be left alone, got %+v", peers)
+	}
+}
+
+func TestRekeyingNode(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeRekeyWgControl{FakePSKWgControl: FakePSKWgControl{presharedKeys: make(map[string]string)}})
+	serverPriv, serverPub, _ := GenerateKeyPair()
+	oldPriv, oldPub, _ := GenerateKeyPair()
+	otherPriv, _, _ := GenerateKeyPair()
+	_, newPub, _ := GenerateKeyPair()
+	api := HttpApi{Registry: registry, WGServerPublicKey: serverPub, WGServerPrivateKey: serverPriv}
+	n, _ := registry.Register(&Registration{PublicKey: oldPub})
+
+	forged, _ := SealRekeyProof(newPub, otherPriv, serverPub)
+	proof, _ := SealRekeyProof(newPub, oldPriv, serverPub)
+	var rekeyTests = []struct {
+		name           string
+		api            *HttpApi
+		request        RekeyRequest
+		expectedStatus int
+	}{
+		{"Without server private key", &HttpApi{Registry: registry}, RekeyRequest{oldPub, newPub, proof}, http.StatusNotImplemented},
+		{"Invalid new key", &api, RekeyRequest{oldPub, "newKey", proof}, http.StatusBadRequest},
+		{"Unknown node", &api, RekeyRequest{newPub, oldPub, proof}, http.StatusNotFound},
+		{"Proof sealed by another key", &api, RekeyRequest{oldPub, newPub, forged}, http.StatusForbidden},
+		{"Proof for another new key", &api, RekeyRequest{oldPub, serverPub, proof}, http.StatusForbidden},
+		{"Valid proof", &api, RekeyRequest{oldPub, newPub, proof}, http.StatusNoContent},
+	}
+	for _, tt := range rekeyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req, _ := http.NewRequest("POST", "/rekey", bytes.NewReader(body))
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(tt.api.rekeyNode).ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Unexpected status code %d, want %d: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+		})
+	}
+	if rekeyed, err := registry.Get(newPub); err != nil || rekeyed.VPNIP != n.VPNIP {
+		t.Errorf("Expected node to keep VPN IP %s under its new key, got %+v (%v)", n.VPNIP, rekeyed, err)
+	}
+}
+
+func TestRegisteringWithExhaustedPool(t *testing.T) {
+	ipgen, _ := NewSimpleIPGen("10.24.1.1/30")
+	registry := NewRegistry(ipgen, &FakeWgControl{})
+	registry.Register(&Registration{PublicKey: "pubKey1"})
+	registry.Register(&Registration{PublicKey: "pubKey2"})
+	api := HttpApi{Registry: registry}
+
+	req, err := http.NewRequest("POST", "/register", strings.NewReader(`{"publicKey":"pubKey3"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.registerNode).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status code %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRegisteringLeasedNode(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := &HttpApi{Registry: registry, MaxLease: time.Hour}
+
+	var leaseTests = []struct {
+		name           string
+		api            *HttpApi
+		jsonPayload    string
+		expectedStatus int
+		expectedLease  int
+	}{
+		{"leased", api, `{"publicKey":"pubKey1","lease":600}`, http.StatusOK, 600},
+		{"capped", api, `{"publicKey":"pubKey2","lease":7200}`, http.StatusOK, 3600},
+		{"disabled", &HttpApi{Registry: registry}, `{"publicKey":"pubKey3","lease":600}`, http.StatusBadRequest, 0},
+	}
+	for _, tt := range leaseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/register", strings.NewReader(tt.jsonPayload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(tt.api.registerNode).ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Unexpected status code %d, want %d", rr.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			var reply RegistrationReply
+			if err := json.NewDecoder(rr.Body).Decode(&reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Lease != tt.expectedLease {
+				t.Errorf("Expected lease of %d seconds, got %d", tt.expectedLease, reply.Lease)
+			}
+		})
+	}
+}
+
+func TestProvisioningNode(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	api := HttpApi{Registry: registry, EndpointIPPortPair: "127.0.0.1:8083", WGServerPublicKey: "123", WGServerPeerIP: "1.1.1.254", VPNPassword: "pass", MaxLease: time.Hour}
+
+	var provisionTests = []struct {
+		name           string
+		jsonPayload    string
+		expectedStatus int
+	}{
+		{"provision", `{"password":"pass","lease":600}`, http.StatusOK},
+		{"badPassword", `{"password":"wrong","lease":600}`, http.StatusForbidden},
+		{"noLease", `{"password":"pass"}`, http.StatusBadRequest},
+	}
+	for _, tt := range provisionTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/provision", strings.NewReader(tt.jsonPayload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.provisionNode).ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Unexpected status code %d, want %d", rr.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			var reply ProvisionReply
+			if err := json.NewDecoder(rr.Body).Decode(&reply); err != nil {
+				t.Fatal(err)
+			}
+			n, err := registry.Get(reply.PublicKey)
+			if err != nil || n.ExpiresAt == 0 {
+				t.Errorf("Expected provisioned node to be registered with a lease, got %v (%v)", n, err)
+			}
+			for _, line := range []string{"Address = 1.1.1.1/24", "PublicKey = 123", "Endpoint = 127.0.0.1:8083", "AllowedIPs = 1.1.1.0/24", "PersistentKeepalive = 25"} {
+				if !strings.Contains(reply.Config, line) {
+					t.Errorf("Expected config to contain %q, got:\n%s", line, reply.Config)
+				}
+			}
+		})
+	}
+}
@@ -2,16 +2,27 @@ package wiregate
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 )
 
+var ErrNoIPsLeft = errors.New("Error! No IPs left to lease!")
+
 type IPGenerator interface {
 	LeaseIP() (string, string, error)
+	// LeaseSpecificIP leases the given IP if it's free.
+	LeaseSpecificIP(string) (string, string, error)
 	ReleaseIP(string) error
 }
 
+// IPCounter is implemented by IPGenerators that can tell how many IPs they
+// lease out and how many of those are free.
+type IPCounter interface {
+	IPCounts() (total, free int)
+}
+
 type SimpleIPGen struct {
 	BaseIPCIDR   string
 	BaseIP       string
@@ -87,7 +98,19 @@ func (i *SimpleIPGen) LeaseIP() (string, string, error) {
 			return ip, i.CIDR, nil
 		}
 	}
-	return "", "", fmt.Errorf("Error! No IPs left to lease!")
+	return "", "", ErrNoIPsLeft
+}
+
+func (i *SimpleIPGen) LeaseSpecificIP(ip string) (string, string, error) {
+	leased, ok := i.AvailableIPs[ip]
+	if !ok {
+		return "", "", fmt.Errorf("IP %s not in available IPs!", ip)
+	}
+	if leased {
+		return "", "", fmt.Errorf("IP %s already leased!", ip)
+	}
+	i.AvailableIPs[ip] = true
+	return ip, i.CIDR, nil
 }
 
 func (i *SimpleIPGen) ReleaseIP(ip string) error {
@@ -98,3 +121,13 @@ func (i *SimpleIPGen) ReleaseIP(ip string) error {
 	}
 	return nil
 }
+
+func (i *SimpleIPGen) IPCounts() (int, int) {
+	free := 0
+	for _, leased := range i.AvailableIPs {
+		if !leased {
+			free++
+		}
+	}
+	return len(i.AvailableIPs), free
+}
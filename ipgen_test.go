@@ -76,3 +76,33 @@ func TestReleasingIPs(t *testing.T) {
 		t.Errorf("Expected error when trying to release IP that doesnt exist, but there was no error")
 	}
 }
+
+func TestLeasingSpecificIP(t *testing.T) {
+	ipgen, err := NewSimpleIPGen("192.168.1.2/29")
+	if err != nil {
+		t.Errorf("Error while initializing SimpleIPGen: %s", err)
+	}
+	ip, cidr, err := ipgen.LeaseSpecificIP("192.168.1.4")
+	if err != nil || ip != "192.168.1.4" || cidr != "29" {
+		t.Errorf("Expected to lease 192.168.1.4/29, got %s/%s (%v)", ip, cidr, err)
+	}
+	if _, _, err = ipgen.LeaseSpecificIP("192.168.1.4"); err == nil {
+		t.Errorf("Expected error when leasing an IP twice, but there was no error")
+	}
+	if _, _, err = ipgen.LeaseSpecificIP("10.24.1.1"); err == nil {
+		t.Errorf("Expected error when leasing IP outside the subnet, but there was no error")
+	}
+}
+
+func TestCountingIPs(t *testing.T) {
+	ipgen, err := NewSimpleIPGen("192.168.1.2/29")
+	if err != nil {
+		t.Fatalf("Error while initializing SimpleIPGen: %s", err)
+	}
+	if _, _, err := ipgen.LeaseIP(); err != nil {
+		t.Fatalf("Error while leasing IP: %s", err)
+	}
+	if total, free := ipgen.IPCounts(); total != 6 || free != 5 {
+		t.Errorf("Expected 5 of 6 IPs free, got %d of %d", free, total)
+	}
+}
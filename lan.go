@@ -0,0 +1,152 @@
+package wiregate
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Kernel routing tables read to find the default route, IPv4 first.
+var routeTablePaths = []string{ipv4RouteTablePath, "/proc/net/ipv6_route"}
+
+var ipv4RouteTablePath = "/proc/net/route"
+
+// Route is a route to a subnet in the kernel's IPv4 routing table.
+type Route struct {
+	Interface string
+	Subnet    *net.IPNet
+}
+
+// DefaultRouteInterface returns the interface the default route goes out of,
+// preferring IPv4 to IPv6.
+func DefaultRouteInterface() (string, error) {
+	for _, path := range routeTablePaths {
+		table, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if iface := ParseDefaultRoute(string(table)); iface != "" {
+			return iface, nil
+		}
+	}
+	return "", fmt.Errorf("No default route found, pick the LAN interface with '-interface'")
+}
+
+// ParseDefaultRoute returns the interface of the default route with the
+// lowest metric in /proc/net/route or /proc/net/ipv6_route, or an empty
+// string if there's none.
+func ParseDefaultRoute(table string) string {
+	best, bestMetric := "", uint64(0)
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		var iface, metric string
+		switch {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		case len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000":
+			iface, metric = fields[0], fields[6]
+		// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt Use Flags Iface
+		case len(fields) == 10 && fields[0] == strings.Repeat("0", 32) && fields[1] == "00":
+			iface, metric = fields[9], fields[5]
+		default:
+			continue
+		}
+		// IPv6 has an unreachable default route on lo
+		if iface == "lo" {
+			continue
+		}
+		base := 10
+		if len(fields) == 10 {
+			base = 16
+		}
+		m, err := strconv.ParseUint(metric, base, 64)
+		if err != nil {
+			continue
+		}
+		if best == "" || m < bestMetric {
+			best, bestMetric = iface, m
+		}
+	}
+	return best
+}
+
+// usableAddress tells whether clients on the LAN can reach the server at ip.
+// Link-local IPv6 addresses need a zone, so they aren't.
+func usableAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// InterfaceAddresses returns the usable IPv4 and IPv6 addresses of ifaceName,
+// IPv4 first.
+func InterfaceAddresses(ifaceName string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve local interface %s: %s", ifaceName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get addresses from interface %s: %s", ifaceName, err)
+	}
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		ipnetAddr, ok := addr.(*net.IPNet)
+		if !ok || !usableAddress(ipnetAddr.IP) {
+			continue
+		}
+		if ip4 := ipnetAddr.IP.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else {
+			v6 = append(v6, ipnetAddr.IP)
+		}
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, fmt.Errorf("Interface %s has no usable IPv4 or IPv6 address", ifaceName)
+	}
+	return append(v4, v6...), nil
+}
+
+// LocalRoutes returns the IPv4 routes to subnets, leaving out default routes.
+func LocalRoutes() ([]Route, error) {
+	table, err := ioutil.ReadFile(ipv4RouteTablePath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the routing table: %s", err)
+	}
+	return ParseRoutes(string(table)), nil
+}
+
+// ParseRoutes returns the routes to subnets in /proc/net/route, leaving out
+// default routes.
+func ParseRoutes(table string) []Route {
+	var routes []Route
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[7] == "00000000" {
+			continue
+		}
+		dest, err := parseRouteAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		mask, err := parseRouteAddress(fields[7])
+		if err != nil {
+			continue
+		}
+		routes = append(routes, Route{Interface: fields[0], Subnet: &net.IPNet{IP: dest.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}})
+	}
+	return routes
+}
+
+// parseRouteAddress decodes an address in /proc/net/route, which is in host
+// byte order, little endian on the architectures WireGate runs on.
+func parseRouteAddress(field string) (net.IP, error) {
+	decoded, err := hex.DecodeString(field)
+	if err != nil || len(decoded) != 4 {
+		return nil, fmt.Errorf("Invalid route address %q", field)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(decoded))
+	return ip, nil
+}
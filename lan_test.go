@@ -0,0 +1,62 @@
+package wiregate
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseDefaultRoute(t *testing.T) {
+	var routeTests = []struct {
+		name     string
+		table    string
+		expected string
+	}{
+		{"IPv4", "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+			"eth0\t0002A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+			"wlan0\t00000000\t0102A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n" +
+			"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n", "eth0"},
+		{"IPv6", "00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n" +
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth1\n", "eth1"},
+		{"No default route", "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+			"eth0\t0002A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n", ""},
+	}
+	for _, tt := range routeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if iface := ParseDefaultRoute(tt.table); iface != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, iface)
+			}
+		})
+	}
+}
+
+func TestUsableAddress(t *testing.T) {
+	for ip, usable := range map[string]bool{
+		"192.168.1.10": true,
+		"fd00::10":     true,
+		"2001:db8::1":  true,
+		"127.0.0.1":    false,
+		"fe80::1":      false,
+		"169.254.1.1":  false,
+	} {
+		if usableAddress(net.ParseIP(ip)) != usable {
+			t.Errorf("Expected %s to be usable: %t", ip, usable)
+		}
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	table := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n" +
+		"tun0\t0000000A\t00000000\t0001\t0\t0\t0\t000000FF\t0\t0\t0\n"
+	routes := ParseRoutes(table)
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 routes without the default one, got %v", routes)
+	}
+	if routes[0].Interface != "eth0" || routes[0].Subnet.String() != "192.168.1.0/24" {
+		t.Errorf("Expected 192.168.1.0/24 on eth0, got %s on %s", routes[0].Subnet, routes[0].Interface)
+	}
+	if routes[1].Interface != "tun0" || routes[1].Subnet.String() != "10.0.0.0/8" {
+		t.Errorf("Expected 10.0.0.0/8 on tun0, got %s on %s", routes[1].Subnet, routes[1].Interface)
+	}
+}
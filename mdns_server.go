@@ -1,33 +1,145 @@
 package wiregate
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/ideasynthesis/mdns"
+	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 )
 
 var NewServerFunc = mdns.NewServer
 
+// MDNSProtocolVersion is advertised in the "v" TXT record. It goes up when
+// clients need to tell servers apart that they can't talk to the same way.
+const MDNSProtocolVersion = 1
+
+// Auth modes advertised in the "auth" TXT record.
+const (
+	AuthPassword      = "password"
+	AuthPasswordUsers = "password+users"
+)
+
+// ServiceInfo is what a server advertises about itself in its mDNS TXT
+// records. Capacity and FreeIPs are 0 if the server doesn't know them.
+type ServiceInfo struct {
+	Version     int
+	Description string
+	Network     string
+	Fingerprint string
+	AuthMode    string
+	Capacity    int
+	FreeIPs     int
+	IPv6        bool
+}
+
+// TXTRecords encodes info as key=value TXT records.
+func (i *ServiceInfo) TXTRecords() []string {
+	records := []string{
+		fmt.Sprintf("v=%d", i.Version),
+		"desc=" + i.Description,
+	}
+	if i.Network != "" {
+		records = append(records, "net="+i.Network)
+	}
+	if i.Fingerprint != "" {
+		records = append(records, "fp="+i.Fingerprint)
+	}
+	if i.AuthMode != "" {
+		records = append(records, "auth="+i.AuthMode)
+	}
+	if i.Capacity > 0 {
+		records = append(records, fmt.Sprintf("cap=%d", i.Capacity), fmt.Sprintf("free=%d", i.FreeIPs))
+	}
+	if i.IPv6 {
+		records = append(records, "ipv6=1")
+	}
+	return records
+}
+
+// ParseServiceInfo decodes TXT records made by TXTRecords. Servers that
+// predate them publish only a free-text description, which gets version 0.
+func ParseServiceInfo(records []string) *ServiceInfo {
+	info := &ServiceInfo{}
+	var versioned bool
+	for _, record := range records {
+		if strings.HasPrefix(record, "v=") {
+			versioned = true
+			break
+		}
+	}
+	if !versioned {
+		info.Description = strings.Join(records, ", ")
+		return info
+	}
+	for _, record := range records {
+		kv := strings.SplitN(record, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "v":
+			info.Version, _ = strconv.Atoi(kv[1])
+		case "desc":
+			info.Description = kv[1]
+		case "net":
+			info.Network = kv[1]
+		case "fp":
+			info.Fingerprint = kv[1]
+		case "auth":
+			info.AuthMode = kv[1]
+		case "cap":
+			info.Capacity, _ = strconv.Atoi(kv[1])
+		case "free":
+			info.FreeIPs, _ = strconv.Atoi(kv[1])
+		case "ipv6":
+			info.IPv6 = kv[1] == "1"
+		}
+	}
+	return info
+}
+
+// mdnsZone answers queries for service with TXT records built from info at
+// query time, so they follow the server's free IPs and reloaded settings.
+type mdnsZone struct {
+	mu      sync.Mutex
+	service *mdns.MDNSService
+	info    func() *ServiceInfo
+}
+
+func (z *mdnsZone) Records(q dns.Question) []dns.RR {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.service.TXT = z.info().TXTRecords()
+	return z.service.Records(q)
+}
+
 type MDNSServer struct {
 	server      *mdns.Server
 	hostname    string
 	serviceName string
-	description string
+	info        func() *ServiceInfo
 
-	ip      *net.IP
+	// Every address the service is advertised at, IPv4 and IPv6
+	ips     []net.IP
 	port    int
 	running bool
 }
 
-func NewMDNSServer(description string, ip *net.IP, port int) *MDNSServer {
+// NewMDNSServer advertises the service on port at ips, with TXT records from
+// info, which is called for every query.
+func NewMDNSServer(info func() *ServiceInfo, ips []net.IP, port int) *MDNSServer {
 	hostname, _ := os.Hostname()
 	server := MDNSServer{
 		hostname:    hostname,
 		serviceName: "_wiregate._tcp",
-		description: description,
-		ip:          ip,
+		info:        info,
+		ips:         ips,
 		port:        port,
 		running:     false,
 	}
@@ -35,14 +147,13 @@ func NewMDNSServer(description string, ip *net.IP, port int) *MDNSServer {
 }
 
 func (m *MDNSServer) Start() error {
-	descriptions := []string{m.description}
 	// domain == "", results in ".local"
-	service, err := mdns.NewMDNSService(m.hostname, m.serviceName, "", "", m.port, []net.IP{*m.ip}, descriptions)
+	service, err := mdns.NewMDNSService(m.hostname, m.serviceName, "", "", m.port, m.ips, m.info().TXTRecords())
 	if err != nil {
 		return err
 	}
 	log.Debugf("Starting MDNSServer with config %#v", service)
-	server, err := NewServerFunc(&mdns.Config{Zone: service})
+	server, err := NewServerFunc(&mdns.Config{Zone: &mdnsZone{service: service, info: m.info}})
 	if err != nil {
 		return err
 	}
@@ -2,9 +2,11 @@ package wiregate
 
 import (
 	"net"
+	"reflect"
 	"testing"
 
 	"github.com/ideasynthesis/mdns"
+	"github.com/miekg/dns"
 )
 
 func TestStartingServer(t *testing.T) {
@@ -15,10 +17,12 @@ func TestStartingServer(t *testing.T) {
 	}
 	NewServerFunc = mockMDNSFunc
 
-	ip := net.IPv4(192, 168, 128, 10)
-	serviceDesc := "serviceDescription"
+	ips := []net.IP{net.IPv4(192, 168, 128, 10), net.ParseIP("fd00::10")}
+	info := func() *ServiceInfo {
+		return &ServiceInfo{Version: MDNSProtocolVersion, Description: "serviceDescription"}
+	}
 	port := 9999
-	server := NewMDNSServer(serviceDesc, &ip, port)
+	server := NewMDNSServer(info, ips, port)
 
 	err := server.Start()
 	if err != nil {
@@ -28,3 +32,45 @@ func TestStartingServer(t *testing.T) {
 		t.Errorf("Tried to start server, but 'called' is false")
 	}
 }
+
+func TestServiceInfoRecords(t *testing.T) {
+	info := &ServiceInfo{
+		Version:     MDNSProtocolVersion,
+		Description: "Office = upstairs",
+		Network:     "office",
+		Fingerprint: "0123456789abcdef",
+		AuthMode:    AuthPasswordUsers,
+		Capacity:    253,
+		FreeIPs:     250,
+		IPv6:        true,
+	}
+	if parsed := ParseServiceInfo(info.TXTRecords()); !reflect.DeepEqual(parsed, info) {
+		t.Errorf("Expected %#v after a round trip, got %#v", info, parsed)
+	}
+
+	legacy := ParseServiceInfo([]string{"Wiregate", "free=text"})
+	if expected := (&ServiceInfo{Description: "Wiregate, free=text"}); !reflect.DeepEqual(legacy, expected) {
+		t.Errorf("Expected %#v for an unversioned server, got %#v", expected, legacy)
+	}
+}
+
+func TestZoneRecordsFollowInfo(t *testing.T) {
+	free := 10
+	info := func() *ServiceInfo {
+		return &ServiceInfo{Version: MDNSProtocolVersion, Capacity: 10, FreeIPs: free}
+	}
+	service, err := mdns.NewMDNSService("host", "_wiregate._tcp", "", "", 9999, []net.IP{net.IPv4(192, 168, 128, 10)}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create service: %s", err)
+	}
+	zone := &mdnsZone{service: service, info: info}
+
+	free = 9
+	records := zone.Records(dns.Question{Name: "host._wiregate._tcp.local.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if len(records) != 1 {
+		t.Fatalf("Expected a TXT record, got %v", records)
+	}
+	if parsed := ParseServiceInfo(records[0].(*dns.TXT).Txt); parsed.FreeIPs != 9 {
+		t.Errorf("Expected TXT record with 9 free IPs, got %v", records[0])
+	}
+}
@@ -1,31 +1,163 @@
 package wiregate
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// WgController adds and removes the server's WireGuard peers. AddHost takes
+// a peer's public key, VPN IP and any subnets it routes for.
 type WgController interface {
-	AddHost(string, string) error
+	AddHost(string, string, ...string) error
 	RemoveHost(string) error
 }
 
+// HandshakeReporter is implemented by WgControllers that know when each peer
+// last completed a WireGuard handshake.
+type HandshakeReporter interface {
+	LatestHandshakes() (map[string]int64, error)
+}
+
+// EndpointReporter is implemented by WgControllers that know the endpoint
+// each peer's WireGuard packets last came from.
+type EndpointReporter interface {
+	PeerEndpoints() (map[string]string, error)
+}
+
+// PresharedKeySetter is implemented by WgControllers that can give a peer a
+// WireGuard preshared key.
+type PresharedKeySetter interface {
+	SetPresharedKey(publicKey, presharedKey string) error
+}
+
+// HostReplacer is implemented by WgControllers that can move a peer to a new
+// public key, keeping its preshared key, VPN IP and subnets, without dropping
+// its traffic while the node switches keys. Replacing the new key with the old
+// one again, before the node used it, undoes the move. Moves the node never
+// completes are undone with AbandonRekey.
+type HostReplacer interface {
+	ReplaceHost(oldPublicKey, newPublicKey, presharedKey, peerIP string, subnets ...string) error
+}
+
+// ErrKeyTaken is returned when rekeying a node to a key that's registered.
+var ErrKeyTaken = errors.New("Public key is already registered")
+
+// WireGuard re-handshakes every two minutes while a tunnel carries traffic,
+// so a handshake this recent (in seconds) means the peer is alive.
+const handshakeLivenessWindow = 180
+
 type Node struct {
 	PubKey, VPNIP, CIDR string
+	// Endpoint is the LAN ip:port of the node's WireGuard interface, if known.
+	Endpoint string
+	// ExpiresAt is the unix time a leased node is purged at, regardless of
+	// heart beats. 0 means the node has to keep beating instead.
+	ExpiresAt int64
+	// Static nodes come from the server's config and are never purged.
+	Static bool
+	// User the node registered as, if any, for ACL policies
+	User string
+	// Subnets behind the node that other nodes reach through it
+	Subnets []string
+	// WireGuard preshared key shared with the node, if any. Guarded by the
+	// registry's mutex since it's rotated.
+	PresharedKey      string
+	presharedKeySetAt int64
+	// Rotated preshared key sent to the node but only installed once the
+	// node acknowledges it
+	pendingPresharedKey string
 	lastAliveAt         int64
 }
 
+// StaticPeer is a node configured by the server's operator instead of
+// registering itself. An empty VPNIP leases the next free one.
+type StaticPeer struct {
+	PublicKey string
+	VPNIP     string
+	Subnets   []string
+}
+
+// Registration describes a node asking to join. An empty PreferredIP leases
+// the next free IP, Subnets are the ones the node routes for and a
+// PresharedKey, if set, is installed for the node's peer.
+type Registration struct {
+	PublicKey    string
+	PreferredIP  string
+	User         string
+	Subnets      []string
+	PresharedKey string
+}
+
 func (n *Node) Beat() {
-	n.lastAliveAt = time.Now().Unix()
+	atomic.StoreInt64(&n.lastAliveAt, time.Now().Unix())
+}
+
+func (n *Node) LastAliveAt() int64 {
+	return atomic.LoadInt64(&n.lastAliveAt)
+}
+
+// withKey returns a copy of n under another public key, without its last
+// heart beat.
+func (n *Node) withKey(key string) *Node {
+	return &Node{
+		PubKey:              key,
+		VPNIP:               n.VPNIP,
+		CIDR:                n.CIDR,
+		Endpoint:            n.Endpoint,
+		ExpiresAt:           n.ExpiresAt,
+		User:                n.User,
+		Subnets:             n.Subnets,
+		PresharedKey:        n.PresharedKey,
+		presharedKeySetAt:   n.presharedKeySetAt,
+		pendingPresharedKey: n.pendingPresharedKey,
+	}
+}
+
+// Number of membership changes kept for clients catching up on a revision.
+// Clients that fall further behind receive the full membership instead.
+const changeLogSize = 1024
+
+// MembershipChange records a node joining, leaving or changing its endpoint
+// at a given revision of the registry.
+type MembershipChange struct {
+	Revision uint64
+	Removed  bool `json:",omitempty"`
+	Peer     MeshPeer
+	// The node's user, so removals can be filtered by ACL policy too
+	user string
 }
 
 type Registry struct {
+	mu        sync.Mutex
 	nodes     map[string]*Node
 	IPGen     IPGenerator
 	WgControl WgController
-	purging   chan bool
+	// If set and WgControl is a HandshakeReporter, a recent WireGuard
+	// handshake keeps a node from being purged without heart beats.
+	HandshakeLiveness bool
+	purging           chan bool
+	revision          uint64
+	changes           []MembershipChange
+	// If set and WgControl is a PresharedKeySetter, nodes' preshared keys
+	// are replaced once they're this old. Nodes learn the new key from their
+	// next membership update.
+	PresharedKeyLifetime time.Duration
+	// Who may reach whom, nil lets all peers reach each other. It's
+	// configuredACL with the keys of rekeyed nodes replaced by their current
+	// ones, from renamedKeys.
+	acl           *ACLPolicy
+	configuredACL *ACLPolicy
+	renamedKeys   map[string]string
+	// Notified, without blocking, whenever the revision changes
+	subscribers map[chan struct{}]bool
 }
 
 func NewRegistry(ipgen IPGenerator, control WgController) *Registry {
@@ -34,61 +166,649 @@ func NewRegistry(ipgen IPGenerator, control WgController) *Registry {
 		IPGen:     ipgen,
 		WgControl: control,
 		purging:   make(chan bool),
+
+		subscribers: make(map[chan struct{}]bool),
+		renamedKeys: make(map[string]string),
 	}
 }
 
 func (r *Registry) Get(publicKey string) (*Node, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if n, ok := r.nodes[publicKey]; ok {
 		return n, nil
 	}
 	return nil, fmt.Errorf("Node with pubkey %s not found!", publicKey)
 }
 
-// TODO a way to insert non-expiring keys, like the server ip/key
+// Register adds the node described by reg, leasing it reg.PreferredIP if
+// that's available, eg. so a node re-registering after a purge keeps its IP.
+// Its subnets must not overlap those of other nodes.
+func (r *Registry) Register(reg *Registration) (*Node, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.put(reg, false)
+}
 
-func (r *Registry) Put(publicKey string) (*Node, error) {
+// put adds a node, leasing it reg.PreferredIP if possible. If requireIP is
+// set the node gets that IP or isn't added at all. The caller must hold r.mu.
+func (r *Registry) put(reg *Registration, requireIP bool) (*Node, error) {
+	publicKey, preferredIP := reg.PublicKey, reg.PreferredIP
 	if _, ok := r.nodes[publicKey]; ok {
 		return nil, fmt.Errorf("Node with pubkey %s already exists", publicKey)
 	}
-	ip, cidr, err := r.IPGen.LeaseIP()
+	if err := r.checkSubnets(reg.Subnets); err != nil {
+		return nil, err
+	}
+	var ip, cidr string
+	var err error
+	if preferredIP != "" {
+		ip, cidr, err = r.IPGen.LeaseSpecificIP(preferredIP)
+		if err != nil {
+			if requireIP {
+				return nil, fmt.Errorf("Problem assigning wg ip %s: %w", preferredIP, err)
+			}
+			log.Debugf("Unable to lease preferred IP %s to %s: %s", preferredIP, publicKey, err)
+		}
+	}
+	if ip == "" {
+		ip, cidr, err = r.IPGen.LeaseIP()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Problem assigning wg ip: %s", err)
+		return nil, fmt.Errorf("Problem assigning wg ip: %w", err)
 	}
 	n := Node{
-		PubKey: publicKey,
-		VPNIP:  ip,
-		CIDR:   cidr,
+		PubKey:  publicKey,
+		VPNIP:   ip,
+		CIDR:    cidr,
+		User:    reg.User,
+		Subnets: reg.Subnets,
 	}
 	n.Beat()
-	err = r.WgControl.AddHost(publicKey, ip)
+	err = r.WgControl.AddHost(publicKey, ip, reg.Subnets...)
 	if err != nil {
+		r.IPGen.ReleaseIP(ip)
 		return nil, fmt.Errorf("Problem with WgControl: %s", err)
 	}
+	if reg.PresharedKey != "" {
+		if err := r.setPresharedKey(&n, reg.PresharedKey); err != nil {
+			r.WgControl.RemoveHost(publicKey)
+			r.IPGen.ReleaseIP(ip)
+			return nil, err
+		}
+	}
 	r.nodes[publicKey] = &n
+	r.recordChange(&n, false)
 
 	return &n, nil
 }
 
+// checkSubnets returns an error if any of subnets overlaps another or a
+// subnet a node already routes for. The caller must hold r.mu.
+func (r *Registry) checkSubnets(subnets []string) error {
+	_, err := checkSubnetsAgainst(subnets, r.routedSubnets(nil))
+	return err
+}
+
+// routedSubnets returns the subnets nodes route for, leaving out the nodes
+// in except. The caller must hold r.mu.
+func (r *Registry) routedSubnets(except map[string]bool) []*net.IPNet {
+	var routed []*net.IPNet
+	for key, n := range r.nodes {
+		if except[key] {
+			continue
+		}
+		for _, s := range n.Subnets {
+			if _, subnet, err := net.ParseCIDR(s); err == nil {
+				routed = append(routed, subnet)
+			}
+		}
+	}
+	return routed
+}
+
+// checkSubnetsAgainst returns an error if any of subnets overlaps another or
+// one in taken, and otherwise taken with subnets added.
+func checkSubnetsAgainst(subnets []string, taken []*net.IPNet) ([]*net.IPNet, error) {
+	for _, s := range subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Subnet %q isn't a valid CIDR subnet", s)
+		}
+		for _, other := range taken {
+			if subnetsOverlap(subnet, other) {
+				return nil, fmt.Errorf("%w: %s overlaps %s", ErrSubnetTaken, subnet, other)
+			}
+		}
+		taken = append(taken, subnet)
+	}
+	return taken, nil
+}
+
 func (r *Registry) Delete(publicKey string) error {
-	if _, ok := r.nodes[publicKey]; !ok {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.delete(publicKey)
+}
+
+// delete removes a node. The caller must hold r.mu.
+func (r *Registry) delete(publicKey string) error {
+	n, ok := r.nodes[publicKey]
+	if !ok {
 		return fmt.Errorf("Node with pubkey %s not found!", publicKey)
 	}
 	err := r.WgControl.RemoveHost(publicKey)
 	if err != nil {
 		return fmt.Errorf("Problem with WgControl: %s", err)
 	}
-	ip := r.nodes[publicKey].VPNIP
-	r.IPGen.ReleaseIP(ip)
+	r.IPGen.ReleaseIP(n.VPNIP)
 	// TODO: can this leave in an incosistent state? eg system, registry, ipgen?
 	delete(r.nodes, publicKey)
+	for named, current := range r.renamedKeys {
+		if current == publicKey {
+			delete(r.renamedKeys, named)
+		}
+	}
+	r.recordChange(n, true)
 	return nil
 }
 
+// SetStaticPeers makes peers the registry's static nodes. Static nodes that
+// aren't in peers anymore are removed and ones with a new VPN IP re-added.
+// Nodes that registered themselves with a static peer's key become static.
+// If any of peers can't be added the registry is left as it was.
+func (r *Registry) SetStaticPeers(peers []StaticPeer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wanted := make(map[string]StaticPeer, len(peers))
+	for _, p := range peers {
+		wanted[p.PublicKey] = p
+	}
+	kept := make(map[string]bool)
+	removed := make(map[string]bool)
+	for key, n := range r.nodes {
+		p, ok := wanted[key]
+		if !n.Static && !ok {
+			continue
+		}
+		if ok && (p.VPNIP == "" || p.VPNIP == n.VPNIP) && sameSubnets(p.Subnets, n.Subnets) {
+			kept[key] = true
+		} else {
+			removed[key] = true
+		}
+	}
+	if err := r.checkStaticPeers(peers, kept, removed); err != nil {
+		return err
+	}
+	for key := range kept {
+		r.nodes[key].Static = true
+		r.nodes[key].ExpiresAt = 0
+	}
+	for key := range removed {
+		log.Infof("Removing static peer %s (%s)", key, r.nodes[key].VPNIP)
+		if err := r.delete(key); err != nil {
+			return err
+		}
+	}
+	for _, p := range peers {
+		if _, ok := r.nodes[p.PublicKey]; ok {
+			continue
+		}
+		n, err := r.put(&Registration{PublicKey: p.PublicKey, PreferredIP: p.VPNIP, Subnets: p.Subnets}, true)
+		if err != nil {
+			return fmt.Errorf("Unable to add static peer %s: %w", p.PublicKey, err)
+		}
+		n.Static = true
+		log.Infof("Added static peer %s (%s)", p.PublicKey, n.VPNIP)
+	}
+	return nil
+}
+
+// checkStaticPeers returns an error if any of peers that aren't kept can't be
+// added once the removed nodes are gone. The caller must hold r.mu.
+func (r *Registry) checkStaticPeers(peers []StaticPeer, kept, removed map[string]bool) error {
+	taken := r.routedSubnets(removed)
+	// VPN IPs of the nodes that stay, and of those that free theirs
+	ips := make(map[string]string)
+	freed := make(map[string]bool)
+	for key, n := range r.nodes {
+		if removed[key] {
+			freed[n.VPNIP] = true
+		} else {
+			ips[n.VPNIP] = key
+		}
+	}
+	for _, p := range peers {
+		if kept[p.PublicKey] {
+			continue
+		}
+		var err error
+		if taken, err = checkSubnetsAgainst(p.Subnets, taken); err != nil {
+			return fmt.Errorf("Unable to add static peer %s: %w", p.PublicKey, err)
+		}
+		if p.VPNIP == "" {
+			continue
+		}
+		if key, ok := ips[p.VPNIP]; ok {
+			return fmt.Errorf("Unable to add static peer %s: VPN IP %s is taken by %s", p.PublicKey, p.VPNIP, key)
+		}
+		ips[p.VPNIP] = p.PublicKey
+		if freed[p.VPNIP] {
+			continue
+		}
+		// Only leasing it tells whether IPGen can lease it
+		if _, _, err := r.IPGen.LeaseSpecificIP(p.VPNIP); err != nil {
+			return fmt.Errorf("Unable to add static peer %s: Problem assigning wg ip %s: %w", p.PublicKey, p.VPNIP, err)
+		}
+		r.IPGen.ReleaseIP(p.VPNIP)
+	}
+	return nil
+}
+
+// sameSubnets tells whether a and b hold the same subnets, nil being the same
+// as none.
+func sameSubnets(a, b []string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+// SupportsRekeying tells whether nodes can move to a new public key.
+func (r *Registry) SupportsRekeying() bool {
+	_, ok := r.WgControl.(HostReplacer)
+	return ok
+}
+
+// Rekey moves the node with oldKey to newKey, keeping everything else about
+// it. Other nodes see the old key leave and the new one join. Static nodes
+// keep the key they're configured with. ACL rules naming the old key follow
+// the node to the new one, even after the ACL is set again.
+func (r *Registry) Rekey(oldKey, newKey string) (*Node, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[oldKey]
+	if !ok {
+		return nil, fmt.Errorf("Node with pubkey %s not found!", oldKey)
+	}
+	if n.Static {
+		return nil, fmt.Errorf("Static node %s can't change its key", oldKey)
+	}
+	if _, ok := r.nodes[newKey]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyTaken, newKey)
+	}
+	replacer, ok := r.WgControl.(HostReplacer)
+	if !ok {
+		return nil, fmt.Errorf("WgControl doesn't support rekeying")
+	}
+	if err := replacer.ReplaceHost(oldKey, newKey, n.PresharedKey, n.VPNIP, n.Subnets...); err != nil {
+		return nil, fmt.Errorf("Problem with WgControl: %s", err)
+	}
+	rekeyed := n.withKey(newKey)
+	rekeyed.Beat()
+	delete(r.nodes, oldKey)
+	r.nodes[newKey] = rekeyed
+	r.renameKey(oldKey, newKey)
+	r.recordChange(n, true)
+	r.recordChange(rekeyed, false)
+	return rekeyed, nil
+}
+
+// AbandonRekey moves the node with newKey back to oldKey, after WgControl gave
+// up on the node switching to newKey and kept the peer with oldKey. Other
+// nodes see the new key leave and the old one join again.
+func (r *Registry) AbandonRekey(oldKey, newKey string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[newKey]
+	if !ok {
+		// Removed while rekeying, so the old peer has to go too
+		if err := r.WgControl.RemoveHost(oldKey); err != nil {
+			log.Errorf("Unable to remove peer %s of a removed node: %s", oldKey, err)
+		}
+		return
+	}
+	if _, ok := r.nodes[oldKey]; ok {
+		log.Errorf("Unable to move node %s back to pubkey %s, which is registered again", n.VPNIP, oldKey)
+		return
+	}
+	restored := n.withKey(oldKey)
+	atomic.StoreInt64(&restored.lastAliveAt, n.LastAliveAt())
+	delete(r.nodes, newKey)
+	r.nodes[oldKey] = restored
+	r.renameKey(newKey, oldKey)
+	r.recordChange(n, true)
+	r.recordChange(restored, false)
+	log.Infof("Moved node %s back to pubkey %s, as it didn't switch to %s", n.VPNIP, oldKey, newKey)
+}
+
+// renameKey points ACL rules naming oldKey, or the key a node had before it
+// became oldKey, at newKey. The caller must hold r.mu.
+func (r *Registry) renameKey(oldKey, newKey string) {
+	named := oldKey
+	for original, current := range r.renamedKeys {
+		if current == oldKey {
+			named = original
+		}
+	}
+	if named == newKey {
+		delete(r.renamedKeys, named)
+	} else {
+		r.renamedKeys[named] = newKey
+	}
+	r.acl = r.configuredACL.withRenamedKeys(r.renamedKeys)
+}
+
+// IPCounts returns how many IPs the registry can lease and how many are still
+// free. ok is false if its IPGenerator can't count them.
+func (r *Registry) IPCounts() (total, free int, ok bool) {
+	counter, ok := r.IPGen.(IPCounter)
+	if !ok {
+		return 0, 0, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total, free = counter.IPCounts()
+	return total, free, true
+}
+
+// SupportsPresharedKeys tells whether nodes can be given preshared keys.
+func (r *Registry) SupportsPresharedKeys() bool {
+	_, ok := r.WgControl.(PresharedKeySetter)
+	return ok
+}
+
+// PresharedKey returns the preshared key a node should use, empty if it has
+// none. That's the rotated key while the node hasn't acknowledged it yet.
+func (r *Registry) PresharedKey(publicKey string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[publicKey]
+	if !ok {
+		return "", fmt.Errorf("Node with pubkey %s not found!", publicKey)
+	}
+	if n.pendingPresharedKey != "" {
+		return n.pendingPresharedKey, nil
+	}
+	return n.PresharedKey, nil
+}
+
+// AcknowledgePresharedKey installs the rotated preshared key of a node once
+// the node reports the fingerprint of it, which it can only know after
+// opening the key. Fingerprints of any other key are ignored.
+func (r *Registry) AcknowledgePresharedKey(publicKey, fingerprint string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[publicKey]
+	if !ok {
+		return fmt.Errorf("Node with pubkey %s not found!", publicKey)
+	}
+	if n.pendingPresharedKey == "" || KeyFingerprint(n.pendingPresharedKey) != fingerprint {
+		return nil
+	}
+	if err := r.setPresharedKey(n, n.pendingPresharedKey); err != nil {
+		return err
+	}
+	n.pendingPresharedKey = ""
+	log.Debugf("Installed the rotated preshared key of %s", publicKey)
+	return nil
+}
+
+// setPresharedKey installs psk for n. The caller must hold r.mu.
+func (r *Registry) setPresharedKey(n *Node, psk string) error {
+	setter, ok := r.WgControl.(PresharedKeySetter)
+	if !ok {
+		return fmt.Errorf("WgControl doesn't support preshared keys")
+	}
+	if err := setter.SetPresharedKey(n.PubKey, psk); err != nil {
+		return fmt.Errorf("Problem with WgControl: %s", err)
+	}
+	n.PresharedKey = psk
+	n.presharedKeySetAt = time.Now().Unix()
+	return nil
+}
+
+// rotatePresharedKeys gives nodes whose preshared keys were set before
+// setBefore new ones. The new key is only sent to the node at first, and the
+// old one stays installed until the node acknowledges the new one, so
+// handshakes keep working in between. Leased nodes keep theirs, since they
+// don't heart beat to learn new ones.
+func (r *Registry) rotatePresharedKeys(setBefore int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rotated := false
+	for key, n := range r.nodes {
+		if n.PresharedKey == "" || n.pendingPresharedKey != "" || n.ExpiresAt != 0 || n.presharedKeySetAt >= setBefore {
+			continue
+		}
+		psk, err := GeneratePresharedKey()
+		if err != nil {
+			log.Errorf("Unable to rotate preshared key of %s: %s", key, err)
+			continue
+		}
+		n.pendingPresharedKey = psk
+		log.Debugf("Rotated preshared key of %s", key)
+		rotated = true
+	}
+	if rotated {
+		r.notify()
+	}
+}
+
+// SetEndpoint updates the WireGuard endpoint a node is reachable at.
+func (r *Registry) SetEndpoint(publicKey, endpoint string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[publicKey]
+	if !ok {
+		return fmt.Errorf("Node with pubkey %s not found!", publicKey)
+	}
+	if n.Endpoint != endpoint {
+		n.Endpoint = endpoint
+		r.recordChange(n, false)
+	}
+	return nil
+}
+
+// LearnEndpoint records the endpoint WireGuard last received the node's
+// packets from, if WgControl is an EndpointReporter. Unlike an endpoint the
+// node reports itself, only the holder of its private key can complete a
+// handshake from there.
+func (r *Registry) LearnEndpoint(publicKey string) {
+	reporter, ok := r.WgControl.(EndpointReporter)
+	if !ok {
+		return
+	}
+	endpoints, err := reporter.PeerEndpoints()
+	if err != nil {
+		log.Errorf("Unable to read WireGuard peer endpoints: %s", err)
+		return
+	}
+	if endpoint := endpoints[publicKey]; endpoint != "" {
+		r.SetEndpoint(publicKey, endpoint)
+	}
+}
+
+// SetExpiry turns a node into a leased node that is purged at expiresAt
+// instead of when its heart beats stop.
+func (r *Registry) SetExpiry(publicKey string, expiresAt int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[publicKey]
+	if !ok {
+		return fmt.Errorf("Node with pubkey %s not found!", publicKey)
+	}
+	n.ExpiresAt = expiresAt
+	return nil
+}
+
+// recordChange bumps the revision and appends to the change log. The caller
+// must hold r.mu.
+func (r *Registry) recordChange(n *Node, removed bool) {
+	r.revision++
+	r.changes = append(r.changes, MembershipChange{
+		Revision: r.revision,
+		Removed:  removed,
+		Peer:     n.meshPeer(),
+		user:     n.User,
+	})
+	if len(r.changes) > changeLogSize {
+		r.changes = append([]MembershipChange(nil), r.changes[len(r.changes)-changeLogSize:]...)
+	}
+	r.notify()
+}
+
+// notify wakes up subscribers. The caller must hold r.mu.
+func (r *Registry) notify() {
+	for ch := range r.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetACL changes the ACL policy. Since it changes which peers nodes see, the
+// change log is dropped so every node receives its full membership again.
+func (r *Registry) SetACL(acl *ACLPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.configuredACL = acl
+	r.acl = acl.withRenamedKeys(r.renamedKeys)
+	r.revision++
+	r.changes = nil
+	r.notify()
+}
+
+// canSee tells whether the node with viewerKey may know about a peer under
+// the ACL policy, an empty viewerKey seeing every peer. The caller must hold
+// r.mu.
+func (r *Registry) canSee(viewerKey, peerKey, peerUser string) bool {
+	if viewerKey == "" || r.acl == nil {
+		return true
+	}
+	viewer, ok := r.nodes[viewerKey]
+	if !ok {
+		return viewerKey == peerKey
+	}
+	return r.acl.CanSee(viewerKey, viewer.User, peerKey, peerUser)
+}
+
+// PeerRules returns the firewall rules enforcing the ACL policy between the
+// registered nodes.
+func (r *Registry) PeerRules() []PeerRule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nodes := make([]*Node, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].VPNIP < nodes[j].VPNIP })
+	return r.acl.PeerRules(nodes)
+}
+
+// Subscribe returns a channel that receives a value after membership changes.
+// Notifications are coalesced, so readers should fetch every change since the
+// last revision they saw. The returned func cancels the subscription.
+func (r *Registry) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	r.mu.Lock()
+	r.subscribers[ch] = true
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		delete(r.subscribers, ch)
+		r.mu.Unlock()
+	}
+}
+
+func (n *Node) meshPeer() MeshPeer {
+	return MeshPeer{
+		PublicKey: n.PubKey,
+		VPNIP:     n.VPNIP,
+		Endpoint:  n.Endpoint,
+		Subnets:   n.Subnets,
+	}
+}
+
+// MembershipSince returns the current revision and the changes made after
+// revision. If those changes are no longer available, or revision is 0 or
+// unknown, ok is false and the caller should send the full membership.
+func (r *Registry) MembershipSince(revision uint64) (current uint64, changes []MembershipChange, ok bool) {
+	return r.MembershipSinceFor("", revision)
+}
+
+// MembershipSinceFor is MembershipSince leaving out the changes to peers the
+// node with viewerKey may not see.
+func (r *Registry) MembershipSinceFor(viewerKey string, revision uint64) (current uint64, changes []MembershipChange, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if revision == 0 || revision > r.revision {
+		return r.revision, nil, false
+	}
+	if revision == r.revision {
+		return r.revision, []MembershipChange{}, true
+	}
+	if len(r.changes) == 0 || r.changes[0].Revision > revision+1 {
+		return r.revision, nil, false
+	}
+	start := len(r.changes) - int(r.revision-revision)
+	changes = make([]MembershipChange, 0, len(r.changes)-start)
+	for _, c := range r.changes[start:] {
+		if r.canSee(viewerKey, c.Peer.PublicKey, c.user) {
+			changes = append(changes, c)
+		}
+	}
+	return r.revision, changes, true
+}
+
+// Membership returns the current revision along with all registered nodes.
+func (r *Registry) Membership() (uint64, []MeshPeer) {
+	return r.MembershipFor("")
+}
+
+// MembershipFor is Membership leaving out the peers the node with viewerKey
+// may not see.
+func (r *Registry) MembershipFor(viewerKey string) (uint64, []MeshPeer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peers := make([]MeshPeer, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		if r.canSee(viewerKey, n.PubKey, n.User) {
+			peers = append(peers, n.meshPeer())
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].VPNIP < peers[j].VPNIP })
+	return r.revision, peers
+}
+
+// HeartBeatingNodes returns the keys of the nodes that are purged once their
+// heart beats stop, leaving out static and leased ones.
+func (r *Registry) HeartBeatingNodes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.nodes))
+	for key, n := range r.nodes {
+		if !n.Static && n.ExpiresAt == 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 func (r *Registry) GetRegisteredIPs() []string {
+	return r.RegisteredIPsFor("")
+}
+
+// RegisteredIPsFor returns the VPN IPs of the nodes the node with viewerKey
+// may see.
+func (r *Registry) RegisteredIPsFor(viewerKey string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	registeredIPs := make([]string, 0, len(r.nodes))
 	for _, n := range r.nodes {
-		registeredIPs = append(registeredIPs, n.VPNIP)
+		if r.canSee(viewerKey, n.PubKey, n.User) {
+			registeredIPs = append(registeredIPs, n.VPNIP)
+		}
 	}
+	sort.Strings(registeredIPs)
 	return registeredIPs
 }
 
@@ -99,12 +819,27 @@ func (r *Registry) StartPurging(deadline, interval int) {
 		defer ticker.Stop()
 		for {
 			log.Debug("Purging...")
-			expirationTime := time.Now().Unix() - int64(deadline)
-			for key, node := range r.nodes {
-				if node.lastAliveAt < expirationTime {
-					log.Infof("Havent received beat from %s, purging", key)
-					r.Delete(key)
+			now := time.Now().Unix()
+			expirationTime := now - int64(deadline)
+			handshakes := r.latestHandshakes()
+			handshakeExpiration := now - handshakeLivenessWindow
+			if int64(deadline) > handshakeLivenessWindow {
+				handshakeExpiration = expirationTime
+			}
+			if r.PresharedKeyLifetime > 0 {
+				r.rotatePresharedKeys(now - int64(r.PresharedKeyLifetime/time.Second))
+			}
+			for _, key := range r.leaseExpiredNodes(now) {
+				log.Infof("Lease of %s expired, purging", key)
+				r.Delete(key)
+			}
+			for _, key := range r.expiredNodes(expirationTime) {
+				if handshakes[key] >= handshakeExpiration {
+					log.Debugf("Havent received beat from %s, but its tunnel is alive", key)
+					continue
 				}
+				log.Infof("Havent received beat from %s, purging", key)
+				r.Delete(key)
 			}
 			select {
 			case <-r.purging:
@@ -116,6 +851,48 @@ func (r *Registry) StartPurging(deadline, interval int) {
 	}()
 }
 
+// latestHandshakes returns peers' last handshake times if handshake liveness
+// is enabled and supported, or nil otherwise.
+func (r *Registry) latestHandshakes() map[string]int64 {
+	if !r.HandshakeLiveness {
+		return nil
+	}
+	reporter, ok := r.WgControl.(HandshakeReporter)
+	if !ok {
+		return nil
+	}
+	handshakes, err := reporter.LatestHandshakes()
+	if err != nil {
+		log.Errorf("Unable to check WireGuard handshakes, relying on heart beats only: %s", err)
+		return nil
+	}
+	return handshakes
+}
+
+func (r *Registry) expiredNodes(expirationTime int64) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expired := make([]string, 0)
+	for key, node := range r.nodes {
+		if !node.Static && node.ExpiresAt == 0 && node.LastAliveAt() < expirationTime {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+func (r *Registry) leaseExpiredNodes(now int64) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expired := make([]string, 0)
+	for key, node := range r.nodes {
+		if !node.Static && node.ExpiresAt != 0 && node.ExpiresAt < now {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
 func (r *Registry) StopPurging() {
 	r.purging <- true
 }
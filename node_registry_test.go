@@ -1,6 +1,7 @@
 package wiregate
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -16,12 +17,19 @@ func (f *FakeIPGen) LeaseIP() (string, string, error) {
 	return fmt.Sprintf("1.1.1.%d", f.count), "/24", nil
 }
 
+func (f *FakeIPGen) LeaseSpecificIP(ip string) (string, string, error) {
+	if ip == "1.1.1.99" {
+		return "", "", fmt.Errorf("IP %s already leased!", ip)
+	}
+	return ip, "/24", nil
+}
+
 func (f *FakeIPGen) ReleaseIP(string) error { return nil }
 
 // TODO: replace with mock to asset calls made to it
 type FakeWgControl struct{}
 
-func (f *FakeWgControl) AddHost(key, ip string) error {
+func (f *FakeWgControl) AddHost(key, ip string, subnets ...string) error {
 	return nil
 }
 
@@ -32,19 +40,19 @@ func (f *FakeWgControl) RemoveHost(key string) error {
 func TestGettingNode(t *testing.T) {
 	pubkey := "publicKey1"
 	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
-	n1, err := registry.Put(pubkey)
+	n1, err := registry.Register(&Registration{PublicKey: pubkey})
 	if err != nil {
 		t.Errorf("Problem with creating registry entry: %v", err)
 	}
 
-	_, err = registry.Put(pubkey)
+	_, err = registry.Register(&Registration{PublicKey: pubkey})
 	if err == nil {
 		t.Errorf("Created node with duplicated pubkey!")
 	}
 
 	n2, err := registry.Get(pubkey)
 	if !reflect.DeepEqual(n1, n2) {
-		t.Errorf("Get didnt return the same node as was Put: %+v != %+v", n1, n2)
+		t.Errorf("Get didnt return the same node as was registered: %+v != %+v", n1, n2)
 	}
 
 	noNode, err := registry.Get("pubkey_doesnt_exist")
@@ -56,7 +64,7 @@ func TestGettingNode(t *testing.T) {
 func TestDeletingNode(t *testing.T) {
 	pubkey := "publicKey1"
 	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
-	registry.Put(pubkey)
+	registry.Register(&Registration{PublicKey: pubkey})
 	err := registry.Delete(pubkey)
 	if err != nil {
 		t.Errorf("Problem with deleting node: %v", err)
@@ -78,8 +86,8 @@ func TestGetRegisteredIPs(t *testing.T) {
 	pubkey2 := "publicKey2"
 	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
 
-	n1, _ := registry.Put(pubkey1)
-	n2, _ := registry.Put(pubkey2)
+	n1, _ := registry.Register(&Registration{PublicKey: pubkey1})
+	n2, _ := registry.Register(&Registration{PublicKey: pubkey2})
 	expectedIPs := []string{n1.VPNIP, n2.VPNIP}
 	resultingIPs := registry.GetRegisteredIPs()
 	if len(expectedIPs) != len(resultingIPs) {
@@ -95,9 +103,9 @@ func TestPurgingGoro(t *testing.T) {
 	pubkey2 := "publicKey2"
 	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
 
-	n1, _ := registry.Put(pubkey1)
+	n1, _ := registry.Register(&Registration{PublicKey: pubkey1})
 	n1.lastAliveAt -= 3
-	n2, _ := registry.Put(pubkey2)
+	n2, _ := registry.Register(&Registration{PublicKey: pubkey2})
 	n2.lastAliveAt += 10
 
 	registry.StartPurging(1, 1)
@@ -113,3 +121,455 @@ func TestPurgingGoro(t *testing.T) {
 		t.Errorf("Expected node 2 '%s' to exist, but got %v", pubkey2, n2Node)
 	}
 }
+
+func TestMembershipRevisions(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+
+	n1, _ := registry.Register(&Registration{PublicKey: "publicKey1"})
+	registry.Register(&Registration{PublicKey: "publicKey2"})
+	registry.SetEndpoint("publicKey1", "192.168.1.10:51820")
+	registry.Delete("publicKey2")
+
+	revision, peers := registry.Membership()
+	if revision != 4 {
+		t.Errorf("Expected revision 4, got %d", revision)
+	}
+	expectedPeers := []MeshPeer{{PublicKey: "publicKey1", VPNIP: n1.VPNIP, Endpoint: "192.168.1.10:51820"}}
+	if !reflect.DeepEqual(peers, expectedPeers) {
+		t.Errorf("Peers do not match! Expected %v, got %v", expectedPeers, peers)
+	}
+
+	var revisionTests = []struct {
+		name            string
+		since           uint64
+		expectedOk      bool
+		expectedChanges int
+	}{
+		{"noRevision", 0, false, 0},
+		{"upToDate", 4, true, 0},
+		{"behind", 2, true, 2},
+		{"fromFirst", 1, true, 3},
+		{"unknownRevision", 5, false, 0},
+	}
+	for _, tt := range revisionTests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, changes, ok := registry.MembershipSince(tt.since)
+			if current != revision {
+				t.Errorf("Expected current revision %d, got %d", revision, current)
+			}
+			if ok != tt.expectedOk || len(changes) != tt.expectedChanges {
+				t.Errorf("Expected ok=%v with %d changes, got ok=%v with %v", tt.expectedOk, tt.expectedChanges, ok, changes)
+			}
+		})
+	}
+
+	_, changes, _ := registry.MembershipSince(3)
+	if len(changes) != 1 || !changes[0].Removed || changes[0].Peer.PublicKey != "publicKey2" {
+		t.Errorf("Expected removal of publicKey2, got %v", changes)
+	}
+}
+
+func TestChangeLogTruncation(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	for i := 0; i < changeLogSize+10; i++ {
+		registry.Register(&Registration{PublicKey: fmt.Sprintf("publicKey%d", i)})
+	}
+	if _, _, ok := registry.MembershipSince(5); ok {
+		t.Errorf("Expected revision older than change log to require full membership")
+	}
+	if _, changes, ok := registry.MembershipSince(20); !ok || len(changes) != changeLogSize-10 {
+		t.Errorf("Expected %d changes, got %d (ok=%v)", changeLogSize-10, len(changes), ok)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	updates, unsubscribe := registry.Subscribe()
+
+	registry.Register(&Registration{PublicKey: "publicKey1"})
+	registry.Register(&Registration{PublicKey: "publicKey2"})
+	select {
+	case <-updates:
+	default:
+		t.Errorf("Expected notification after membership change")
+	}
+	select {
+	case <-updates:
+		t.Errorf("Expected notifications to be coalesced")
+	default:
+	}
+
+	unsubscribe()
+	registry.Delete("publicKey1")
+	select {
+	case <-updates:
+		t.Errorf("Received notification after unsubscribing")
+	default:
+	}
+}
+
+type FakeHandshakeWgControl struct {
+	FakeWgControl
+	handshakes map[string]int64
+}
+
+func (f *FakeHandshakeWgControl) LatestHandshakes() (map[string]int64, error) {
+	return f.handshakes, nil
+}
+
+type FakeEndpointWgControl struct {
+	FakeWgControl
+	endpoints map[string]string
+}
+
+func (f *FakeEndpointWgControl) PeerEndpoints() (map[string]string, error) {
+	return f.endpoints, nil
+}
+
+func TestPurgingWithHandshakeLiveness(t *testing.T) {
+	wgControl := &FakeHandshakeWgControl{handshakes: make(map[string]int64)}
+	registry := NewRegistry(&FakeIPGen{}, wgControl)
+	registry.HandshakeLiveness = true
+
+	n1, _ := registry.Register(&Registration{PublicKey: "publicKey1"})
+	n1.lastAliveAt -= 3
+	n2, _ := registry.Register(&Registration{PublicKey: "publicKey2"})
+	n2.lastAliveAt -= 3
+	n3, _ := registry.Register(&Registration{PublicKey: "publicKey3"})
+	n3.lastAliveAt -= 3
+	wgControl.handshakes["publicKey1"] = time.Now().Unix() - 60
+	wgControl.handshakes["publicKey2"] = time.Now().Unix() - handshakeLivenessWindow - 10
+
+	registry.StartPurging(1, 1)
+	time.Sleep(100 * time.Millisecond)
+	registry.StopPurging()
+
+	if _, err := registry.Get("publicKey1"); err != nil {
+		t.Errorf("Expected node with recent handshake to survive purge")
+	}
+	if _, err := registry.Get("publicKey2"); err == nil {
+		t.Errorf("Expected node with stale handshake to be purged")
+	}
+	if _, err := registry.Get("publicKey3"); err == nil {
+		t.Errorf("Expected node without handshake to be purged")
+	}
+}
+
+func TestRegisterPreferringIP(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+
+	n1, err := registry.Register(&Registration{PublicKey: "publicKey1", PreferredIP: "1.1.1.50"})
+	if err != nil || n1.VPNIP != "1.1.1.50" {
+		t.Errorf("Expected node to get preferred IP 1.1.1.50, got %v (%v)", n1, err)
+	}
+	n2, err := registry.Register(&Registration{PublicKey: "publicKey2", PreferredIP: "1.1.1.99"})
+	if err != nil || n2.VPNIP != "1.1.1.1" {
+		t.Errorf("Expected node to fall back to any IP, got %v (%v)", n2, err)
+	}
+}
+
+func TestPurgingLeasedNodes(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+
+	n1, _ := registry.Register(&Registration{PublicKey: "publicKey1"})
+	n1.lastAliveAt -= 30
+	registry.SetExpiry("publicKey1", time.Now().Unix()+60)
+	registry.Register(&Registration{PublicKey: "publicKey2"})
+	registry.SetExpiry("publicKey2", time.Now().Unix()-1)
+
+	registry.StartPurging(1, 1)
+	time.Sleep(100 * time.Millisecond)
+	registry.StopPurging()
+
+	if _, err := registry.Get("publicKey1"); err != nil {
+		t.Errorf("Expected leased node to survive without heart beats")
+	}
+	if _, err := registry.Get("publicKey2"); err == nil {
+		t.Errorf("Expected node with expired lease to be purged")
+	}
+}
+
+func TestSettingStaticPeers(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	registry.Register(&Registration{PublicKey: "dynamicKey"})
+	registry.Register(&Registration{PublicKey: "becomesStatic"})
+
+	err := registry.SetStaticPeers([]StaticPeer{
+		{PublicKey: "staticKey1", VPNIP: "1.1.1.50"},
+		{PublicKey: "staticKey2"},
+		{PublicKey: "becomesStatic"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to set static peers: %v", err)
+	}
+	expected := []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.1.50"}
+	if ips := registry.GetRegisteredIPs(); !reflect.DeepEqual(ips, expected) {
+		t.Errorf("Expected %v to be registered, got %v", expected, ips)
+	}
+
+	for _, key := range []string{"staticKey1", "staticKey2", "becomesStatic"} {
+		n, _ := registry.Get(key)
+		n.lastAliveAt -= 30
+	}
+	registry.StartPurging(1, 1)
+	time.Sleep(100 * time.Millisecond)
+	registry.StopPurging()
+	if n, err := registry.Get("becomesStatic"); err != nil || !n.Static {
+		t.Errorf("Expected static peers to survive without heart beats, got %v (%v)", n, err)
+	}
+
+	err = registry.SetStaticPeers([]StaticPeer{{PublicKey: "staticKey1", VPNIP: "1.1.1.60"}})
+	if err != nil {
+		t.Fatalf("Unable to update static peers: %v", err)
+	}
+	expected = []string{"1.1.1.1", "1.1.1.60"}
+	if ips := registry.GetRegisteredIPs(); !reflect.DeepEqual(ips, expected) {
+		t.Errorf("Expected %v to be registered after reload, got %v", expected, ips)
+	}
+
+	err = registry.SetStaticPeers([]StaticPeer{{PublicKey: "staticKey3", VPNIP: "1.1.1.99"}})
+	if err == nil {
+		t.Errorf("Expected static peer with an unavailable IP to fail")
+	}
+	err = registry.SetStaticPeers([]StaticPeer{{PublicKey: "staticKey3", VPNIP: "1.1.1.1"}})
+	if err == nil {
+		t.Errorf("Expected static peer with another node's IP to fail")
+	}
+	err = registry.SetStaticPeers([]StaticPeer{{PublicKey: "staticKey3", Subnets: []string{"lab"}}})
+	if err == nil {
+		t.Errorf("Expected static peer with an invalid subnet to fail")
+	}
+	if ips := registry.GetRegisteredIPs(); !reflect.DeepEqual(ips, expected) {
+		t.Errorf("Expected failed updates to leave %v registered, got %v", expected, ips)
+	}
+
+	// Static peers without subnets are the same with an empty list of them
+	revision, _ := registry.Membership()
+	err = registry.SetStaticPeers([]StaticPeer{{PublicKey: "staticKey1", VPNIP: "1.1.1.60", Subnets: []string{}}})
+	if err != nil {
+		t.Fatalf("Unable to update static peers: %v", err)
+	}
+	if now, _ := registry.Membership(); now != revision {
+		t.Errorf("Expected the unchanged static peer to be kept, went from revision %d to %d", revision, now)
+	}
+}
+
+func TestMembershipFilteredByACL(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	registry.Register(&Registration{PublicKey: "aliceKey", User: "alice"})
+	registry.Register(&Registration{PublicKey: "bobKey", User: "bob"})
+	registry.Register(&Registration{PublicKey: "carolKey", User: "carol"})
+	revision, _ := registry.Membership()
+
+	registry.SetACL(&ACLPolicy{Rules: []ACLRule{{From: []string{"user:alice"}, To: []string{"user:bob"}}}})
+	if _, _, ok := registry.MembershipSinceFor("bobKey", revision); ok {
+		t.Errorf("Expected a full membership to be required after the policy changed")
+	}
+	_, peers := registry.MembershipFor("bobKey")
+	if len(peers) != 2 || peers[0].PublicKey != "aliceKey" || peers[1].PublicKey != "bobKey" {
+		t.Errorf("Expected bob to see alice and himself, got %+v", peers)
+	}
+	if ips := registry.RegisteredIPsFor("carolKey"); !reflect.DeepEqual(ips, []string{"1.1.1.3"}) {
+		t.Errorf("Expected carol to only see herself, got %v", ips)
+	}
+
+	revision, _ = registry.Membership()
+	registry.Delete("aliceKey")
+	if _, changes, _ := registry.MembershipSinceFor("carolKey", revision); len(changes) != 0 {
+		t.Errorf("Expected carol not to hear about alice leaving, got %+v", changes)
+	}
+	if _, changes, _ := registry.MembershipSinceFor("bobKey", revision); len(changes) != 1 || !changes[0].Removed {
+		t.Errorf("Expected bob to hear about alice leaving, got %+v", changes)
+	}
+
+	expected := []PeerRule{}
+	if rules := registry.PeerRules(); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected no rules once alice left, got %+v", rules)
+	}
+}
+
+func TestRegisteringSubnets(t *testing.T) {
+	registry := NewRegistry(&FakeIPGen{}, &FakeWgControl{})
+	n, err := registry.Register(&Registration{PublicKey: "labKey", Subnets: []string{"192.168.50.0/24"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, peers := registry.Membership(); !reflect.DeepEqual(peers[0].Subnets, []string{"192.168.50.0/24"}) {
+		t.Errorf("Expected subnets to be shared with peers, got %+v", peers[0])
+	}
+	_, err = registry.Register(&Registration{PublicKey: "otherKey", Subnets: []string{"192.168.0.0/16"}})
+	if !errors.Is(err, ErrSubnetTaken) {
+		t.Errorf("Expected overlapping subnet to be refused, got %v", err)
+	}
+	registry.Delete(n.PubKey)
+	if _, err := registry.Register(&Registration{PublicKey: "otherKey", Subnets: []string{"192.168.0.0/16"}}); err != nil {
+		t.Errorf("Expected subnet to be free once its node left, got %s", err)
+	}
+}
+
+type FakePSKWgControl struct {
+	FakeWgControl
+	presharedKeys map[string]string
+}
+
+func (f *FakePSKWgControl) SetPresharedKey(key, psk string) error {
+	f.presharedKeys[key] = psk
+	return nil
+}
+
+func TestRotatingPresharedKeys(t *testing.T) {
+	control := &FakePSKWgControl{presharedKeys: make(map[string]string)}
+	registry := NewRegistry(&FakeIPGen{}, control)
+	if !registry.SupportsPresharedKeys() || NewRegistry(&FakeIPGen{}, &FakeWgControl{}).SupportsPresharedKeys() {
+		t.Fatalf("Expected only WgControllers setting preshared keys to support them")
+	}
+	registry.Register(&Registration{PublicKey: "pubKey1", PresharedKey: "psk1"})
+	registry.Register(&Registration{PublicKey: "leasedKey", PresharedKey: "psk2"})
+	registry.SetExpiry("leasedKey", time.Now().Add(time.Hour).Unix())
+	registry.Register(&Registration{PublicKey: "noPSKKey"})
+	if control.presharedKeys["pubKey1"] != "psk1" {
+		t.Errorf("Expected preshared key to be installed, got %v", control.presharedKeys)
+	}
+
+	updates, unsubscribe := registry.Subscribe()
+	defer unsubscribe()
+	registry.rotatePresharedKeys(time.Now().Unix() + 1)
+	psk, _ := registry.PresharedKey("pubKey1")
+	if psk == "psk1" || ValidateKey(psk) != nil {
+		t.Errorf("Expected a new preshared key, got %q", psk)
+	}
+	if control.presharedKeys["pubKey1"] != "psk1" {
+		t.Errorf("Expected the old preshared key to stay installed until acknowledged, got %q", control.presharedKeys["pubKey1"])
+	}
+	registry.rotatePresharedKeys(time.Now().Unix() + 1)
+	if again, _ := registry.PresharedKey("pubKey1"); again != psk {
+		t.Errorf("Expected an unacknowledged preshared key not to be rotated again, got %q", again)
+	}
+	registry.AcknowledgePresharedKey("pubKey1", KeyFingerprint("psk1"))
+	if control.presharedKeys["pubKey1"] != "psk1" {
+		t.Errorf("Expected acknowledging another key to change nothing, got %q", control.presharedKeys["pubKey1"])
+	}
+	if err := registry.AcknowledgePresharedKey("pubKey1", KeyFingerprint(psk)); err != nil || control.presharedKeys["pubKey1"] != psk {
+		t.Errorf("Expected the acknowledged preshared key to be installed, got %q (%v)", control.presharedKeys["pubKey1"], err)
+	}
+	if current, _ := registry.PresharedKey("pubKey1"); current != psk {
+		t.Errorf("Expected the acknowledged preshared key to be current, got %q", current)
+	}
+	if psk, _ := registry.PresharedKey("leasedKey"); psk != "psk2" {
+		t.Errorf("Expected leased node to keep its preshared key, got %q", psk)
+	}
+	if psk, _ := registry.PresharedKey("noPSKKey"); psk != "" {
+		t.Errorf("Expected node without preshared key not to get one, got %q", psk)
+	}
+	select {
+	case <-updates:
+	default:
+		t.Errorf("Expected subscribers to be told about the rotation")
+	}
+}
+
+type FakeRekeyWgControl struct {
+	FakePSKWgControl
+	replaced []string
+}
+
+func (f *FakeRekeyWgControl) ReplaceHost(oldKey, newKey, psk, ip string, subnets ...string) error {
+	f.replaced = append(f.replaced, oldKey, newKey, psk, ip)
+	return nil
+}
+
+func TestRekeying(t *testing.T) {
+	control := &FakeRekeyWgControl{FakePSKWgControl: FakePSKWgControl{presharedKeys: make(map[string]string)}}
+	registry := NewRegistry(&FakeIPGen{}, control)
+	if !registry.SupportsRekeying() || NewRegistry(&FakeIPGen{}, &FakeWgControl{}).SupportsRekeying() {
+		t.Fatalf("Expected only WgControllers replacing hosts to support rekeying")
+	}
+	old, _ := registry.Register(&Registration{PublicKey: "oldKey", User: "alice", Subnets: []string{"192.168.50.0/24"}, PresharedKey: "psk"})
+	registry.Register(&Registration{PublicKey: "otherKey"})
+	revision, _ := registry.Membership()
+
+	n, err := registry.Rekey("oldKey", "newKey")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n.VPNIP != old.VPNIP || n.User != "alice" || n.PresharedKey != "psk" || !reflect.DeepEqual(n.Subnets, old.Subnets) {
+		t.Errorf("Expected node to keep everything but its key, got %+v", n)
+	}
+	if !reflect.DeepEqual(control.replaced, []string{"oldKey", "newKey", "psk", old.VPNIP}) {
+		t.Errorf("Expected peer to be replaced in WgControl, got %v", control.replaced)
+	}
+	if _, err := registry.Get("oldKey"); err == nil {
+		t.Errorf("Expected old key to be gone")
+	}
+	_, changes, _ := registry.MembershipSince(revision)
+	if len(changes) != 2 || !changes[0].Removed || changes[0].Peer.PublicKey != "oldKey" || changes[1].Peer.PublicKey != "newKey" {
+		t.Errorf("Expected peers to see the old key leave and the new one join, got %+v", changes)
+	}
+
+	if _, err := registry.Rekey("newKey", "otherKey"); !errors.Is(err, ErrKeyTaken) {
+		t.Errorf("Expected rekeying to a registered key to fail with ErrKeyTaken, got %v", err)
+	}
+	if _, err := registry.Rekey("oldKey", "anotherKey"); err == nil {
+		t.Errorf("Expected rekeying an unknown node to fail")
+	}
+	registry.SetStaticPeers([]StaticPeer{{PublicKey: "otherKey"}})
+	if _, err := registry.Rekey("otherKey", "anotherKey"); err == nil {
+		t.Errorf("Expected static nodes to keep their key")
+	}
+}
+
+func TestRekeyingFollowsACL(t *testing.T) {
+	control := &FakeRekeyWgControl{FakePSKWgControl: FakePSKWgControl{presharedKeys: make(map[string]string)}}
+	registry := NewRegistry(&FakeIPGen{}, control)
+	registry.Register(&Registration{PublicKey: "aliceKey"})
+	registry.Register(&Registration{PublicKey: "bobKey"})
+	registry.Register(&Registration{PublicKey: "carolKey"})
+	policy := &ACLPolicy{Rules: []ACLRule{{From: []string{"aliceKey"}, To: []string{"bobKey"}}}}
+	registry.SetACL(policy)
+
+	registry.Rekey("aliceKey", "aliceKey2")
+	registry.Rekey("aliceKey2", "aliceKey3")
+	_, peers := registry.MembershipFor("bobKey")
+	if len(peers) != 2 || peers[0].PublicKey != "aliceKey3" {
+		t.Errorf("Expected bob to still see alice under her new key, got %+v", peers)
+	}
+
+	// Setting the ACL from the config again keeps following the new key
+	registry.SetACL(policy)
+	if ips := registry.RegisteredIPsFor("aliceKey3"); len(ips) != 2 {
+		t.Errorf("Expected alice to still see bob after the ACL was set again, got %v", ips)
+	}
+	if policy.Rules[0].From[0] != "aliceKey" {
+		t.Errorf("Expected the configured ACL to be left alone, got %+v", policy)
+	}
+
+	registry.Delete("aliceKey3")
+	if len(registry.renamedKeys) != 0 {
+		t.Errorf("Expected renamed keys to be forgotten with their node, got %v", registry.renamedKeys)
+	}
+}
+
+func TestAbandoningRekey(t *testing.T) {
+	control := &FakeRekeyWgControl{FakePSKWgControl: FakePSKWgControl{presharedKeys: make(map[string]string)}}
+	registry := NewRegistry(&FakeIPGen{}, control)
+	old, _ := registry.Register(&Registration{PublicKey: "oldKey", PresharedKey: "psk"})
+	registry.SetACL(&ACLPolicy{Rules: []ACLRule{{From: []string{"oldKey"}, To: []string{"otherKey"}}}})
+	registry.Rekey("oldKey", "newKey")
+	revision, _ := registry.Membership()
+
+	registry.AbandonRekey("oldKey", "newKey")
+	n, err := registry.Get("oldKey")
+	if err != nil || n.VPNIP != old.VPNIP || n.PresharedKey != "psk" {
+		t.Errorf("Expected the node back under its old key, got %+v (%v)", n, err)
+	}
+	if _, err := registry.Get("newKey"); err == nil {
+		t.Errorf("Expected the new key to be gone")
+	}
+	if len(registry.renamedKeys) != 0 {
+		t.Errorf("Expected ACL rules to name the old key again, got %v", registry.renamedKeys)
+	}
+	_, changes, _ := registry.MembershipSince(revision)
+	if len(changes) != 2 || !changes[0].Removed || changes[0].Peer.PublicKey != "newKey" || changes[1].Peer.PublicKey != "oldKey" {
+		t.Errorf("Expected peers to see the new key leave and the old one join, got %+v", changes)
+	}
+}
@@ -2,14 +2,21 @@ package wiregate
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 var execCommand = NewCommand
+var execCommandWithInput = NewCommandWithInput
 var lookPath = NewLookPath
-var postUpBase = "iptables -A FORWARD -i %s -j ACCEPT; iptables -A FORWARD -o %s -j ACCEPT; iptables -t nat -A POSTROUTING -o %s -j MASQUERADE"
-var postDownBase = "iptables -D FORWARD -i %s -j ACCEPT; iptables -D FORWARD -o %s -j ACCEPT; iptables -t nat -D POSTROUTING -o %s -j MASQUERADE"
 
 type Commander interface {
 	CombinedOutput() ([]byte, error)
@@ -25,6 +32,13 @@ func NewCommand(cmd string, args ...string) Commander {
 	}
 }
 
+// NewCommandWithInput is NewCommand with input fed to the command's stdin.
+func NewCommandWithInput(input, cmd string, args ...string) Commander {
+	c := exec.Command(cmd, args...)
+	c.Stdin = strings.NewReader(input)
+	return Command{Cmd: c}
+}
+
 func NewLookPath(file string) (string, error) {
 	return exec.LookPath(file)
 }
@@ -44,33 +58,48 @@ type ShellWireguardControl struct {
 	PostDown           string
 	EndpointIPPortPair string
 	EndpointIP         string
+	// Sets up forwarding and NAT for the VPN before PostUp runs, nil leaves
+	// the firewall alone
+	Firewall Firewall
+	// Subnets routed to each peer besides its VPN IP, guarded by routesMu
+	routesMu sync.Mutex
+	routes   map[string][]string
+	// Peers waiting for a handshake to take over from the key they replace,
+	// by new public key, guarded by routesMu
+	replacing map[string]*pendingReplacement
+	// Called with the old and new public key when a replacement is given up
+	// on because the new peer didn't handshake in time
+	ReplaceAbandoned func(oldPubkey, newPubkey string)
 }
 
+// pendingReplacement is a new peer that's waiting to take over oldPubkey's
+// VPN IP and subnets.
+type pendingReplacement struct {
+	oldPubkey string
+	peerIP    string
+	subnets   []string
+	cancel    chan struct{}
+}
+
+// How often ReplaceHost looks for the new peer's handshake, and how long it
+// waits before giving up on it.
+var replaceHandshakePoll = 250 * time.Millisecond
+var replaceHandshakeTimeout = 2 * time.Minute
+
 var getEndpointIPFn = getEndpointIP
 
+// getEndpointIP returns the address clients that aren't told otherwise use to
+// reach the server on ifaceName, its first IPv4 address if it has one.
 func getEndpointIP(ifaceName string) (string, error) {
-	iface, err := net.InterfaceByName(ifaceName)
+	addrs, err := InterfaceAddresses(ifaceName)
 	if err != nil {
-		return "", fmt.Errorf("Unable to resolve local interface %s: %s", ifaceName, err)
-	}
-	addrs, err := iface.Addrs()
-	if err != nil {
-		return "", fmt.Errorf("Unable to get addresses from interface %s: %s", ifaceName, err)
-	}
-	for _, addr := range addrs {
-		if ipnetAddr, ok := addr.(*net.IPNet); ok {
-			if ifaceIPv4 := ipnetAddr.IP.To4(); ifaceIPv4 != nil {
-				return ifaceIPv4.String(), nil
-			}
-		}
+		return "", err
 	}
-	return "", nil
+	return addrs[0].String(), nil
 }
 
 func NewShellWireguardControl(address, subnetIP, subnetCIDR, listenPort, wgIface, iface, privateKeypath string) (*ShellWireguardControl, error) {
 	// TODO simplify initialization, dont use primitive strings
-	postUp := fmt.Sprintf(postUpBase, wgIface, wgIface, iface)
-	postDown := fmt.Sprintf(postDownBase, wgIface, wgIface, iface)
 	endpointIP, err := getEndpointIPFn(iface)
 	if err != nil {
 		return nil, err
@@ -82,10 +111,10 @@ func NewShellWireguardControl(address, subnetIP, subnetCIDR, listenPort, wgIface
 		SubnetCIDR:         subnetCIDR,
 		ListenPort:         listenPort,
 		InterfaceName:      wgIface,
-		PostUp:             postUp,
-		PostDown:           postDown,
-		EndpointIPPortPair: fmt.Sprintf("%s:%s", endpointIP, listenPort),
+		EndpointIPPortPair: net.JoinHostPort(endpointIP, listenPort),
 		EndpointIP:         endpointIP,
+		routes:             make(map[string][]string),
+		replacing:          make(map[string]*pendingReplacement),
 	}
 	return s, nil
 }
@@ -124,10 +153,23 @@ func (s *ShellWireguardControl) CreateInterface() error {
 		return fmt.Errorf("Activating interface failed when calling ip: %s\n%s", err, out)
 	}
 
+	if s.Firewall != nil {
+		if err := s.Firewall.Setup(); err != nil {
+			// Don't leave a VPN interface behind that the firewall doesn't cover
+			ipLinkDelete := execCommand("ip", "link", "delete", "dev", s.InterfaceName, "type", "wireguard")
+			if out, delErr := ipLinkDelete.CombinedOutput(); delErr != nil {
+				return fmt.Errorf("%s\nDeleting interface %s failed too: %s\n%s", err, s.InterfaceName, delErr, out)
+			}
+			return err
+		}
+	}
+
 	// execute postup
-	postUpCmd := execCommand("sh", "-c", s.PostUp)
-	if out, err := postUpCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("Activating interface failed when executing post-up cmd: %s\n%s", err, out)
+	if s.PostUp != "" {
+		postUpCmd := execCommand("sh", "-c", s.PostUp)
+		if out, err := postUpCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Activating interface failed when executing post-up cmd: %s\n%s", err, out)
+		}
 	}
 
 	return nil
@@ -152,30 +194,274 @@ func (s *ShellWireguardControl) DestroyInterface() error {
 		return fmt.Errorf("Command 'wg' not found!")
 	}
 	// ip -4 rule show - wg allowed-ips to see if these change ip -4 rule show results
+	// Every step runs even if an earlier one fails, so as little as possible
+	// is left behind
+	var failures []string
 	ipLinkDelete := execCommand("ip", "link", "delete", "dev", s.InterfaceName, "type", "wireguard")
 	if out, err := ipLinkDelete.CombinedOutput(); err != nil {
-		return fmt.Errorf("Deleting interface %s failed: %s\n%s", s.InterfaceName, err, out)
+		failures = append(failures, fmt.Sprintf("Deleting interface %s failed: %s\n%s", s.InterfaceName, err, out))
 	}
-	postDownCmd := execCommand("sh", "-c", s.PostDown)
-	if out, err := postDownCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("Executing post-down cmd failed: %s\n%s", err, out)
+	if s.PostDown != "" {
+		postDownCmd := execCommand("sh", "-c", s.PostDown)
+		if out, err := postDownCmd.CombinedOutput(); err != nil {
+			failures = append(failures, fmt.Sprintf("Executing post-down cmd failed: %s\n%s", err, out))
+		}
+	}
+	if s.Firewall != nil {
+		if err := s.Firewall.Teardown(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
 	}
-
 	return nil
 }
 
-func (s *ShellWireguardControl) AddHost(pubkey, peerIP string) error {
-	wgSetPeer := execCommand("wg", "set", s.InterfaceName, "peer", pubkey, "allowed-ips", peerIP)
+// AddHost adds a peer reachable at peerIP and routes any subnets behind it
+// through the WireGuard interface.
+func (s *ShellWireguardControl) AddHost(pubkey, peerIP string, subnets ...string) error {
+	allowedIPs := strings.Join(append([]string{peerIP}, subnets...), ",")
+	wgSetPeer := execCommand("wg", "set", s.InterfaceName, "peer", pubkey, "allowed-ips", allowedIPs)
 	if out, err := wgSetPeer.CombinedOutput(); err != nil {
-		return fmt.Errorf("Failed to add peer (%s - %s): %s\n%s", pubkey, peerIP, err, out)
+		return fmt.Errorf("Failed to add peer (%s - %s): %s\n%s", pubkey, allowedIPs, err, out)
+	}
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	for _, subnet := range subnets {
+		addRoute := execCommand("ip", "route", "replace", subnet, "dev", s.InterfaceName)
+		if out, err := addRoute.CombinedOutput(); err != nil {
+			s.removeRoutes(subnets)
+			execCommand("wg", "set", s.InterfaceName, "peer", pubkey, "remove").CombinedOutput()
+			return fmt.Errorf("Failed to route %s to peer %s: %s\n%s", subnet, pubkey, err, out)
+		}
+	}
+	if len(subnets) > 0 {
+		s.routes[pubkey] = subnets
 	}
 	return nil
 }
 
+// RemoveHost removes a peer, and the one it's replacing if it hasn't taken
+// over from it yet.
 func (s *ShellWireguardControl) RemoveHost(pubkey string) error {
-	wgSetPeerRemove := execCommand("wg", "set", s.InterfaceName, "peer", pubkey, "remove")
+	args := []string{"set", s.InterfaceName, "peer", pubkey, "remove"}
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	p, replacing := s.replacing[pubkey]
+	if replacing {
+		args = append(args, "peer", p.oldPubkey, "remove")
+	}
+	wgSetPeerRemove := execCommand("wg", args...)
 	if out, err := wgSetPeerRemove.CombinedOutput(); err != nil {
 		return fmt.Errorf("Failed to removed peer (%s): %s\n%s", pubkey, err, out)
 	}
+	if replacing {
+		delete(s.replacing, pubkey)
+		close(p.cancel)
+		pubkey = p.oldPubkey
+	}
+	s.removeRoutes(s.routes[pubkey])
+	delete(s.routes, pubkey)
+	return nil
+}
+
+// SetPresharedKey gives an existing peer a preshared key, which 'wg' only
+// reads from a file.
+func (s *ShellWireguardControl) SetPresharedKey(pubkey, psk string) error {
+	pskPath, err := writePresharedKey(psk)
+	if err != nil {
+		return fmt.Errorf("Failed to write preshared key for peer %s: %s", pubkey, err)
+	}
+	defer os.Remove(pskPath)
+	wgSetPSK := execCommand("wg", "set", s.InterfaceName, "peer", pubkey, "preshared-key", pskPath)
+	if out, err := wgSetPSK.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to set preshared key for peer %s: %s\n%s", pubkey, err, out)
+	}
+	return nil
+}
+
+// ReplaceHost moves a peer to a new public key without dropping its traffic.
+// The new peer is added next to the old one, with the old one's endpoint and
+// no allowed IPs, while the old one keeps carrying traffic until the node
+// switches keys. Once the new peer handshakes it takes over the VPN IP and
+// subnets in a single 'wg set' that removes the old one. Replacing the new key
+// with the old one before that happens calls the switch off, and so does the
+// new peer not handshaking within replaceHandshakeTimeout, after which
+// ReplaceAbandoned is called.
+func (s *ShellWireguardControl) ReplaceHost(oldPubkey, newPubkey, psk, peerIP string, subnets ...string) error {
+	s.routesMu.Lock()
+	if p, ok := s.replacing[oldPubkey]; ok && p.oldPubkey == newPubkey {
+		delete(s.replacing, oldPubkey)
+		close(p.cancel)
+		s.routesMu.Unlock()
+		if out, err := execCommand("wg", "set", s.InterfaceName, "peer", oldPubkey, "remove").CombinedOutput(); err != nil {
+			return fmt.Errorf("Failed to remove replacement peer %s: %s\n%s", oldPubkey, err, out)
+		}
+		return nil
+	}
+	s.routesMu.Unlock()
+	args := []string{"set", s.InterfaceName, "peer", newPubkey}
+	if endpoint := s.peerEndpoint(oldPubkey); endpoint != "" {
+		args = append(args, "endpoint", endpoint)
+	}
+	if psk != "" {
+		pskPath, err := writePresharedKey(psk)
+		if err != nil {
+			return fmt.Errorf("Failed to write preshared key for peer %s: %s", newPubkey, err)
+		}
+		defer os.Remove(pskPath)
+		args = append(args, "preshared-key", pskPath)
+	}
+	if out, err := execCommand("wg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to add peer %s to replace %s: %s\n%s", newPubkey, oldPubkey, err, out)
+	}
+	p := &pendingReplacement{oldPubkey: oldPubkey, peerIP: peerIP, subnets: subnets, cancel: make(chan struct{})}
+	s.routesMu.Lock()
+	s.replacing[newPubkey] = p
+	s.routesMu.Unlock()
+	go s.finishReplacing(newPubkey, p, replaceHandshakePoll, replaceHandshakeTimeout)
 	return nil
 }
+
+// finishReplacing hands the old peer's VPN IP and subnets to newPubkey once
+// it handshakes, or gives up on it after timeout.
+func (s *ShellWireguardControl) finishReplacing(newPubkey string, p *pendingReplacement, poll, timeout time.Duration) {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	handshook := func() bool {
+		handshakes, err := s.LatestHandshakes()
+		return err == nil && handshakes[newPubkey] > 0
+	}
+	for waiting := true; waiting; {
+		select {
+		case <-p.cancel:
+			return
+		case <-deadline.C:
+			if !handshook() {
+				s.abandonReplacing(newPubkey, p)
+				return
+			}
+			waiting = false
+		case <-ticker.C:
+			waiting = !handshook()
+		}
+	}
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	if s.replacing[newPubkey] != p {
+		return
+	}
+	delete(s.replacing, newPubkey)
+	allowedIPs := strings.Join(append([]string{p.peerIP}, p.subnets...), ",")
+	wgSwap := execCommand("wg", "set", s.InterfaceName, "peer", newPubkey, "allowed-ips", allowedIPs, "peer", p.oldPubkey, "remove")
+	if out, err := wgSwap.CombinedOutput(); err != nil {
+		log.Errorf("Failed to replace peer %s with %s: %s\n%s", p.oldPubkey, newPubkey, err, out)
+		return
+	}
+	// The routes to its subnets go through the interface, not the peer
+	if routes, ok := s.routes[p.oldPubkey]; ok {
+		s.routes[newPubkey] = routes
+		delete(s.routes, p.oldPubkey)
+	}
+}
+
+// abandonReplacing removes newPubkey, which never handshook, and leaves the
+// old peer carrying the node's traffic.
+func (s *ShellWireguardControl) abandonReplacing(newPubkey string, p *pendingReplacement) {
+	s.routesMu.Lock()
+	if s.replacing[newPubkey] != p {
+		s.routesMu.Unlock()
+		return
+	}
+	delete(s.replacing, newPubkey)
+	s.routesMu.Unlock()
+	log.Warnf("Peer %s didn't handshake in time to replace %s, keeping the old peer", newPubkey, p.oldPubkey)
+	if out, err := execCommand("wg", "set", s.InterfaceName, "peer", newPubkey, "remove").CombinedOutput(); err != nil {
+		log.Errorf("Failed to remove replacement peer %s: %s\n%s", newPubkey, err, out)
+	}
+	// Called without routesMu, as the registry calls back into s
+	if s.ReplaceAbandoned != nil {
+		s.ReplaceAbandoned(p.oldPubkey, newPubkey)
+	}
+}
+
+// peerEndpoint returns the endpoint WireGuard last saw a peer at, empty if
+// there's none or it can't be read.
+func (s *ShellWireguardControl) peerEndpoint(pubkey string) string {
+	endpoints, _ := s.PeerEndpoints()
+	return endpoints[pubkey]
+}
+
+// PeerEndpoints returns the endpoint WireGuard last received each peer's
+// packets from, leaving out peers it hasn't heard from.
+func (s *ShellWireguardControl) PeerEndpoints() (map[string]string, error) {
+	out, err := execCommand("wg", "show", s.InterfaceName, "endpoints").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s\n%s", err, out)
+	}
+	endpoints := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] != "(none)" {
+			endpoints[fields[0]] = fields[1]
+		}
+	}
+	return endpoints, nil
+}
+
+// writePresharedKey writes psk to a temporary file for 'wg' to read, which
+// the caller removes.
+func writePresharedKey(psk string) (string, error) {
+	pskFile, err := ioutil.TempFile("", "wiregate-psk")
+	if err != nil {
+		return "", err
+	}
+	_, err = pskFile.WriteString(psk)
+	if closeErr := pskFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(pskFile.Name())
+		return "", err
+	}
+	return pskFile.Name(), nil
+}
+
+// removeRoutes deletes the routes to subnets, which may not all exist. The
+// caller must hold s.routesMu.
+func (s *ShellWireguardControl) removeRoutes(subnets []string) {
+	for _, subnet := range subnets {
+		execCommand("ip", "route", "del", subnet, "dev", s.InterfaceName).CombinedOutput()
+	}
+}
+
+// LatestHandshakes returns the unix time of the last handshake with each peer,
+// 0 meaning there wasn't one yet.
+func (s *ShellWireguardControl) LatestHandshakes() (map[string]int64, error) {
+	wgShow := execCommand("wg", "show", s.InterfaceName, "latest-handshakes")
+	out, err := wgShow.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read latest handshakes: %s\n%s", err, out)
+	}
+	return ParseLatestHandshakes(string(out))
+}
+
+// ParseLatestHandshakes parses the output of 'wg show <iface> latest-handshakes'.
+func ParseLatestHandshakes(out string) (map[string]int64, error) {
+	handshakes := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected handshake timestamp %q: %s", fields[1], err)
+		}
+		handshakes[fields[0]] = ts
+	}
+	return handshakes, nil
+}
@@ -2,8 +2,12 @@ package wiregate
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os/exec"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TODO: Cover cmd failure scenarios
@@ -100,6 +104,180 @@ func TestAddRemoveHost(t *testing.T) {
 	}
 }
 
+func TestAddHostWithSubnets(t *testing.T) {
+	s := createTestServer()
+	calls := recordCommands(nil)
+	if err := s.AddHost("123123", "10.24.99.10", "192.168.50.0/24", "192.168.51.0/24"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := [][]string{
+		{"wg", "set", "wg-interface0", "peer", "123123", "allowed-ips", "10.24.99.10,192.168.50.0/24,192.168.51.0/24"},
+		{"ip", "route", "replace", "192.168.50.0/24", "dev", "wg-interface0"},
+		{"ip", "route", "replace", "192.168.51.0/24", "dev", "wg-interface0"},
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Errorf("Expected %v, got %v", expected, *calls)
+	}
+
+	*calls = nil
+	if err := s.RemoveHost("123123"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = [][]string{
+		{"wg", "set", "wg-interface0", "peer", "123123", "remove"},
+		{"ip", "route", "del", "192.168.50.0/24", "dev", "wg-interface0"},
+		{"ip", "route", "del", "192.168.51.0/24", "dev", "wg-interface0"},
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Errorf("Expected %v, got %v", expected, *calls)
+	}
+
+	// A subnet that can't be routed undoes the whole peer
+	calls = recordCommands(func(args []string) bool { return args[0] == "ip" && args[3] == "192.168.51.0/24" })
+	if err := s.AddHost("123123", "10.24.99.10", "192.168.50.0/24", "192.168.51.0/24"); err == nil {
+		t.Fatalf("Expected routing failure to be reported")
+	}
+	last := (*calls)[len(*calls)-1]
+	if !reflect.DeepEqual(last, []string{"wg", "set", "wg-interface0", "peer", "123123", "remove"}) {
+		t.Errorf("Expected peer to be removed again, last command was %v", last)
+	}
+}
+
+func TestSetPresharedKey(t *testing.T) {
+	s := createTestServer()
+	var pskFileContents string
+	execCommand = func(cmd string, args ...string) Commander {
+		if len(args) == 6 && args[4] == "preshared-key" {
+			contents, _ := ioutil.ReadFile(args[5])
+			pskFileContents = string(contents)
+		}
+		return NewMockCommand(cmd, "", "", args...)
+	}
+	if err := s.SetPresharedKey("123123", "psk"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if pskFileContents != "psk" {
+		t.Errorf("Expected preshared key to be passed in a file, got %q", pskFileContents)
+	}
+}
+
+func TestReplaceHost(t *testing.T) {
+	s := createTestServer()
+	recordCommands(nil)
+	s.AddHost("123123", "10.24.99.10", "192.168.50.0/24")
+	defer func(poll time.Duration) { replaceHandshakePoll = poll }(replaceHandshakePoll)
+	replaceHandshakePoll = time.Millisecond
+	var mu sync.Mutex
+	var calls [][]string
+	var handshake string
+	swapped := make(chan struct{}, 1)
+	execCommand = func(cmd string, args ...string) Commander {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, append([]string{cmd}, args...))
+		switch {
+		case args[0] == "show" && args[2] == "endpoints":
+			return NewMockCommand(cmd, "123123\t192.168.1.20:51820\n456456\t(none)\n", "", args...)
+		case args[0] == "show":
+			return NewMockCommand(cmd, "123123\t1600000000\n789789\t"+handshake+"\n", "", args...)
+		case len(args) > 5 && args[4] == "allowed-ips":
+			swapped <- struct{}{}
+		}
+		return NewMockCommand(cmd, "", "", args...)
+	}
+	lastCall := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls[len(calls)-1]
+	}
+
+	// The new peer waits next to the old one for its handshake
+	handshake = "0"
+	if err := s.ReplaceHost("123123", "789789", "", "10.24.99.10", "192.168.50.0/24"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []string{"wg", "set", "wg-interface0", "peer", "789789", "endpoint", "192.168.1.20:51820"}
+	mu.Lock()
+	if !reflect.DeepEqual(calls[1], expected) {
+		t.Errorf("Expected the new peer to be added without allowed IPs %v, got %v", expected, calls[1])
+	}
+	handshake = "1600000100"
+	mu.Unlock()
+	select {
+	case <-swapped:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the new peer to take over after its handshake")
+	}
+	expected = []string{"wg", "set", "wg-interface0", "peer", "789789", "allowed-ips", "10.24.99.10,192.168.50.0/24", "peer", "123123", "remove"}
+	if got := lastCall(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected peer to be replaced in one command %v, got %v", expected, got)
+	}
+
+	// The subnet routes now belong to the new peer
+	mu.Lock()
+	calls = nil
+	mu.Unlock()
+	s.RemoveHost("789789")
+	if len(calls) != 2 || calls[1][2] != "del" {
+		t.Errorf("Expected the new peer's routes to be removed with it, ran %v", calls)
+	}
+}
+
+func TestReplaceHostTimeout(t *testing.T) {
+	s := createTestServer()
+	recordCommands(nil)
+	s.AddHost("123123", "10.24.99.10", "192.168.50.0/24")
+	defer func(poll, timeout time.Duration) {
+		replaceHandshakePoll, replaceHandshakeTimeout = poll, timeout
+	}(replaceHandshakePoll, replaceHandshakeTimeout)
+	replaceHandshakePoll, replaceHandshakeTimeout = time.Hour, time.Millisecond
+	abandoned := make(chan []string, 1)
+	s.ReplaceAbandoned = func(oldPubkey, newPubkey string) {
+		abandoned <- []string{oldPubkey, newPubkey}
+	}
+	calls := recordCommands(nil)
+	if err := s.ReplaceHost("123123", "789789", "", "10.24.99.10", "192.168.50.0/24"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	select {
+	case keys := <-abandoned:
+		if !reflect.DeepEqual(keys, []string{"123123", "789789"}) {
+			t.Errorf("Expected the replacement of 123123 by 789789 to be abandoned, got %v", keys)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the replacement to be abandoned without a handshake")
+	}
+	expected := []string{"wg", "set", "wg-interface0", "peer", "789789", "remove"}
+	if got := (*calls)[len(*calls)-1]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected only the new peer to be removed %v, got %v", expected, got)
+	}
+	if len(s.replacing) != 0 || len(s.routes["123123"]) != 1 {
+		t.Errorf("Expected the old peer to keep its routes, got %v and %v", s.replacing, s.routes)
+	}
+}
+
+func TestUndoingReplaceHost(t *testing.T) {
+	s := createTestServer()
+	recordCommands(nil)
+	s.AddHost("123123", "10.24.99.10")
+	defer func(poll time.Duration) { replaceHandshakePoll = poll }(replaceHandshakePoll)
+	replaceHandshakePoll = time.Hour
+	if err := s.ReplaceHost("123123", "789789", "", "10.24.99.10"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	calls := recordCommands(nil)
+	if err := s.ReplaceHost("789789", "123123", "", "10.24.99.10"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := [][]string{{"wg", "set", "wg-interface0", "peer", "789789", "remove"}}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Errorf("Expected only the new peer to be removed %v, got %v", expected, *calls)
+	}
+	if len(s.replacing) != 0 {
+		t.Errorf("Expected the replacement to be called off, got %v", s.replacing)
+	}
+}
+
 func TestCreateDestroyInterface(t *testing.T) {
 	s := createTestServer()
 	var interfaceTests = []struct {
@@ -135,3 +313,69 @@ func TestCreateDestroyInterface(t *testing.T) {
 		})
 	}
 }
+
+func TestInterfaceCleanupOnFailure(t *testing.T) {
+	s := createTestServer()
+	s.Firewall = newIptablesFirewall(testFirewallConfig)
+	defer func() { s.Firewall = nil }()
+	lookPath = func(file string) (string, error) {
+		return "/some/path", nil
+	}
+
+	// Firewall rules go even if the interface is already gone
+	calls := recordCommands(func(args []string) bool { return args[0] == "ip" })
+	if err := s.DestroyInterface(); err == nil {
+		t.Errorf("Expected the failed interface deletion to be reported")
+	}
+	ranTeardown := false
+	for _, call := range *calls {
+		ranTeardown = ranTeardown || call[0] == "iptables"
+	}
+	if !ranTeardown {
+		t.Errorf("Expected the firewall rules to be removed anyway, ran %v", *calls)
+	}
+
+	// The interface goes if its firewall rules can't be set up
+	calls = recordCommands(func(args []string) bool { return args[0] == "iptables" })
+	if err := s.CreateInterface(); err == nil {
+		t.Errorf("Expected the firewall setup failure to be reported")
+	}
+	expected := []string{"ip", "link", "delete", "dev", "wg-interface0", "type", "wireguard"}
+	if last := (*calls)[len(*calls)-1]; !reflect.DeepEqual(last, expected) {
+		t.Errorf("Expected the interface to be deleted %v, got %v", expected, last)
+	}
+}
+
+func TestLatestHandshakes(t *testing.T) {
+	s := createTestServer()
+	execCommand = func(cmd string, args ...string) Commander {
+		return NewMockCommand(cmd, "key1=\t1600000000\nkey2=\t0\n", "", args...)
+	}
+	handshakes, err := s.LatestHandshakes()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]int64{"key1=": 1600000000, "key2=": 0}
+	if !reflect.DeepEqual(handshakes, expected) {
+		t.Errorf("Expected handshakes %v, got %v", expected, handshakes)
+	}
+
+	if _, err := ParseLatestHandshakes("key1=\tyesterday\n"); err == nil {
+		t.Errorf("Expected error for malformed timestamp")
+	}
+}
+
+func TestPeerEndpoints(t *testing.T) {
+	s := createTestServer()
+	execCommand = func(cmd string, args ...string) Commander {
+		return NewMockCommand(cmd, "key1=\t192.168.1.20:41000\nkey2=\t(none)\n", "", args...)
+	}
+	endpoints, err := s.PeerEndpoints()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]string{"key1=": "192.168.1.20:41000"}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints %v, got %v", expected, endpoints)
+	}
+}
@@ -0,0 +1,86 @@
+package wiregate
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrSubnetTaken is returned when a node advertises a subnet that overlaps
+// one another node already routes for.
+var ErrSubnetTaken = errors.New("Subnet already routed through another node")
+
+// ErrSubnetNotAllowed is returned when a node advertises a subnet the server
+// doesn't let nodes route for.
+var ErrSubnetNotAllowed = errors.New("Subnet not allowed")
+
+// subnetsOverlap tells whether a and b share any address.
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// CheckAdvertisedSubnets returns an error wrapping ErrSubnetNotAllowed unless
+// every subnet lies within one of allowed.
+func CheckAdvertisedSubnets(subnets, allowed []string) error {
+	for _, s := range subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil || subnet.String() != s {
+			return fmt.Errorf("%w: %q isn't a CIDR subnet like 192.168.50.0/24", ErrSubnetNotAllowed, s)
+		}
+		within := false
+		for _, a := range allowed {
+			_, allowedSubnet, err := net.ParseCIDR(a)
+			if err != nil {
+				continue
+			}
+			ones, _ := subnet.Mask.Size()
+			allowedOnes, _ := allowedSubnet.Mask.Size()
+			if allowedSubnet.Contains(subnet.IP) && ones >= allowedOnes && len(subnet.IP) == len(allowedSubnet.IP) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			return fmt.Errorf("%w: %s isn't within the subnets nodes may route for", ErrSubnetNotAllowed, s)
+		}
+	}
+	return nil
+}
+
+// VPN subnets picked from a pool have room for 253 nodes.
+const pooledSubnetPrefix = 24
+
+// FreeSubnet returns the first /24 within the IPv4 subnets of pool that
+// overlaps none of taken.
+func FreeSubnet(pool []string, taken []*net.IPNet) (*net.IPNet, error) {
+	mask := net.CIDRMask(pooledSubnetPrefix, 32)
+	for _, p := range pool {
+		_, block, err := net.ParseCIDR(p)
+		if err != nil || block.IP.To4() == nil {
+			return nil, fmt.Errorf("Subnet pool entry %q isn't an IPv4 CIDR subnet", p)
+		}
+		ones, _ := block.Mask.Size()
+		if ones > pooledSubnetPrefix {
+			return nil, fmt.Errorf("Subnet pool entry %s is smaller than a /%d", p, pooledSubnetPrefix)
+		}
+		start := binary.BigEndian.Uint32(block.IP.To4())
+		for i := uint32(0); i < 1<<uint(pooledSubnetPrefix-ones); i++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, start+i<<(32-pooledSubnetPrefix))
+			candidate := &net.IPNet{IP: ip, Mask: mask}
+			free := true
+			for _, t := range taken {
+				if subnetsOverlap(candidate, t) {
+					free = false
+					break
+				}
+			}
+			if free {
+				return candidate, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Every /%d in %s overlaps a route or subnet in use", pooledSubnetPrefix, strings.Join(pool, ", "))
+}
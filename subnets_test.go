@@ -0,0 +1,66 @@
+package wiregate
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckAdvertisedSubnets(t *testing.T) {
+	allowed := []string{"192.168.0.0/16", "172.16.5.0/24"}
+	var subnetTests = []struct {
+		subnets []string
+		valid   bool
+	}{
+		{nil, true},
+		{[]string{"192.168.50.0/24", "172.16.5.0/24"}, true},
+		{[]string{"192.168.50.0/24", "10.0.0.0/8"}, false},
+		{[]string{"172.16.0.0/16"}, false},
+		{[]string{"192.168.50.1/24"}, false},
+		{[]string{"lab"}, false},
+	}
+	for _, tt := range subnetTests {
+		err := CheckAdvertisedSubnets(tt.subnets, allowed)
+		if tt.valid && err != nil {
+			t.Errorf("Expected %v to be allowed, got %s", tt.subnets, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrSubnetNotAllowed) {
+			t.Errorf("Expected %v not to be allowed, got %v", tt.subnets, err)
+		}
+	}
+	if err := CheckAdvertisedSubnets([]string{"192.168.50.0/24"}, nil); err == nil {
+		t.Errorf("Expected no subnets to be allowed without a policy")
+	}
+}
+
+func TestFreeSubnet(t *testing.T) {
+	parse := func(s string) *net.IPNet {
+		_, subnet, _ := net.ParseCIDR(s)
+		return subnet
+	}
+	pool := []string{"10.24.0.0/23", "172.24.0.0/16"}
+	var freeSubnetTests = []struct {
+		taken    []*net.IPNet
+		expected string
+	}{
+		{nil, "10.24.0.0/24"},
+		{[]*net.IPNet{parse("10.24.0.128/25")}, "10.24.1.0/24"},
+		{[]*net.IPNet{parse("10.0.0.0/8")}, "172.24.0.0/24"},
+		{[]*net.IPNet{parse("10.0.0.0/8"), parse("172.16.0.0/12")}, ""},
+	}
+	for _, tt := range freeSubnetTests {
+		subnet, err := FreeSubnet(pool, tt.taken)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("Expected no free subnet when %v are taken, got %s", tt.taken, subnet)
+			}
+			continue
+		}
+		if err != nil || subnet.String() != tt.expected {
+			t.Errorf("Expected %s when %v are taken, got %v (%v)", tt.expected, tt.taken, subnet, err)
+		}
+	}
+	if _, err := FreeSubnet([]string{"10.24.1.0/25"}, nil); err == nil {
+		t.Errorf("Expected pool entries smaller than a /24 to be refused")
+	}
+}
@@ -0,0 +1,171 @@
+package wiregate
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// GenerateKeyPair returns a base64 encoded WireGuard private and public key,
+// like 'wg genkey' and 'wg pubkey' would.
+func GenerateKeyPair() (string, string, error) {
+	var privKey [32]byte
+	if _, err := rand.Read(privKey[:]); err != nil {
+		return "", "", fmt.Errorf("Error while generating private key: %s", err)
+	}
+	// Clamp the key as described in RFC 7748
+	privKey[0] &= 248
+	privKey[31] = (privKey[31] & 127) | 64
+	encodedPrivKey := base64.StdEncoding.EncodeToString(privKey[:])
+	pubKey, err := PublicKey(encodedPrivKey)
+	if err != nil {
+		return "", "", err
+	}
+	return encodedPrivKey, pubKey, nil
+}
+
+// KeyFingerprint shortens a base64 encoded WireGuard public key to 16 hex
+// digits of its SHA-256 hash, short enough to compare by eye.
+func KeyFingerprint(pubKey string) string {
+	decoded, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(decoded)
+	return hex.EncodeToString(sum[:8])
+}
+
+// PublicKey derives the base64 encoded public key of a WireGuard private key.
+func PublicKey(privKey string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(privKey)
+	if err != nil || len(decoded) != 32 {
+		return "", fmt.Errorf("Invalid WireGuard private key")
+	}
+	var scalar, pubKey [32]byte
+	copy(scalar[:], decoded)
+	curve25519.ScalarBaseMult(&pubKey, &scalar)
+	return base64.StdEncoding.EncodeToString(pubKey[:]), nil
+}
+
+// ValidateKey checks that key is a base64 encoded WireGuard key.
+func ValidateKey(key string) error {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return fmt.Errorf("Invalid WireGuard key %q, expected 32 base64 encoded bytes", key)
+	}
+	return nil
+}
+
+// GeneratePresharedKey returns a base64 encoded WireGuard preshared key, like
+// 'wg genpsk' would.
+func GeneratePresharedKey() (string, error) {
+	var psk [32]byte
+	if _, err := rand.Read(psk[:]); err != nil {
+		return "", fmt.Errorf("Error while generating preshared key: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(psk[:]), nil
+}
+
+// MeshPresharedKey derives the preshared key of the direct tunnel between two
+// mesh peers from the server's private key, so the server hands both of them
+// the same key without keeping track of pairs.
+func MeshPresharedKey(serverPrivKey, pubKeyA, pubKeyB string) (string, error) {
+	secret, err := decodeKey(serverPrivKey)
+	if err != nil {
+		return "", err
+	}
+	if pubKeyB < pubKeyA {
+		pubKeyA, pubKeyB = pubKeyB, pubKeyA
+	}
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte("wiregate mesh preshared key\n" + pubKeyA + "\n" + pubKeyB))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func decodeKey(key string) (*[32]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("Invalid WireGuard key")
+	}
+	var k [32]byte
+	copy(k[:], decoded)
+	return &k, nil
+}
+
+// SealPresharedKey encrypts psk so only the owner of recipientPubKey can read
+// it, and can tell it came from the owner of senderPrivKey. WireGuard keys
+// are Curve25519 keys, so they double as NaCl box keys.
+func SealPresharedKey(psk, senderPrivKey, recipientPubKey string) (string, error) {
+	return seal(psk, senderPrivKey, recipientPubKey)
+}
+
+// OpenPresharedKey decrypts a preshared key sealed by SealPresharedKey.
+func OpenPresharedKey(sealed, recipientPrivKey, senderPubKey string) (string, error) {
+	psk, err := open(sealed, recipientPrivKey, senderPubKey)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open sealed preshared key: %s", err)
+	}
+	return psk, nil
+}
+
+// SealRekeyProof proves to the server that a node switching to newPubKey owns
+// the key it's registered with, by sealing the new key with the old one.
+func SealRekeyProof(newPubKey, oldPrivKey, serverPubKey string) (string, error) {
+	return seal(newPubKey, oldPrivKey, serverPubKey)
+}
+
+// OpenRekeyProof returns the new public key in a proof sealed by
+// SealRekeyProof, which only opens if it was sealed by the owner of oldPubKey.
+func OpenRekeyProof(proof, serverPrivKey, oldPubKey string) (string, error) {
+	newPubKey, err := open(proof, serverPrivKey, oldPubKey)
+	if err != nil {
+		return "", fmt.Errorf("Invalid rekey proof: %s", err)
+	}
+	return newPubKey, nil
+}
+
+// seal encrypts message with NaCl box, prefixing it with its nonce.
+func seal(message, senderPrivKey, recipientPubKey string) (string, error) {
+	priv, err := decodeKey(senderPrivKey)
+	if err != nil {
+		return "", err
+	}
+	pub, err := decodeKey(recipientPubKey)
+	if err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", fmt.Errorf("Error while generating nonce: %s", err)
+	}
+	sealed := box.Seal(nonce[:], []byte(message), &nonce, pub, priv)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func open(sealed, recipientPrivKey, senderPubKey string) (string, error) {
+	priv, err := decodeKey(recipientPrivKey)
+	if err != nil {
+		return "", err
+	}
+	pub, err := decodeKey(senderPubKey)
+	if err != nil {
+		return "", err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(decoded) < 24 {
+		return "", fmt.Errorf("not a sealed box")
+	}
+	var nonce [24]byte
+	copy(nonce[:], decoded)
+	message, ok := box.Open(nil, decoded[24:], &nonce, pub, priv)
+	if !ok {
+		return "", fmt.Errorf("it wasn't sealed for this key or by the expected sender")
+	}
+	return string(message), nil
+}
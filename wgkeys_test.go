@@ -0,0 +1,129 @@
+package wiregate
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPublicKey(t *testing.T) {
+	// Test vector from RFC 7748, section 6.1
+	privKey, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	expectedPubKey, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	pubKey, err := PublicKey(base64.StdEncoding.EncodeToString(privKey))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if pubKey != base64.StdEncoding.EncodeToString(expectedPubKey) {
+		t.Errorf("Unexpected public key %s", pubKey)
+	}
+
+	if _, err := PublicKey("notAKey"); err == nil {
+		t.Errorf("Expected error for invalid private key")
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	privKey, pubKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(privKey)
+	if len(decoded) != 32 || decoded[0]&7 != 0 || decoded[31]&128 != 0 || decoded[31]&64 == 0 {
+		t.Errorf("Private key isn't a clamped curve25519 key: %v", decoded)
+	}
+	if derived, _ := PublicKey(privKey); derived != pubKey {
+		t.Errorf("Public key %s doesn't match private key", pubKey)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	_, pubKey, _ := GenerateKeyPair()
+	if err := ValidateKey(pubKey); err != nil {
+		t.Errorf("Expected generated key to be valid, got %s", err)
+	}
+	for _, key := range []string{"", "notAKey", "YWJj"} {
+		if err := ValidateKey(key); err == nil {
+			t.Errorf("Expected error for invalid key %q", key)
+		}
+	}
+}
+
+func TestSealPresharedKey(t *testing.T) {
+	serverPriv, serverPub, _ := GenerateKeyPair()
+	nodePriv, nodePub, _ := GenerateKeyPair()
+	_, otherPub, _ := GenerateKeyPair()
+	psk, err := GeneratePresharedKey()
+	if err != nil || ValidateKey(psk) != nil {
+		t.Fatalf("Invalid preshared key %q: %v", psk, err)
+	}
+
+	sealed, err := SealPresharedKey(psk, serverPriv, nodePub)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if opened, err := OpenPresharedKey(sealed, nodePriv, serverPub); err != nil || opened != psk {
+		t.Errorf("Expected to open %s, got %q (%v)", psk, opened, err)
+	}
+	if _, err := OpenPresharedKey(sealed, nodePriv, otherPub); err == nil {
+		t.Errorf("Expected a key sealed by someone else not to open")
+	}
+}
+
+func TestRekeyProof(t *testing.T) {
+	serverPriv, serverPub, _ := GenerateKeyPair()
+	oldPriv, oldPub, _ := GenerateKeyPair()
+	_, newPub, _ := GenerateKeyPair()
+	otherPriv, _, _ := GenerateKeyPair()
+
+	proof, err := SealRekeyProof(newPub, oldPriv, serverPub)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if opened, err := OpenRekeyProof(proof, serverPriv, oldPub); err != nil || opened != newPub {
+		t.Errorf("Expected proof to carry %s, got %q (%v)", newPub, opened, err)
+	}
+	forged, _ := SealRekeyProof(newPub, otherPriv, serverPub)
+	if _, err := OpenRekeyProof(forged, serverPriv, oldPub); err == nil {
+		t.Errorf("Expected a proof sealed without the old key to be refused")
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	_, pubKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	fingerprint := KeyFingerprint(pubKey)
+	if len(fingerprint) != 16 || fingerprint != KeyFingerprint(pubKey) {
+		t.Errorf("Expected a stable 16 digit fingerprint, got %q", fingerprint)
+	}
+	if KeyFingerprint("notAKey!") != "" {
+		t.Errorf("Expected no fingerprint for an invalid key")
+	}
+}
+
+func TestMeshPresharedKey(t *testing.T) {
+	serverPriv, _, _ := GenerateKeyPair()
+	otherServerPriv, _, _ := GenerateKeyPair()
+	ab, err := MeshPresharedKey(serverPriv, "keyA", "keyB")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ValidateKey(ab) != nil {
+		t.Errorf("Expected a valid preshared key, got %q", ab)
+	}
+	if ba, _ := MeshPresharedKey(serverPriv, "keyB", "keyA"); ba != ab {
+		t.Errorf("Expected both peers of a pair to get the same key, got %s and %s", ab, ba)
+	}
+	if ac, _ := MeshPresharedKey(serverPriv, "keyA", "keyC"); ac == ab {
+		t.Errorf("Expected different pairs to get different keys")
+	}
+	if other, _ := MeshPresharedKey(otherServerPriv, "keyA", "keyB"); other == ab {
+		t.Errorf("Expected different servers to derive different keys")
+	}
+	if _, err := MeshPresharedKey("notAKey", "keyA", "keyB"); err == nil {
+		t.Errorf("Expected an error for an invalid server key")
+	}
+}
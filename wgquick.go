@@ -0,0 +1,65 @@
+package wiregate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WgQuickConfig is a configuration file for wg-quick(8).
+type WgQuickConfig struct {
+	Interface WgQuickInterface
+	Peers     []WgQuickPeer
+}
+
+type WgQuickInterface struct {
+	Address    string
+	PrivateKey string
+	ListenPort int
+	MTU        int
+	FwMark     string
+	DNS        []string
+	PostUp     string
+	PostDown   string
+}
+
+type WgQuickPeer struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+func (c *WgQuickConfig) String() string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	writeOption(&b, "Address", c.Interface.Address)
+	writeOption(&b, "PrivateKey", c.Interface.PrivateKey)
+	writeIntOption(&b, "ListenPort", c.Interface.ListenPort)
+	writeIntOption(&b, "MTU", c.Interface.MTU)
+	writeOption(&b, "FwMark", c.Interface.FwMark)
+	writeOption(&b, "DNS", strings.Join(c.Interface.DNS, ", "))
+	writeOption(&b, "PostUp", c.Interface.PostUp)
+	writeOption(&b, "PostDown", c.Interface.PostDown)
+	for _, p := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		writeOption(&b, "PublicKey", p.PublicKey)
+		writeOption(&b, "PresharedKey", p.PresharedKey)
+		writeOption(&b, "Endpoint", p.Endpoint)
+		writeOption(&b, "AllowedIPs", strings.Join(p.AllowedIPs, ", "))
+		writeIntOption(&b, "PersistentKeepalive", p.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+func writeOption(b *strings.Builder, key, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s = %s\n", key, value)
+	}
+}
+
+func writeIntOption(b *strings.Builder, key string, value int) {
+	if value != 0 {
+		fmt.Fprintf(b, "%s = %d\n", key, value)
+	}
+}
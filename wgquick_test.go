@@ -0,0 +1,35 @@
+package wiregate
+
+import (
+	"testing"
+)
+
+func TestWgQuickConfig(t *testing.T) {
+	conf := &WgQuickConfig{
+		Interface: WgQuickInterface{
+			Address:    "10.24.1.26/24",
+			PrivateKey: "privateKey",
+			MTU:        1380,
+		},
+		Peers: []WgQuickPeer{{
+			PublicKey:           "serverKey",
+			Endpoint:            "192.168.1.134:51820",
+			AllowedIPs:          []string{"10.24.1.0/24", "192.168.50.0/24"},
+			PersistentKeepalive: 25,
+		}},
+	}
+	expected := `[Interface]
+Address = 10.24.1.26/24
+PrivateKey = privateKey
+MTU = 1380
+
+[Peer]
+PublicKey = serverKey
+Endpoint = 192.168.1.134:51820
+AllowedIPs = 10.24.1.0/24, 192.168.50.0/24
+PersistentKeepalive = 25
+`
+	if got := conf.String(); got != expected {
+		t.Errorf("Unexpected config, got:\n%s\nwant:\n%s", got, expected)
+	}
+}